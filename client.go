@@ -9,7 +9,6 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/google/go-querystring/query"
@@ -18,9 +17,6 @@ import (
 
 var (
 	userAgent = "keygen/" + APIVersion + " sdk/" + SDKVersion + " go/" + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH
-
-	// mutex is used to sychronize access to the HTTP client.
-	mutex = &sync.Mutex{}
 )
 
 type Response struct {
@@ -51,6 +47,8 @@ func (r *Response) tldr() string {
 // ClientOptions stores config options used in API requests.
 type ClientOptions struct {
 	Account     string
+	Product     string
+	Package     string
 	Environment string
 	LicenseKey  string
 	Token       string
@@ -59,22 +57,49 @@ type ClientOptions struct {
 	APIVersion  string
 	APIPrefix   string
 	APIURL      string
+
+	// RSAPublicKey is the PEM-encoded RSA public key used for verifying license
+	// keys signed using an RSA scheme. Defaults to empty.
+	RSAPublicKey string
+
+	// HTTPClient is the HTTP client used for API requests. Defaults to the
+	// global HTTPClient when nil.
+	HTTPClient *http.Client
+
+	// Logger is the leveled logger used for the client. Defaults to the
+	// global Logger when nil.
+	Logger LeveledLogger
+
+	// Retries is the retry policy used for failed API requests. Defaults
+	// to the global Retries when nil.
+	Retries *RetryOptions
+
+	// Clock is the trusted clock used for expiry checks. Defaults to the
+	// global Clock when nil.
+	Clock *TrustedClock
+
+	// Scheduler is the heartbeat scheduler used for monitors. Defaults to
+	// the global Scheduler when nil.
+	Scheduler *HeartbeatScheduler
 }
 
 // Client represents the internal HTTP client and config used for API requests.
+// Resources returned by a client, e.g. a License from Client.Validate, are
+// bound to the client, so that any follow-up requests made through that
+// resource use the same config. A Client is safe for concurrent use, and
+// requests are not serialized.
 type Client struct {
-	HTTPClient *http.Client
 	ClientOptions
-
-	mutex *sync.Mutex
 }
 
-// NewClient creates a new Client with default settings.
+// NewClient creates a new Client with default settings, i.e. using the
+// current values of the SDK's global config.
 func NewClient() *Client {
 	client := &Client{
-		HTTPClient,
 		ClientOptions{
 			Account:     Account,
+			Product:     Product,
+			Package:     Package,
 			Environment: Environment,
 			LicenseKey:  LicenseKey,
 			Token:       Token,
@@ -83,8 +108,14 @@ func NewClient() *Client {
 			APIPrefix:   APIPrefix,
 			APIVersion:  APIVersion,
 			APIURL:      APIURL,
+			HTTPClient:  HTTPClient,
+			Logger:      Logger,
+			Retries:     Retries,
+			Clock:       Clock,
+			Scheduler:   Scheduler,
+
+			RSAPublicKey: RSAPublicKey,
 		},
-		mutex,
 	}
 
 	return client
@@ -93,9 +124,10 @@ func NewClient() *Client {
 // NewClientWithOptions creates a new client with custom settings.
 func NewClientWithOptions(options *ClientOptions) *Client {
 	client := &Client{
-		HTTPClient,
 		ClientOptions{
 			Account:     options.Account,
+			Product:     options.Product,
+			Package:     options.Package,
 			Environment: options.Environment,
 			LicenseKey:  options.LicenseKey,
 			Token:       options.Token,
@@ -104,8 +136,24 @@ func NewClientWithOptions(options *ClientOptions) *Client {
 			APIPrefix:   options.APIPrefix,
 			APIVersion:  options.APIVersion,
 			APIURL:      options.APIURL,
+			HTTPClient:  options.HTTPClient,
+			Logger:      options.Logger,
+			Retries:     options.Retries,
+			Clock:       options.Clock,
+			Scheduler:   options.Scheduler,
+
+			RSAPublicKey: options.RSAPublicKey,
 		},
-		mutex,
+	}
+
+	return client
+}
+
+// clientOrDefault returns the provided client, falling back to a new client
+// using the global config, e.g. for a resource that was initialized by hand.
+func clientOrDefault(client *Client) *Client {
+	if client == nil {
+		return NewClient()
 	}
 
 	return client
@@ -164,32 +212,39 @@ func (c *Client) Delete(ctx context.Context, path string, params interface{}, mo
 func (c *Client) new(ctx context.Context, method string, path string, params interface{}) (*http.Request, error) {
 	var url string
 
-	if c.APIVersion == "" {
-		c.APIVersion = APIVersion
-	}
+	// Local vars so we don't mutate the client, since it may be shared
+	// across goroutines
+	account := c.Account
+	version := c.APIVersion
+	prefix := c.APIPrefix
+	host := c.APIURL
 
-	if c.APIPrefix == "" {
-		c.APIPrefix = APIPrefix
+	if version == "" {
+		version = APIVersion
 	}
 
-	if c.APIURL == "" {
-		c.APIURL = APIURL
+	if prefix == "" {
+		prefix = APIPrefix
 	}
 
-	// Local vars so we don't mutate the client
-	account := c.Account
-	prefix := c.APIPrefix
-	host := c.APIURL
+	if host == "" {
+		host = APIURL
+	}
 
 	// Add scheme if not present (e.g. with self-hosted KEYGEN_HOST env var via the CLI)
 	if !strings.HasPrefix(host, "https://") && !strings.HasPrefix(host, "http://") {
 		host = "https://" + host
 	}
 
+	switch {
+	// Support for following links, e.g. a paginated list's next link, which
+	// are already absolute paths
+	case strings.HasPrefix(path, "/"):
+		url = host + path
 	// Support for custom domains
-	if host == "https://api.keygen.sh" {
+	case host == "https://api.keygen.sh":
 		url = fmt.Sprintf("%s/%s/accounts/%s/%s", host, prefix, account, path)
-	} else {
+	default:
 		url = fmt.Sprintf("%s/%s/%s", host, prefix, path)
 	}
 
@@ -217,6 +272,17 @@ func (c *Client) new(ctx context.Context, method string, path string, params int
 			}
 		}
 
+		if opts, ok := params.(ListOptions); ok {
+			values, err := opts.values()
+			if err != nil {
+				return nil, err
+			}
+
+			if enc := values.Encode(); enc != "" {
+				url += "?" + enc
+			}
+		}
+
 		if qs, ok := params.(querystring); ok {
 			values, err := query.Values(qs)
 			if err != nil {
@@ -229,14 +295,16 @@ func (c *Client) new(ctx context.Context, method string, path string, params int
 		}
 	}
 
-	Logger.Infof("Request: method=%s url=%s size=%d", method, url, in.Len())
+	logger := c.logger()
+
+	logger.Infof("Request: method=%s url=%s size=%d", method, url, in.Len())
 	if in.Len() > 0 {
-		Logger.Debugf("        body=%s", in.Bytes())
+		logger.Debugf("        body=%s", in.Bytes())
 	}
 
 	req, err := http.NewRequest(method, url, &in)
 	if err != nil {
-		Logger.Errorf("Error building request: method=%s url=%s err=%v", method, url, err)
+		logger.Errorf("Error building request: method=%s url=%s err=%v", method, url, err)
 
 		return nil, err
 	}
@@ -252,7 +320,7 @@ func (c *Client) new(ctx context.Context, method string, path string, params int
 		req.Header.Add("Keygen-Environment", c.Environment)
 	}
 
-	req.Header.Add("Keygen-Version", c.APIVersion)
+	req.Header.Add("Keygen-Version", version)
 
 	if in.Len() > 0 {
 		req.Header.Add("Content-Type", jsonapi.ContentType)
@@ -264,15 +332,18 @@ func (c *Client) new(ctx context.Context, method string, path string, params int
 	return req.WithContext(ctx), nil
 }
 
-func (c *Client) send(req *http.Request, model interface{}) (*Response, error) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+func (c *Client) attempt(req *http.Request, model interface{}) (*Response, error) {
+	logger := c.logger()
 
-	c.HTTPClient.CheckRedirect = c.checkRedirect
+	// Use a shallow copy of the HTTP client so that we can set our redirect
+	// policy without mutating a client that may be shared, e.g. the global
+	// HTTPClient. The underlying transport, and its pool, is still shared.
+	client := *c.httpClient()
+	client.CheckRedirect = c.checkRedirect
 
-	res, err := c.HTTPClient.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
-		Logger.Errorf("Error performing request: method=%s url=%s err=%v", req.Method, req.URL, err)
+		logger.Errorf("Error performing request: method=%s url=%s err=%v", req.Method, req.URL, err)
 
 		return nil, err
 	}
@@ -282,7 +353,7 @@ func (c *Client) send(req *http.Request, model interface{}) (*Response, error) {
 	res.Body.Close()
 
 	if err != nil {
-		Logger.Errorf("Error reading response body: id=%s status=%d err=%v", requestID, res.StatusCode, err)
+		logger.Errorf("Error reading response body: id=%s status=%d err=%v", requestID, res.StatusCode, err)
 
 		return nil, err
 	}
@@ -296,9 +367,9 @@ func (c *Client) send(req *http.Request, model interface{}) (*Response, error) {
 		Body:    out,
 	}
 
-	Logger.Infof("Response: id=%s status=%d size=%d", response.ID, response.Status, response.Size)
+	logger.Infof("Response: id=%s status=%d size=%d", response.ID, response.Status, response.Size)
 	if response.Size > 0 {
-		Logger.Debugf("         body=%s", response.Body)
+		logger.Debugf("         body=%s", response.Body)
 	}
 
 	// Handle certain error statuses before we check signature
@@ -339,19 +410,24 @@ func (c *Client) send(req *http.Request, model interface{}) (*Response, error) {
 			Err:        err,
 		}
 	case response.Status >= http.StatusInternalServerError:
-		Logger.Errorf("An unexpected API error occurred: id=%s status=%d size=%d body=%s", response.ID, response.Status, response.Size, response.tldr())
+		logger.Errorf("An unexpected API error occurred: id=%s status=%d size=%d body=%s", response.ID, response.Status, response.Size, response.tldr())
 
-		return response, fmt.Errorf("an error occurred: id=%s status=%d size=%d body=%s", response.ID, response.Status, response.Size, response.tldr())
+		return response, &ServerError{&Error{response, "", "", "", ""}}
 	}
 
 	if c.PublicKey != "" {
-		verifier := &verifier{c.PublicKey}
+		verifier := &verifier{PublicKey: c.PublicKey}
 
 		if err := verifier.VerifyResponse(response); err != nil {
-			Logger.Errorf("Error verifying response signature: id=%s status=%d size=%d body=%s err=%v", response.ID, response.Status, response.Size, response.tldr(), err)
+			logger.Errorf("Error verifying response signature: id=%s status=%d size=%d body=%s err=%v", response.ID, response.Status, response.Size, response.tldr(), err)
 
 			return response, err
 		}
+
+		// The response's date is signed, so it can be trusted
+		if t, err := time.Parse(time.RFC1123, response.Headers.Get("Date")); err == nil {
+			c.observe(t)
+		}
 	}
 
 	if response.Status == http.StatusNoContent || response.Size == 0 {
@@ -360,7 +436,7 @@ func (c *Client) send(req *http.Request, model interface{}) (*Response, error) {
 
 	doc, err := jsonapi.Unmarshal(response.Body, model)
 	if err != nil {
-		Logger.Errorf("Error parsing response JSON: id=%s status=%d size=%d body=%s err=%v", response.ID, response.Status, response.Size, response.tldr(), err)
+		logger.Errorf("Error parsing response JSON: id=%s status=%d size=%d body=%s err=%v", response.ID, response.Status, response.Size, response.tldr(), err)
 
 		return response, err
 	}
@@ -403,7 +479,7 @@ func (c *Client) send(req *http.Request, model interface{}) (*Response, error) {
 		case code == ErrorCodeMachineHeartbeatDead || code == ErrorCodeProcessHeartbeatDead:
 			return response, ErrHeartbeatDead
 		case code == ErrorCodeFingerprintTaken:
-			return response, ErrMachineAlreadyActivated
+			return response, fingerprintTaken(err)
 		case code == ErrorCodeMachineLimitExceeded:
 			return response, ErrMachineLimitExceeded
 		case code == ErrorCodeProcessLimitExceeded:
@@ -426,6 +502,30 @@ func (c *Client) send(req *http.Request, model interface{}) (*Response, error) {
 	return response, nil
 }
 
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+
+	return HTTPClient
+}
+
+func (c *Client) scheduler() *HeartbeatScheduler {
+	if c.Scheduler != nil {
+		return c.Scheduler
+	}
+
+	return Scheduler
+}
+
+func (c *Client) logger() LeveledLogger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+
+	return Logger
+}
+
 // We don't want to automatically follow redirects
 func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
 	return http.ErrUseLastResponse
@@ -6,6 +6,33 @@ import (
 	"github.com/keygen-sh/jsonapi-go"
 )
 
+// ComponentMatchingStrategy is a policy's strategy for matching a validation's
+// component fingerprints against a machine's components.
+type ComponentMatchingStrategy string
+
+const (
+	ComponentMatchingStrategyMatchAny  ComponentMatchingStrategy = "MATCH_ANY"
+	ComponentMatchingStrategyMatchTwo  ComponentMatchingStrategy = "MATCH_TWO"
+	ComponentMatchingStrategyMatchMost ComponentMatchingStrategy = "MATCH_MOST"
+	ComponentMatchingStrategyMatchAll  ComponentMatchingStrategy = "MATCH_ALL"
+)
+
+// match reports whether the number of matched component fingerprints satisfies
+// the strategy, out of the total number of fingerprints. An unknown strategy
+// is treated as MATCH_ANY, the API's default.
+func (s ComponentMatchingStrategy) match(matched int, total int) bool {
+	switch s {
+	case ComponentMatchingStrategyMatchAll:
+		return matched == total
+	case ComponentMatchingStrategyMatchMost:
+		return matched >= (total+1)/2
+	case ComponentMatchingStrategyMatchTwo:
+		return matched >= 2
+	default:
+		return matched >= 1
+	}
+}
+
 type component struct {
 	ID          string                 `json:"-"`
 	Type        string                 `json:"-"`
@@ -109,3 +136,41 @@ type Components []Component
 func (c *Components) SetData(to func(target interface{}) error) error {
 	return to(c)
 }
+
+// ComponentChanges are the changes made by Machine.SyncComponents.
+type ComponentChanges struct {
+	// Added are the components that were added to the machine.
+	Added Components
+
+	// Removed are the components that were removed from the machine.
+	Removed Components
+}
+
+// ComponentIterator iterates over a paginated list of components. Pages are fetched
+// as needed, and iteration stops on the first error.
+type ComponentIterator struct{ iterator }
+
+// Next advances the iterator to the next component, returning false when there
+// are no more components or an error occurred.
+func (it *ComponentIterator) Next() bool {
+	return it.advance()
+}
+
+// Component returns the current component.
+func (it *ComponentIterator) Component() *Component {
+	if it.item == nil {
+		return nil
+	}
+
+	return it.item.(*Component)
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *ComponentIterator) Err() error {
+	return it.err
+}
+
+// FilterComponentFingerprint filters a list of components by fingerprint.
+func FilterComponentFingerprint(fingerprint string) ListOption {
+	return ListFilter("fingerprint", fingerprint)
+}
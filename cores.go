@@ -0,0 +1,155 @@
+package keygen
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var (
+	// cgroupRoot is where the cgroup filesystem is mounted.
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// cgroupSelf lists the current process's cgroups.
+	cgroupSelf = "/proc/self/cgroup"
+)
+
+// AvailableCores returns the number of CPU cores available to the current
+// process. In a container, runtime.NumCPU reports the host's cores, so a CPU
+// quota set using cgroup v2's cpu.max, or cgroup v1's cpu.cfs_quota_us and
+// cpu.cfs_period_us, is honored, rounded up to a whole core. The quota is read
+// from the process's own cgroup, per /proc/self/cgroup, and its ancestors, so
+// a nested cgroup, or a host without a cgroup namespace, is also honored. Use
+// it with ActivateCores, e.g. for a policy with a core limit.
+func AvailableCores() int {
+	cores := runtime.NumCPU()
+
+	if quota, ok := cgroupCores(cgroupRoot, cgroupSelf); ok && quota < cores {
+		return quota
+	}
+
+	return cores
+}
+
+// cgroupCores returns the smallest CPU quota of the process's cgroup, listed
+// in the self file, and its ancestors, mounted at root, in whole cores,
+// reporting whether there is a quota.
+func cgroupCores(root string, self string) (int, bool) {
+	paths := cgroupPaths(self)
+	cores, ok := 0, false
+
+	// cgroup v2, i.e. "$MAX $PERIOD", where $MAX may be "max"
+	for _, dir := range cgroupAncestors(root, paths[""]) {
+		data, err := os.ReadFile(filepath.Join(dir, "cpu.max"))
+		if err != nil {
+			continue
+		}
+
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 {
+			continue
+		}
+
+		if quota, found := quotaCores(fields[0], fields[1]); found && (!ok || quota < cores) {
+			cores, ok = quota, true
+		}
+	}
+
+	if ok {
+		return cores, true
+	}
+
+	// cgroup v1, which may be mounted with the cpuacct controller
+	for _, mount := range []string{"cpu", "cpu,cpuacct"} {
+		for _, dir := range cgroupAncestors(filepath.Join(root, mount), paths["cpu"]) {
+			quota, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us"))
+			if err != nil {
+				continue
+			}
+
+			period, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_period_us"))
+			if err != nil {
+				continue
+			}
+
+			if quota, found := quotaCores(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period))); found && (!ok || quota < cores) {
+				cores, ok = quota, true
+			}
+		}
+
+		if ok {
+			return cores, true
+		}
+	}
+
+	return 0, false
+}
+
+// cgroupPaths parses the self file, i.e. /proc/self/cgroup, into the process's
+// cgroup path per controller, e.g. "cpu". The cgroup v2 path is keyed by "".
+// A missing file has no paths.
+func cgroupPaths(self string) map[string]string {
+	paths := map[string]string{}
+
+	data, err := os.ReadFile(self)
+	if err != nil {
+		return paths
+	}
+
+	// Each line is "$ID:$CONTROLLERS:$PATH", where $CONTROLLERS is empty for v2
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		if parts[1] == "" {
+			paths[""] = parts[2]
+
+			continue
+		}
+
+		for _, controller := range strings.Split(parts[1], ",") {
+			paths[controller] = parts[2]
+		}
+	}
+
+	return paths
+}
+
+// cgroupAncestors returns the dirs of the cgroup at path, mounted at root, and
+// of each of its ancestors, up to and including root. Without a cgroup
+// namespace, the process's cgroup may not be mounted, e.g. in a container, in
+// which case only root is honored.
+func cgroupAncestors(root string, path string) []string {
+	dirs := []string{}
+
+	for path = filepath.Clean("/" + path); path != "/"; path = filepath.Dir(path) {
+		dirs = append(dirs, filepath.Join(root, path))
+	}
+
+	return append(dirs, root)
+}
+
+// quotaCores converts a CPU quota and period into whole cores. An unlimited
+// quota, i.e. "max" or -1, isn't a quota.
+func quotaCores(quota string, period string) (int, bool) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+
+	cores := int((q + p - 1) / p)
+	if cores < 1 {
+		cores = 1
+	}
+
+	return cores, true
+}
@@ -5,30 +5,42 @@ import (
 	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"strings"
 )
 
+// errDecryptionFailed is returned when a certificate can't be authenticated
+// using the secret, i.e. the secret is wrong, or the certificate was tampered
+// with.
+var errDecryptionFailed = errors.New("certificate decryption failed")
+
 type decryptor struct {
 	Secret string
 }
 
+// DecryptCertificate decrypts the certificate using the secret. It returns
+// ErrFileFormatInvalid when the certificate is malformed, and
+// errDecryptionFailed when it can't be authenticated using the secret.
 func (d *decryptor) DecryptCertificate(cert *certificate) ([]byte, error) {
 	parts := strings.SplitN(cert.Enc, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrFileFormatInvalid
+	}
 
 	// Decode parts
 	ciphertext, err := base64.StdEncoding.DecodeString(parts[0])
 	if err != nil {
-		return nil, err
+		return nil, ErrFileFormatInvalid
 	}
 
 	iv, err := base64.StdEncoding.DecodeString(parts[1])
 	if err != nil {
-		return nil, err
+		return nil, ErrFileFormatInvalid
 	}
 
 	tag, err := base64.StdEncoding.DecodeString(parts[2])
 	if err != nil {
-		return nil, err
+		return nil, ErrFileFormatInvalid
 	}
 
 	// Hash secret
@@ -48,13 +60,18 @@ func (d *decryptor) DecryptCertificate(cert *certificate) ([]byte, error) {
 		return nil, err
 	}
 
+	// Open panics for a nonce of the wrong size
+	if len(iv) != aes.NonceSize() {
+		return nil, ErrFileFormatInvalid
+	}
+
 	// Append auth tag to ciphertext
 	ciphertext = append(ciphertext, tag...)
 
 	// Decrypt
 	plaintext, err := aes.Open(nil, iv, ciphertext, nil)
 	if err != nil {
-		return nil, err
+		return nil, errDecryptionFailed
 	}
 
 	return plaintext, nil
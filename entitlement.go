@@ -38,3 +38,32 @@ type Entitlements []Entitlement
 func (e *Entitlements) SetData(to func(target interface{}) error) error {
 	return to(e)
 }
+
+// EntitlementIterator iterates over a paginated list of entitlements. Pages are fetched
+// as needed, and iteration stops on the first error.
+type EntitlementIterator struct{ iterator }
+
+// Next advances the iterator to the next entitlement, returning false when there
+// are no more entitlements or an error occurred.
+func (it *EntitlementIterator) Next() bool {
+	return it.advance()
+}
+
+// Entitlement returns the current entitlement.
+func (it *EntitlementIterator) Entitlement() *Entitlement {
+	if it.item == nil {
+		return nil
+	}
+
+	return it.item.(*Entitlement)
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *EntitlementIterator) Err() error {
+	return it.err
+}
+
+// FilterEntitlementCode filters a list of entitlements by code.
+func FilterEntitlementCode(code EntitlementCode) ListOption {
+	return ListFilter("code", string(code))
+}
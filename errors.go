@@ -3,6 +3,7 @@ package keygen
 import (
 	"errors"
 	"fmt"
+	"path"
 	"time"
 )
 
@@ -75,6 +76,55 @@ type NotFoundError struct{ Err *Error }
 func (e *NotFoundError) Error() string { return "resource was not found" }
 func (e *NotFoundError) Unwrap() error { return e.Err }
 
+// notFound reports whether err is a *NotFoundError.
+func notFound(err error) bool {
+	var notFoundErr *NotFoundError
+
+	return errors.As(err, &notFoundErr)
+}
+
+// fingerprintTaken returns the sentinel error for a taken fingerprint. The API
+// reports a component's taken fingerprint like a machine's, so it's told apart
+// using the request's resource type, i.e. ErrComponentAlreadyActivated when
+// adding a component, and ErrMachineAlreadyActivated otherwise.
+func fingerprintTaken(err *Error) error {
+	if res := err.Response; res != nil && res.Request != nil && path.Base(res.Request.URL.Path) == "components" {
+		return ErrComponentAlreadyActivated
+	}
+
+	return ErrMachineAlreadyActivated
+}
+
+// ServerError represents an unexpected API error, i.e. a 5xx response.
+type ServerError struct{ Err *Error }
+
+func (e *ServerError) Error() string { return "an unexpected API error occurred" }
+func (e *ServerError) Unwrap() error { return e.Err }
+
+// ValidationError represents an invalid license validation, as returned by
+// License.LastValidationError. It carries the validation result and the
+// validated license, and it matches the sentinel error for the result's code
+// using errors.Is, e.g. ErrLicenseNoMachine, as well as any less specific
+// sentinel, e.g. ErrLicenseNotActivated.
+type ValidationError struct {
+	Result     ValidationResult
+	License    *License
+	ResponseID string
+	Err        error
+
+	// generic is the less specific sentinel error for the code, if any
+	generic error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// Is reports whether the target is the less specific sentinel error for the
+// validation code, e.g. ErrLicenseNotActivated for ErrLicenseNoMachine.
+func (e *ValidationError) Is(target error) bool {
+	return e.generic != nil && target == e.generic
+}
+
 // LicenseFileError represents an invalid license file error.
 type LicenseFileError struct{ Err error }
 
@@ -124,9 +174,11 @@ var (
 	ErrValidationFingerprintMissing = errors.New("validation fingerprint scope is missing")
 	ErrValidationComponentsMissing  = errors.New("validation components scope is missing")
 	ErrValidationProductMissing     = errors.New("validation product scope is missing")
+	ErrValidationNonceMismatch      = errors.New("validation nonce does not match")
 	ErrHeartbeatPingFailed          = errors.New("heartbeat ping failed")
 	ErrHeartbeatRequired            = errors.New("heartbeat is required")
 	ErrHeartbeatDead                = errors.New("heartbeat is dead")
+	ErrHeartbeatSchedulerClosed     = errors.New("heartbeat scheduler is closed")
 	ErrMachineAlreadyActivated      = errors.New("machine is already activated")
 	ErrMachineLimitExceeded         = errors.New("machine limit has been exceeded")
 	ErrMachineNotFound              = errors.New("machine no longer exists")
@@ -135,6 +187,8 @@ var (
 	ErrMachineFileNotEncrypted      = errors.New("machine file is not encrypted")
 	ErrMachineFileNotGenuine        = errors.New("machine file is not genuine")
 	ErrMachineFileExpired           = errors.New("machine file is expired")
+	ErrMachineFileSecretMissing     = errors.New("machine file secret is missing")
+	ErrMachineFileFormatInvalid     = errors.New("machine file format is invalid")
 	ErrComponentNotActivated        = errors.New("component is not activated")
 	ErrComponentAlreadyActivated    = errors.New("component is already activated")
 	ErrComponentConflict            = errors.New("component is duplicated")
@@ -143,6 +197,8 @@ var (
 	ErrLicenseSchemeMissing         = errors.New("license scheme is missing")
 	ErrLicenseKeyMissing            = errors.New("license key is missing")
 	ErrLicenseKeyNotGenuine         = errors.New("license key is not genuine")
+	ErrLicenseKeyExpired            = errors.New("license key is expired")
+	ErrLicenseKeyDatasetInvalid     = errors.New("license key dataset is invalid")
 	ErrLicenseNotActivated          = errors.New("license is not activated")
 	ErrLicenseNotAllowed            = errors.New("license authentication is not allowed by policy")
 	ErrLicenseExpired               = errors.New("license is expired")
@@ -157,9 +213,36 @@ var (
 	ErrLicenseFileNotGenuine        = errors.New("license file is not genuine")
 	ErrLicenseFileExpired           = errors.New("license file is expired")
 	ErrLicenseFileSecretMissing     = errors.New("license file secret is missing")
+	ErrLicenseFileFormatInvalid     = errors.New("license file format is invalid")
+	ErrFileFormatInvalid            = errors.New("file is not a license file or machine file")
 	ErrTokenNotAllowed              = errors.New("token authentication is not allowed by policy")
 	ErrTokenFormatInvalid           = errors.New("token format is invalid")
 	ErrTokenInvalid                 = errors.New("token is invalid")
 	ErrTokenExpired                 = errors.New("token is expired")
 	ErrSystemClockUnsynced          = errors.New("system clock is out of sync")
 )
+
+// Validation errors, one per validation code
+var (
+	ErrLicenseNotFound                    = errors.New("license was not found")
+	ErrLicenseOverdue                     = errors.New("license is overdue for check-in")
+	ErrLicenseNoMachine                   = errors.New("license has no machine")
+	ErrLicenseNoMachines                  = errors.New("license has no machines")
+	ErrLicenseEntitlementsMissing         = errors.New("license is missing entitlements")
+	ErrValidationFingerprintScopeRequired = errors.New("validation fingerprint scope is required")
+	ErrValidationFingerprintScopeMismatch = errors.New("validation fingerprint scope does not match")
+	ErrValidationFingerprintScopeEmpty    = errors.New("validation fingerprint scope is empty")
+	ErrValidationComponentsScopeRequired  = errors.New("validation components scope is required")
+	ErrValidationComponentsScopeEmpty     = errors.New("validation components scope is empty")
+	ErrValidationProductScopeRequired     = errors.New("validation product scope is required")
+	ErrValidationProductScopeMismatch     = errors.New("validation product scope does not match")
+	ErrValidationPolicyScopeRequired      = errors.New("validation policy scope is required")
+	ErrValidationPolicyScopeMismatch      = errors.New("validation policy scope does not match")
+	ErrValidationMachineScopeRequired     = errors.New("validation machine scope is required")
+	ErrValidationMachineScopeMismatch     = errors.New("validation machine scope does not match")
+	ErrValidationEntitlementsScopeEmpty   = errors.New("validation entitlements scope is empty")
+	ErrValidationUserScopeRequired        = errors.New("validation user scope is required")
+	ErrValidationUserScopeMismatch        = errors.New("validation user scope does not match")
+	ErrValidationChecksumScopeRequired    = errors.New("validation checksum scope is required")
+	ErrValidationChecksumScopeMismatch    = errors.New("validation checksum scope does not match")
+)
@@ -0,0 +1,153 @@
+package keygen
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	licenseFileHeader = "-----BEGIN LICENSE FILE-----"
+	machineFileHeader = "-----BEGIN MACHINE FILE-----"
+)
+
+// File represents a license file or a machine file, e.g. one loaded from disk
+// using LoadFile. Use a type switch to get the *LicenseFile or *MachineFile.
+type File interface {
+	// Verify verifies the file's signature.
+	Verify() error
+
+	// Save atomically writes the file's certificate to the path.
+	Save(path string) error
+
+	certificate() (*certificate, error)
+}
+
+// ReadFile reads a license file or a machine file certificate from the reader,
+// detecting its kind from its header. It returns a *LicenseFile or a
+// *MachineFile, or ErrFileFormatInvalid if it is neither.
+func ReadFile(r io.Reader) (File, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := string(data)
+	header := strings.TrimSpace(cert)
+
+	switch {
+	case strings.HasPrefix(header, licenseFileHeader):
+		return &LicenseFile{Certificate: cert}, nil
+	case strings.HasPrefix(header, machineFileHeader):
+		return &MachineFile{Certificate: cert}, nil
+	default:
+		return nil, ErrFileFormatInvalid
+	}
+}
+
+// LoadFile loads a license file or a machine file from the path. See ReadFile
+// for more info.
+func LoadFile(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadFile(f)
+}
+
+// ReadLicenseFile reads a license file certificate from the reader. It returns
+// ErrLicenseFileFormatInvalid if it is not a license file.
+func ReadLicenseFile(r io.Reader) (*LicenseFile, error) {
+	file, err := ReadFile(r)
+	if err != nil && err != ErrFileFormatInvalid {
+		return nil, err
+	}
+
+	lic, ok := file.(*LicenseFile)
+	if !ok {
+		return nil, ErrLicenseFileFormatInvalid
+	}
+
+	return lic, nil
+}
+
+// LoadLicenseFile loads a license file from the path. It returns
+// ErrLicenseFileFormatInvalid if it is not a license file.
+func LoadLicenseFile(path string) (*LicenseFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadLicenseFile(f)
+}
+
+// ReadMachineFile reads a machine file certificate from the reader. It returns
+// ErrMachineFileFormatInvalid if it is not a machine file.
+func ReadMachineFile(r io.Reader) (*MachineFile, error) {
+	file, err := ReadFile(r)
+	if err != nil && err != ErrFileFormatInvalid {
+		return nil, err
+	}
+
+	lic, ok := file.(*MachineFile)
+	if !ok {
+		return nil, ErrMachineFileFormatInvalid
+	}
+
+	return lic, nil
+}
+
+// LoadMachineFile loads a machine file from the path. It returns
+// ErrMachineFileFormatInvalid if it is not a machine file.
+func LoadMachineFile(path string) (*MachineFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadMachineFile(f)
+}
+
+// writeFile atomically writes the data to the path, readable and writable by
+// the current user only. The data is written to a temporary file in the same
+// directory, which is then renamed over the path, so that a reader never sees
+// a partially written file.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	// Clean up the temporary file on failure
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
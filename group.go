@@ -0,0 +1,33 @@
+package keygen
+
+import "time"
+
+// Group represents a Keygen group object.
+type Group struct {
+	ID          string                 `json:"-"`
+	Type        string                 `json:"-"`
+	Name        string                 `json:"name"`
+	MaxUsers    int                    `json:"maxUsers"`
+	MaxLicenses int                    `json:"maxLicenses"`
+	MaxMachines int                    `json:"maxMachines"`
+	Created     time.Time              `json:"created"`
+	Updated     time.Time              `json:"updated"`
+	Metadata    map[string]interface{} `json:"metadata"`
+}
+
+// SetID implements the jsonapi.UnmarshalResourceIdentifier interface.
+func (g *Group) SetID(id string) error {
+	g.ID = id
+	return nil
+}
+
+// SetType implements the jsonapi.UnmarshalResourceIdentifier interface.
+func (g *Group) SetType(t string) error {
+	g.Type = t
+	return nil
+}
+
+// SetData implements the jsonapi.UnmarshalData interface.
+func (g *Group) SetData(to func(target interface{}) error) error {
+	return to(g)
+}
@@ -0,0 +1,355 @@
+package keygen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// heartbeatLag is subtracted from a heartbeat window, to account for any
+	// network lag.
+	heartbeatLag = 30 * time.Second
+
+	// defaultHeartbeatDuration is the API's default heartbeat window, used
+	// when a machine doesn't have one.
+	defaultHeartbeatDuration = 10 * time.Minute
+
+	// heartbeatMinBackoff is the backoff used before the first retry of a
+	// failed heartbeat ping.
+	heartbeatMinBackoff = time.Second
+)
+
+// closed is an already closed channel, i.e. a Done channel for something that
+// was never started.
+var closed = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+
+	return c
+}()
+
+// MonitorOptions stores config options used by a heartbeat monitor.
+type MonitorOptions struct {
+	// Interval is the interval between heartbeat pings. Defaults to the
+	// machine's heartbeat window minus 30 seconds to account for any network
+	// lag, or half of the window when it's a minute or shorter.
+	Interval time.Duration
+
+	// OnError is called for each failed heartbeat ping. Transient failures,
+	// e.g. network errors, are retried with backoff within the heartbeat
+	// window, while other failures, e.g. ErrHeartbeatDead, stop the monitor.
+	// It is called from one of the scheduler's workers, so it should not block,
+	// but it's safe to stop the monitor from it, i.e. by calling Stop.
+	OnError func(error)
+
+	// OnResurrected is called when a heartbeat ping resurrects the machine
+	// after its heartbeat died, i.e. its heartbeat status is RESURRECTED.
+	// It is called from one of the scheduler's workers, so it should not block,
+	// but it's safe to stop the monitor from it, i.e. by calling Stop.
+	OnResurrected func()
+}
+
+// heartbeatEnd is the reason a monitor ended.
+type heartbeatEnd int
+
+const (
+	heartbeatRunning heartbeatEnd = iota
+	heartbeatStopped
+	heartbeatCanceled
+	heartbeatFailed
+)
+
+// HeartbeatMonitor sends heartbeat pings for a machine or a process in the
+// background, using the client's heartbeat scheduler. Use
+// Machine.MonitorWithOptions to start a monitor. A HeartbeatMonitor is safe
+// for concurrent use.
+type HeartbeatMonitor struct {
+	opts      MonitorOptions
+	ping      func(ctx context.Context) (HeartbeatStatusCode, error)
+	window    time.Duration
+	logger    LeveledLogger
+	scheduler *HeartbeatScheduler
+	canceled  func()
+	parent    context.Context
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	// Guarded by the scheduler's mutex
+	due     time.Time
+	index   int
+	running bool
+	ending  heartbeatEnd
+
+	// Only used by the worker sending the monitor's ping
+	deadline time.Time
+	backoff  RetryOptions
+
+	mu       sync.Mutex
+	status   HeartbeatStatusCode
+	err      error
+	failures int
+	caller   uint64
+}
+
+// Monitor sends a heartbeat ping for the current Machine, and then keeps sending
+// pings in the background until ctx is canceled. Pings are sent according to
+// the machine's heartbeat window, minus 30 seconds to account for any network
+// lag. An error will be returned if the first ping fails, e.g. ErrHeartbeatDead.
+// Subsequent ping errors are logged. Use MonitorWithOptions to stop the monitor,
+// or to handle its errors.
+func (m *Machine) Monitor(ctx context.Context) error {
+	_, err := m.MonitorWithOptions(ctx, MonitorOptions{})
+
+	return err
+}
+
+// MonitorWithOptions sends a heartbeat ping for the current Machine, and then
+// starts a monitor that keeps sending pings in the background, until ctx is
+// canceled, the monitor is stopped, or a ping fails with a non-transient error,
+// e.g. ErrHeartbeatDead. An error will be returned if the first ping fails.
+func (m *Machine) MonitorWithOptions(ctx context.Context, options MonitorOptions) (*HeartbeatMonitor, error) {
+	if err := m.ping(ctx); err != nil {
+		return nil, err
+	}
+
+	if m.HeartbeatStatus == HeartbeatStatusCodeResurrected && options.OnResurrected != nil {
+		options.OnResurrected()
+	}
+
+	client := clientOrDefault(m.client)
+	pinger := heartbeatClient(client)
+	ping := func(ctx context.Context) (HeartbeatStatusCode, error) {
+		// Ping a copy, so that the machine isn't written concurrently
+		machine := &Machine{ID: m.ID, client: pinger}
+		if err := machine.ping(ctx); err != nil {
+			return "", err
+		}
+
+		return machine.HeartbeatStatus, nil
+	}
+
+	window := time.Duration(m.HeartbeatDuration) * time.Second
+
+	return startHeartbeat(ctx, client, ping, window, m.HeartbeatStatus, options, nil)
+}
+
+// startHeartbeat starts a monitor that sends heartbeat pings in the background,
+// according to the heartbeat window. When canceled is not nil, it's called if
+// the monitor stops because ctx was canceled, rather than by Stop or a failed
+// ping.
+func startHeartbeat(ctx context.Context, client *Client, ping func(ctx context.Context) (HeartbeatStatusCode, error), window time.Duration, status HeartbeatStatusCode, options MonitorOptions, canceled func()) (*HeartbeatMonitor, error) {
+	if window <= 0 {
+		window = defaultHeartbeatDuration
+	}
+
+	if options.Interval <= 0 {
+		options.Interval = heartbeatInterval(window)
+	}
+
+	backoff := RetryOptions{MinBackoff: heartbeatMinBackoff, MaxBackoff: options.Interval}
+	if backoff.MinBackoff > backoff.MaxBackoff {
+		backoff.MinBackoff = backoff.MaxBackoff
+	}
+
+	scheduler := client.scheduler()
+	pctx, cancel := context.WithCancel(ctx)
+	monitor := &HeartbeatMonitor{
+		opts:      options,
+		ping:      ping,
+		window:    window,
+		logger:    client.logger(),
+		scheduler: scheduler,
+		canceled:  canceled,
+		parent:    ctx,
+		ctx:       pctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		index:     -1,
+		deadline:  time.Now().Add(window),
+		backoff:   backoff,
+		status:    status,
+	}
+
+	if err := scheduler.schedule(monitor); err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	return monitor, nil
+}
+
+// heartbeatClient returns a copy of the client that doesn't retry failed
+// requests, since the monitor retries failed pings using its own backoff, and
+// a retried ping would hold a scheduler worker.
+func heartbeatClient(client *Client) *Client {
+	c := *client
+	c.Retries = &RetryOptions{MaxAttempts: 1}
+
+	return &c
+}
+
+// heartbeatInterval returns the default interval between pings for a heartbeat
+// window.
+func heartbeatInterval(window time.Duration) time.Duration {
+	if window <= 2*heartbeatLag {
+		return window / 2
+	}
+
+	return window - heartbeatLag
+}
+
+// Stop stops the monitor, canceling its in-flight ping, if any, and waits for
+// it to be removed from its scheduler. It's safe to call from the monitor's
+// callbacks, e.g. OnError, in which case it doesn't wait, and the monitor is
+// removed once the callback returns.
+func (h *HeartbeatMonitor) Stop() {
+	h.scheduler.end(h, heartbeatStopped)
+	h.cancel()
+
+	// The callback's caller removes the monitor, so waiting would deadlock
+	h.mu.Lock()
+	calling := h.caller != 0 && h.caller == goid()
+	h.mu.Unlock()
+
+	if calling {
+		return
+	}
+
+	<-h.done
+}
+
+// Done returns a channel that is closed once the monitor has stopped.
+func (h *HeartbeatMonitor) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns the error that stopped the monitor, e.g. ErrHeartbeatDead. It
+// returns nil while the monitor is running, or when it was stopped by Stop or
+// by canceling its context.
+func (h *HeartbeatMonitor) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.err
+}
+
+// Status returns the machine's heartbeat status, as of the last successful
+// heartbeat ping.
+func (h *HeartbeatMonitor) Status() HeartbeatStatusCode {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.status
+}
+
+// Failures returns the number of consecutive failed heartbeat pings, since
+// the last successful ping.
+func (h *HeartbeatMonitor) Failures() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.failures
+}
+
+// record records the result of a heartbeat ping, returning the wait until the
+// next ping, or the reason the monitor ended, e.g. after ErrHeartbeatDead.
+func (h *HeartbeatMonitor) record(status HeartbeatStatusCode, err error) (time.Duration, heartbeatEnd) {
+	if err != nil {
+		// The monitor was stopped or canceled while the ping was in flight
+		if h.ctx.Err() != nil {
+			return 0, heartbeatRunning
+		}
+
+		h.mu.Lock()
+		h.failures++
+		failures := h.failures
+		h.mu.Unlock()
+
+		h.logger.Errorf("Heartbeat ping failed: attempt=%d err=%v", failures, err)
+
+		if h.opts.OnError != nil {
+			h.call(func() { h.opts.OnError(err) })
+		}
+
+		if !transient(err) {
+			h.mu.Lock()
+			h.err = err
+			h.mu.Unlock()
+
+			return 0, heartbeatFailed
+		}
+
+		wait := h.backoff.backoff(failures - 1)
+
+		// Retry before the heartbeat window closes, when it's still open
+		if remaining := time.Until(h.deadline); remaining > 0 && wait > remaining/2 {
+			wait = remaining / 2
+		}
+
+		return wait, heartbeatRunning
+	}
+
+	h.mu.Lock()
+	h.status = status
+	h.failures = 0
+	h.mu.Unlock()
+
+	if status == HeartbeatStatusCodeResurrected && h.opts.OnResurrected != nil {
+		h.call(h.opts.OnResurrected)
+	}
+
+	h.deadline = time.Now().Add(h.window)
+
+	return h.opts.Interval, heartbeatRunning
+}
+
+// call calls one of the monitor's callbacks, e.g. OnError, recording the
+// calling goroutine, so that Stop knows not to wait for the monitor to be
+// removed when called from the callback, but still waits when called from
+// any other goroutine. A monitor's callbacks are never called concurrently.
+func (h *HeartbeatMonitor) call(fn func()) {
+	h.mu.Lock()
+	h.caller = goid()
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		h.caller = 0
+		h.mu.Unlock()
+	}()
+
+	fn()
+}
+
+// goid returns the current goroutine's ID, parsed from the first line of its
+// stack trace, i.e. "goroutine $ID [$STATUS]:".
+func goid() uint64 {
+	buf := make([]byte, 64)
+	buf = bytes.TrimPrefix(buf[:runtime.Stack(buf, false)], []byte("goroutine "))
+
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		if id, err := strconv.ParseUint(string(buf[:i]), 10, 64); err == nil {
+			return id
+		}
+	}
+
+	return 0
+}
+
+// transient reports whether a failed request may succeed when retried, e.g. a
+// network error, as opposed to e.g. ErrHeartbeatDead.
+func transient(err error) bool {
+	var serverErr *ServerError
+	var rateLimitErr *RateLimitError
+	var netErr net.Error
+
+	return errors.As(err, &serverErr) || errors.As(err, &rateLimitErr) || errors.As(err, &netErr)
+}
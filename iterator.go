@@ -0,0 +1,109 @@
+package keygen
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// iterator implements the paging for the typed resource iterators, e.g. a
+// MachineIterator. Pages are fetched lazily, following the JSON:API next
+// link of each page until there are no more pages.
+type iterator struct {
+	ctx    context.Context
+	client *Client
+	path   string
+	params ListOptions
+	next   string
+	done   bool
+	items  []interface{}
+	item   interface{}
+	err    error
+
+	// page returns a model for the next page, and a func that returns the
+	// page's items once the model has been unmarshaled.
+	page func() (interface{}, func() []interface{})
+}
+
+func newIterator(ctx context.Context, client *Client, path string, options []ListOption, page func() (interface{}, func() []interface{})) iterator {
+	it := iterator{ctx: ctx, client: client, path: path, page: page}
+
+	opts := ListOptions{PageSize: 100, PageNumber: 1}
+	for _, opt := range options {
+		if err := opt(&opts); err != nil {
+			it.err = err
+
+			return it
+		}
+	}
+
+	it.params = opts
+
+	return it
+}
+
+// advance moves the iterator to the next item, fetching the next page when
+// the current page has been exhausted.
+func (it *iterator) advance() bool {
+	for len(it.items) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+
+			return false
+		}
+
+		it.fetch()
+	}
+
+	it.item, it.items = it.items[0], it.items[1:]
+
+	return true
+}
+
+func (it *iterator) fetch() {
+	model, items := it.page()
+
+	var res *Response
+	var err error
+
+	if it.next != "" {
+		res, err = it.client.Get(it.ctx, it.next, nil, model)
+	} else {
+		res, err = it.client.Get(it.ctx, it.path, it.params, model)
+	}
+
+	if err != nil {
+		it.err = err
+
+		return
+	}
+
+	it.items = items()
+	it.next = nextLink(res)
+
+	if it.next == "" || len(it.items) == 0 {
+		it.done = true
+	}
+}
+
+// nextLink returns the JSON:API next link for a paginated response, if any.
+func nextLink(res *Response) string {
+	var doc struct {
+		Links struct {
+			Next string `json:"next"`
+		} `json:"links"`
+	}
+
+	if res == nil || res.Size == 0 {
+		return ""
+	}
+
+	if err := json.Unmarshal(res.Body, &doc); err != nil {
+		return ""
+	}
+
+	return doc.Links.Next
+}
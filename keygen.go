@@ -45,6 +45,10 @@ var (
 	// and API response signatures.
 	PublicKey string
 
+	// RSAPublicKey is the PEM-encoded Keygen RSA public key used for verifying
+	// license keys signed using an RSA scheme, e.g. RSA_2048_PKCS1_SIGN_V2.
+	RSAPublicKey string
+
 	// UserAgent defines the user-agent string sent to the API backend,
 	// uniquely identifying an integration.
 	UserAgent string
@@ -63,8 +67,26 @@ var (
 	// attacks. Set to -1 to disable.
 	MaxClockDrift = time.Duration(5) * time.Minute
 
+	// Clock is the trusted clock used for expiry checks, which detects a
+	// system clock that was turned back. See NewTrustedClock. Defaults to
+	// nil, i.e. the system clock.
+	Clock *TrustedClock
+
+	// Scheduler is the heartbeat scheduler used by machine monitors and
+	// process monitors, e.g. Machine.Monitor and Machine.Spawn. Its
+	// goroutines are started once its first monitor is scheduled.
+	Scheduler = NewHeartbeatScheduler(SchedulerOptions{})
+
 	// HTTPClient is the internal HTTP client used by the SDK for API
 	// requests. Set this to a custom HTTP client, to implement e.g.
-	// automatic retries, rate limiting checks, or for tests.
+	// custom transports, or for tests.
 	HTTPClient = cleanhttp.DefaultPooledClient()
+
+	// Retries is the retry policy used by the SDK for failed API requests,
+	// e.g. rate limited requests or 5xx responses. Set to nil to disable.
+	Retries = &RetryOptions{
+		MaxAttempts: 3,
+		MinBackoff:  500 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+	}
 )
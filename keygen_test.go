@@ -2,33 +2,71 @@ package keygen
 
 import (
 	"bytes"
+	"container/heap"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/denisbrodbeck/machineid"
 	"github.com/google/uuid"
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/keygen-sh/keygen-go/v3/keygentest"
 )
 
-func init() {
+var srv *keygentest.Server
+
+func TestMain(m *testing.M) {
 	log := Logger.(*logger)
 	log.Level = LogLevelDebug
 
-	if url := os.Getenv("KEYGEN_CUSTOM_DOMAIN"); url != "" {
-		APIURL = url
-	}
-
-	PublicKey = os.Getenv("KEYGEN_PUBLIC_KEY")
-	Environment = os.Getenv("KEYGEN_ENVIRONMENT_ID")
-	Account = os.Getenv("KEYGEN_ACCOUNT_ID")
-	Product = os.Getenv("KEYGEN_PRODUCT_ID")
-	LicenseKey = os.Getenv("KEYGEN_LICENSE_KEY")
-	Token = os.Getenv("KEYGEN_LICENSE_TOKEN")
+	srv = keygentest.NewServer()
+
+	expiry := time.Now().Add(365 * 24 * time.Hour)
+	license := srv.AddLicense(keygentest.License{
+		Name:                    "Test License",
+		Key:                     `{"entitlements":["TEST_ENTITLEMENT_A","TEST_ENTITLEMENT_B"]}`,
+		Scheme:                  string(SchemeCodeEd25519),
+		Expiry:                  &expiry,
+		Entitlements:            []string{"TEST_ENTITLEMENT_A", "TEST_ENTITLEMENT_B"},
+		MaxMachines:             1,
+		MaxProcesses:            5,
+		RequireHeartbeat:        true,
+		RequireFingerprintScope: true,
+	})
+
+	APIURL = srv.URL
+	PublicKey = srv.PublicKey
+	Account = srv.Account
+	Product = srv.Product
+	LicenseKey = license.Key
 	Logger = log
+
+	code := m.Run()
+	srv.Close()
+
+	os.Exit(code)
 }
 
 func TestValidate(t *testing.T) {
@@ -38,7 +76,7 @@ func TestValidate(t *testing.T) {
 		t.Fatalf("Should fingerprint the current machine: err=%v", err)
 	}
 
-	if _, err := Validate(ctx); err != ErrValidationFingerprintMissing {
+	if _, err := Validate(ctx); !errors.Is(err, ErrValidationFingerprintMissing) {
 		t.Fatalf("Should have a required scope: err=%v", err)
 	}
 
@@ -61,9 +99,9 @@ func TestValidate(t *testing.T) {
 	}
 
 	switch {
-	case err == ErrLicenseInvalid:
+	case errors.Is(err, ErrLicenseInvalid):
 		t.Fatalf("Should be a valid license: err=%v", err)
-	case err == ErrLicenseNotActivated:
+	case errors.Is(err, ErrLicenseNotActivated):
 		switch {
 		case license.LastValidation.Code != ValidationCodeNoMachine:
 			t.Fatalf("Should store last validation code: code=%s", license.LastValidation.Code)
@@ -407,7 +445,7 @@ func TestValidate(t *testing.T) {
 				t.Fatalf("Should be scoped to components: scope=%v", license.LastValidation)
 			}
 
-			if err := license.Validate(ctx, fingerprint, uuid.NewString()); err != ErrComponentNotActivated {
+			if err := license.Validate(ctx, fingerprint, uuid.NewString()); !errors.Is(err, ErrComponentNotActivated) {
 				t.Fatalf("Should be invalid: err=%v", err)
 			}
 
@@ -467,9 +505,15 @@ func TestValidate(t *testing.T) {
 }
 
 func TestLicenseFile(t *testing.T) {
-	lic := &LicenseFile{Certificate: "-----BEGIN LICENSE FILE-----\neyJlbmMiOiJDK2dneG5xRkJ6RURXMWc1YTBrUTE4OHBpdU9BL09vMkZDeUov\na2tlVk5QL3lJRTJGTVVXeXJZWUpzVGdmNXNIWFk3dko0My9Eb1JlRlluQ3VO\nSHprazFJOXZZdVpOWm9rWExSSHJvVkdxQXhBQ0pSN0R6dUJVTDk2bjI3VTcw\nNTRpR21DbjZOYmxVOVJzOUF0dGxRZ0kxZ2FNNUdaaE0walAzaGZvTnFkdzZu\nK3M2Y3M2Q2xRNGg5SmlEeTlvRGQzYmxFMEx4c0tYekhDS2graGtNSmtkbTZU\ndG9FWkU0eDdFOE4rWWNNM1hhdnJzSnNDL2k5MUdWQk9aT2pWZkdDNFg2dlV4\nK2RScGszT3dpMUF5QTh3MVRTazE3QVVaRlZrcVpiSEZyM2l0T3hxc0ZBbUNB\nWExVOTl4UzU2SGdWM0pZWGFVL2tKNTZETkhBOXNaTnVUcWxHR05sQXo5bUN0\nM1dGV1FNREQzdFdaelJqaUVRam9jOWppSEgvR3dFSlBZWjZPSmZVdXJuVnlr\ncllyTC92V3ZLeDRqRitJVS9rV1VPNmpBTnJMekpLMWVEalY0M2lpKzZxVytr\nNlQ2MC82N1hYVEUvczR0NG5FMDBHUmMvWGs3Vm5vc2VQbTh2eDMwVTI0YnhJ\nQjlxU3kwOTZncmhDYnJxQi9NNUJ5czlBdlFmSVdibDVZU0EyTUU3SG1uMVRS\nSThtMDI3YzdSUWtENDdveUxtbktRQmNEOExvczl4UEloYmJmOXhOKzlDY3VK\nN1ZaWFlLemdVQTZwQ0trTmFzK014T2F2VkQrbXZ2eHY4MjN0K2J4M2xxQndX\nbUFtckxXdTVoM2lQYjR2ZitaWHJPZUZhSzhpaElid0dYb1Vld0NLdkdwYmdV\nUGh4dXdmbTlaUjUzc1U1WVFNUFk5aGExd0dpcERycFpBaG5FSlZ6by9qY0Y5\nQzkvQ1ZxWGVpL1lWTktrZ3UwUk0zZFJ1ZUI3NkRPWmNjZkNXZXRPYklmS3dR\nODVWRVhzaUxSUWZkN3BSam5xa2ZRQnJVU0QvRlB2OXJPc2lNZkdSbmNSWlk0\nZU5WZXN6bEgyRXhXa1ZmNHBTcTg4cS9TVXU1UWZaV3pSNkhrTXR2MHRuVzd6\nMy9DOXRwb0JWc0VndlVFR0E4TW43eXpwQ0hXbmNWdWJNcy91bU16NWFGVFJq\nYjdhZUlVNitSYTBOcWhKOWtGc3pXb2E5MDNHZ0IxeENiMkdzSUxKVHpBQXM5\nd2NoRlQ4bThNQUNaNTRCMVM0SHN3VVJveGt0ZHBVcFZ4WFEyK1hDQjlBQjNM\nTkFIRlZlYjZyL0FtZW1vR082cG1VaGl5a0lJbmNlUm1YT3JzQzNKZWE4M1JI\nZmwrb1U5NXpFOUpjZTd0UDgwa0pxT2t5N3Z1MER0c0xPVkdMSm9WMEN6RVVn\nTDV6YlpwVDAyc2FzN21nYzd6Z1lKbVBxSzFVTWNvOWw2NXRFaHRxQ2g3WUlG\nenRkRGVMaUxXRTRlYjhIdUJGTmE4MkwzOWplajNtQythNDR5M1pwdElpcUY4\nM3ZjQTJCRk5qazdod0FDbmU1QmV5NDVHbnFwdzFRTjhXZmFUMk56djlTT0N3\nWE9TRG1HMzFrV3BPb05wM0tvYXJIeTZ2V280aVpqMlBDc3dpczkySi9GUDYv\nbnZvZFcrUFcrQnViV1pXWGhqRW1ibFZJUGQrTWdBU1FqcXJYRVRjNWc3QjJJ\nMW5icnM3SlExcXFrSDZoMG9WdzEzUTZRRE5DZWcvM2ZwZjk2ejIybmVIUFZY\neWkyNHR4WG5zWFZiZm1Rd3hoY1Y3WVFXMmR4UzVrTU13Q3dsTjA3dFNLSk44\ncmN5UUJ0SWNOcGp6M1FwWEovK2E1a1k2akJPV3VCczNuNU9PWjRoN0g3SHN0\nWDR0dG1zUXl3NC9hR1N1OUFpb2VpaWRzTmhqOWsvUlNzUUlYenhDQ2tMN2JX\nVlQreUVJeXowVTM0Tmp5NFl0aEk5K05pK1NnMU9aSlhPUXNNcmFYM29rdWNR\nNktldkduTTQ3SkVyTnJvY0Y1WlorOTBFcUxnZW1HdXB6Q3lnbHhpMDNjTytH\nWnJSZkMwWElma1JrSk5SMndQNDVtdlJSbUp3amY3OUhzNndpYnk4ZE9raW92\nRFRXRFdaNUp6NC9QN2JobE1vbHNoVTlOSStTbGtsbmM1bnJoaDErSjVyc09v\nQ0pNZ1N4WFh5cDBsUnN5eUFlQXlBd2JhdFdMbTJOeWwvb3dwTFpFd2NCczFE\neko4WjZiWTN6WGNEaklzR0Nlajh4cG9PcmtMRjVmT21vcS9nbStMNnpTc2tD\nVjVJWHBqRk1vaXBscU5ndGV3ZzhPOEQ5aFR2OUZUUWIxRWNvWlpnZkhUQUxt\nS1lTczRaUlY0T3U0R1pEdEVsVW04dXRLM3V0dzROcE43cWJQZGhDVVdnY0pi\nekhyR1h5M05vQWFXbVhFTGVpU1RsVmxKOFJSbGhUVm9nNms2eENFZVBOdEFC\nUmJURDJjKzdpNkR0UmttSXVsMmFFNkJSajB0R2Zlb3NvRUx4S0pOdS9keTBi\neTR2c3habkNLbnFtamVyazhUUTVuc0cwQzVMNURzVGhrc0dkNDVPV2RiK0dq\nbTFVRnNTaFRJNVZrbEx2UUVOQlFjTWJiR0tTWmE1UEdhOHBTMDQwVUNZRkt2\nd2ZMUWE1VVRlV0pmazFKTnZzU0V6VHVaMTQ4QkF5NjJ1T1RhMHNGaTU1SHdW\ncU51UkkyNzFjak1JdVdtYlZDa3ljSSs1ZWtDS0hCZ3FiMFkzY3RRbU9TQzh3\nNDdjMzBkUUFPYmRWYkdibTI2UTlaVVBWOUd3YUNIRjk5NWFLN3U4bURFbDlE\nMkRTb1UxenFHV0l1RVp2RDROblFqV2dRVHZZcE42Qkk4MmVONmZ2UkhEQTZS\nbTNiemRHQmFDUWNaSkdKOGt3YWVHVExjSnl5R29Sc3d5SEI3b1BHQjFhZXE0\na3ZwTjUrK3pBK1gwMGlxMVlIK0F0TFBSd0h6S21KSUIrbG05RXJObU1mNkFI\nMHhXcTF4RE9zSEhDT2lrQUlxeW9ZOHUwYWVocERDMWpvS3RPYWN0U21xbVBi\nc1lVSTNYZVo1Tnc4TVU5dkNvaytaaUhJYXZjWU9VUmR5cW1pemswVnI0bkhw\nTFowN3V5azEyL3pRdDBSRnVINWFjR25nVC9aRUo4eFVKS0lTYnkrT1UwUEpu\nTE5oQ2FmQ2ppTWNNU2xKNm5IZENHMlhtbEQ4ejFqR1ZHRmpRWE9DWkdsVU9m\neHc2Ynphc1h4c2NWNUVLdHpnN1lDY2k3bmpxWTM2K1A5SE0wMUNjVG9tVmpS\nSkw1aitnR1dNUzBQVmN0cTFDcG05SS9nUlZMMjhLZmZteW14anBWOFFuQVZk\nbmFNWVZhNGp0dGtHQ2liemUwQmFyckpyT0pUdG1qeUxyb3RhNU1Jb0dpdkFS\nMzFDSmRWYzBNRDRVRDVTTnhlcFZEZGtpbS91UFF3YjhoaWlsclRDWUhBNEZ5\nVU5nRTMxOFQrMHQ1R1ZlTXdCZkpzeDM1Zm1NSzRQV1R5eUdOcXVYQnlSVDJm\nYjBPa2RnSVVGc3NjY2xlaEt4RmdXdUZBNGxPZFQ4MGFHaHkxdUNkVkJrSnh0\neGtoRklzZ25TaDdSQUZqSVN1YWdIQ29XbXFZVTcrR1ZIVlBBVGtwU1AxWDhi\nbjVQRUlXNFhqVW1vNXNaS2QzYXFvKzM0N0JIaVpOVzRXSG9kWkZsSG41Ris1\nL28ydyt2R3R1S1JWYXZWTUMzR2hINEg5MzRodE5FbTJ5MWxwSUdyWkg4UFBW\nRG1qZDNTNGgwNWVtTUVSYnZWdFFkZTJBdktqUFc2R1hMR25IVTFsck5TaG80\nYnRtclZ6OVJGOHlkNEVhRG50dnVEL1laaFFMK3U1OWJDYXFvNm1FL0dLdFQz\nNU5LM1hxNjQ3Y254WDNHRytSa1Q4RTNNRXhOc05qZUs0K0ZWREhJWDlsWlNO\nNzVTZGhsd2lOY01ka3ZNNVUwY2Iwd2hlYUU5NEtjbUhCbXM1eDlBYWt1ZjdL\nT3A5NERXV0RzWGNsaVlEYzUrZWdMYVZqMmxLNkpPSUZja1dWWkhZeEI2bE16\nUkpsQVlmb2MwSDBDeFhjelhiRlNGQnc0bDVxS0Y1WjVSVHdEa1U4dlJ4Yytn\nYzRMQ3RybTRXV2p2ZmIxbmExMUUyVEt1UUh0MldhOHBpQlVYKzRLM09ONVY2\nemk5dXV0bktUR1F2K0tPd2Z5VndndTlrK0pOWEJFTUhDWUt6Y0hRZjBxUUZl\nUGd4Z3RWZmtEUFFjQS8wd29SVGVnZTR4KzV1YnVEYmRWZ1Z3N3JGY0t3Y1lF\nTXgwNmNDdUxCQWVFV3drWGp3TS9Dd0FPWWJvVFFQUmR4L3U4eXVSTnovK1Z5\nTWw3UjU4d05yQzl4MTRGQ0hLTmREc0MrSFpOWklTcXc3UGg0TGxLeEo3TXcr\ndjRyV1JGbEM2Yk5tZDJaUXdFWGN4NnJVbUpjTmV0WDl6bnNZT0FpV2p4eVNE\ncXo4MmJqUjlvUC8vTnl2emUrS1RTT3JaQmtnM3lRZGVLNTBCM0ZFSmRrQ1c2\nV09XMEdCQ1UzMXhqNWx1OVJLM0REMEI1bDRkRm9GNzlrNXZKdjFhdjQ3WmJr\neWIzRHFMcE00RkZyMWFpSE82dlFzWjcxUUtQbDY2czBlaXdTOXVZY2hXRHEv\nZmc0V3lXSlR5V3RlZUJnNGoxNGhUVm9JTnJnZ2pkME84eDN1VXRtVHA3R1hk\neWFmMWdCSFZXaCtRV1h0T2VMRHJaTDkvTjlSdWczcWFLeENwZlNLRmxRdXFJ\nQlFva1BYZXFVbjNDMkhrcWtwSmJTS3J3UDVJcUNXaEYwcXlqRFlXOWZUQzlN\nSWVjVHBFWVd2QUpkeU1DdW1jL3lMWHQ0bTlJVy9sbjd4bG5NaVlYanFZNWcz\nUDR2NlVtamdOc0x1QXVRQ3BadWplN1BDcXZLcThEMGc5SUhXTFpnd3BjcDFW\nU0pTRHRJY09IbDJCVkQrODJWa1BZTno0TUw1TUNnYXRidGFTKzFhY1ExRDBm\nL25BU25FNW1VYnFiQm50OFFBKzR6RUNuSHJuVU5DSzdqOU51dktyYWx1TXVM\naWhjSWxTVWRCaEtjS2dZWERPSENkaW82Nndna2ZKOHpGWEQvNWlFNlpoQzhE\nTFhqdnJ6T3B4Q08zMXlKZkdRcS9XWDN2S2dGTHFpM1E3dmZqM0xTUDVOaGlY\nWkg2T2g1eElwelFMeHo2cVJIV2NGbW83cThvcXN6TFlRZE9Xd3RFSnVTdVIz\nSVppUzlJZy80dEpnZ1ZZdjdOMGVMRXlDNlN4Y0hNUkdQQ2RzR2FBMFA1YkFl\nSGVoQW80bmd3b0t3dDJqRlJwbmd1Z1V3bzVDQUI5dzZRZ29oZklMckRsY2t5\nUGZudmVEVlJxOHVyWFRJa3RMNkJlNm96VlFRZjVtQVZtMG0wR3ZwcVhkVFJF\ndHBKcW5SeFlpTTBHYWx4aEJWbGZNb2NncWNnTWVlZWFPdUhYdWQ0aTZFUkx3\ncFJ6SkNEYXMwWEk3K2Z3R0lEZENDb21uT254cUxnT05GbGJUQmpvSG1iM3Nn\najlTMmhHNzJjdzlFWWFOd1FrR1VrNVJtaG1kbFhIeWNEYWpIVWd3UVhlK0JF\nVTd0cHBvd3hEMUcwdXMwVG1wQTdrOHBFS3g5b2Evb3k1MFV6WTV1cTl1OXU1\nZlhqdWRaVkcyRG9sdmdOUTM0aXNTdU5LOTMzYkt3WXouTWdwT01nZTFsdWRJ\nbTZ1Mi41VXBDZ1lMNVJMWTRESjUyMnpmWWxRPT0iLCJzaWciOiJEK3h1czhp\nczZHbXI1ZzFVbjVwU1BSTUtpTGpqU2I5NGszbjM1QmpOWTQxNHo3SDFEeUZx\nYkVlQ2hhWExoajVqTEg2WG5PR0pFSDFYaXNNWUFMdjhCQT09IiwiYWxnIjoi\nYWVzLTI1Ni1nY20rZWQyNTUxOSJ9\n-----END LICENSE FILE-----\n"}
+	license := srv.AddLicense(keygentest.License{Entitlements: []string{"TEST_ENTITLEMENT_A"}})
+	cert, err := srv.LicenseFile(license.ID, keygentest.CheckoutOptions{Encrypt: true, TTL: time.Hour, Include: []string{"entitlements"}})
+	if err != nil {
+		t.Fatalf("Should not fail minting license file: err=%v", err)
+	}
+
+	lic := &LicenseFile{Certificate: cert}
 
-	err := lic.Verify()
+	err = lic.Verify()
 	switch {
 	case err == ErrLicenseFileNotGenuine:
 		t.Fatalf("License file is not genuine: err=%v", err)
@@ -477,7 +521,7 @@ func TestLicenseFile(t *testing.T) {
 		t.Fatalf("License file verification failed: err=%v", err)
 	}
 
-	dataset, err := lic.Decrypt(LicenseKey)
+	dataset, err := lic.Decrypt(license.Key)
 	switch {
 	case err == ErrLicenseFileExpired:
 		// noop
@@ -488,10 +532,430 @@ func TestLicenseFile(t *testing.T) {
 	t.Logf("dataset=%+v\n", dataset)
 }
 
+func TestLicenseFileUnencrypted(t *testing.T) {
+	license := srv.AddLicense(keygentest.License{Entitlements: []string{"TEST_ENTITLEMENT_A"}})
+	machine, err := srv.AddMachine(keygentest.Machine{LicenseID: license.ID, Fingerprint: uuid.NewString()})
+	if err != nil {
+		t.Fatalf("Should not fail adding machine: err=%v", err)
+	}
+
+	for _, encrypt := range []bool{false, true} {
+		opts := keygentest.CheckoutOptions{Encrypt: encrypt, TTL: time.Hour, Include: []string{"entitlements"}}
+
+		licenseCert, err := srv.LicenseFile(license.ID, opts)
+		if err != nil {
+			t.Fatalf("Should not fail minting license file: err=%v", err)
+		}
+
+		machineCert, err := srv.MachineFile(machine.ID, opts)
+		if err != nil {
+			t.Fatalf("Should not fail minting machine file: err=%v", err)
+		}
+
+		lic := &LicenseFile{Certificate: licenseCert}
+		if err := lic.Verify(); err != nil {
+			t.Fatalf("Should be a genuine license file: err=%v", err)
+		}
+
+		mac := &MachineFile{Certificate: machineCert}
+		if err := mac.Verify(); err != nil {
+			t.Fatalf("Should be a genuine machine file: err=%v", err)
+		}
+
+		if encrypt {
+			if _, err := lic.Decode(); err != ErrLicenseFileSecretMissing {
+				t.Fatalf("Should require a secret: err=%v", err)
+			}
+
+			if _, err := lic.Dataset(""); err != ErrLicenseFileSecretMissing {
+				t.Fatalf("Should require a secret: err=%v", err)
+			}
+
+			if _, err := mac.Decode(); err != ErrMachineFileSecretMissing {
+				t.Fatalf("Should require a secret: err=%v", err)
+			}
+		} else {
+			if _, err := lic.Decrypt(license.Key); err != ErrLicenseFileNotEncrypted {
+				t.Fatalf("Should not be encrypted: err=%v", err)
+			}
+
+			dataset, err := lic.Decode()
+			if err != nil {
+				t.Fatalf("Should not fail decoding license file: err=%v", err)
+			}
+
+			switch {
+			case dataset.License.ID != license.ID:
+				t.Fatalf("Should have the correct license ID: actual=%s expected=%s", dataset.License.ID, license.ID)
+			case len(dataset.Entitlements) != 1:
+				t.Fatalf("Should have 1 entitlement: entitlements=%v", dataset.Entitlements)
+			case dataset.TTL != 3600 || dataset.Expiry.IsZero():
+				t.Fatalf("Should have a TTL: ttl=%d expiry=%v", dataset.TTL, dataset.Expiry)
+			}
+		}
+
+		dataset, err := lic.Dataset(license.Key)
+		if err != nil || dataset.License.ID != license.ID {
+			t.Fatalf("Should return the license file dataset: err=%v", err)
+		}
+
+		machineDataset, err := mac.Dataset(license.Key + machine.Fingerprint)
+		if err != nil || machineDataset.Machine.ID != machine.ID {
+			t.Fatalf("Should return the machine file dataset: err=%v", err)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	license := srv.AddLicense(keygentest.License{})
+	machine, err := srv.AddMachine(keygentest.Machine{LicenseID: license.ID, Fingerprint: uuid.NewString()})
+	if err != nil {
+		t.Fatalf("Should not fail adding machine: err=%v", err)
+	}
+
+	licenseCert, err := srv.LicenseFile(license.ID, keygentest.CheckoutOptions{Encrypt: true, TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Should not fail minting license file: err=%v", err)
+	}
+
+	machineCert, err := srv.MachineFile(machine.ID, keygentest.CheckoutOptions{Encrypt: true, TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Should not fail minting machine file: err=%v", err)
+	}
+
+	licensePath := dir + "/license.lic"
+	if err := (&LicenseFile{Certificate: licenseCert}).Save(licensePath); err != nil {
+		t.Fatalf("Should not fail saving license file: err=%v", err)
+	}
+
+	machinePath := dir + "/machine.lic"
+	if err := (&MachineFile{Certificate: machineCert}).Save(machinePath); err != nil {
+		t.Fatalf("Should not fail saving machine file: err=%v", err)
+	}
+
+	if info, err := os.Stat(licensePath); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+		t.Fatalf("Should save with restrictive permissions: info=%v err=%v", info, err)
+	}
+
+	// Overwrite an existing file
+	if err := (&LicenseFile{Certificate: licenseCert}).Save(licensePath); err != nil {
+		t.Fatalf("Should not fail overwriting license file: err=%v", err)
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Fatalf("Should not leave temporary files: entries=%v err=%v", entries, err)
+	}
+
+	file, err := LoadFile(licensePath)
+	if err != nil {
+		t.Fatalf("Should not fail loading license file: err=%v", err)
+	}
+
+	lic, ok := file.(*LicenseFile)
+	if !ok {
+		t.Fatalf("Should detect a license file: file=%T", file)
+	}
+
+	if err := lic.Verify(); err != nil {
+		t.Fatalf("Should be a genuine license file: err=%v", err)
+	}
+
+	if dataset, err := lic.Decrypt(license.Key); err != nil || dataset.License.ID != license.ID {
+		t.Fatalf("Should decrypt the loaded license file: err=%v", err)
+	}
+
+	file, err = LoadFile(machinePath)
+	if err != nil {
+		t.Fatalf("Should not fail loading machine file: err=%v", err)
+	}
+
+	if _, ok := file.(*MachineFile); !ok {
+		t.Fatalf("Should detect a machine file: file=%T", file)
+	}
+
+	mac, err := LoadMachineFile(machinePath)
+	if err != nil {
+		t.Fatalf("Should not fail loading machine file: err=%v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := mac.WriteTo(&buf); err != nil || buf.String() != machineCert {
+		t.Fatalf("Should write the machine file: err=%v", err)
+	}
+
+	if _, err := LoadLicenseFile(machinePath); err != ErrLicenseFileFormatInvalid {
+		t.Fatalf("Should not load a machine file as a license file: err=%v", err)
+	}
+
+	if _, err := ReadMachineFile(strings.NewReader(licenseCert)); err != ErrMachineFileFormatInvalid {
+		t.Fatalf("Should not read a license file as a machine file: err=%v", err)
+	}
+
+	if _, err := ReadFile(strings.NewReader("invalid")); err != ErrFileFormatInvalid {
+		t.Fatalf("Should not read an invalid file: err=%v", err)
+	}
+
+	if _, err := LoadFile(dir + "/missing.lic"); !os.IsNotExist(err) {
+		t.Fatalf("Should not load a missing file: err=%v", err)
+	}
+}
+
+func TestMachineFileValidate(t *testing.T) {
+	drift := MaxClockDrift
+	t.Cleanup(func() { MaxClockDrift = drift })
+
+	// The skewed clock cases rely on clock drift being detected
+	MaxClockDrift = 5 * time.Minute
+
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour)
+	license := srv.AddLicense(keygentest.License{
+		Expiry:                    &expiry,
+		ComponentMatchingStrategy: "MATCH_MOST",
+	})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	board := uuid.NewString()
+	disk := uuid.NewString()
+	cpu := uuid.NewString()
+
+	machine, err := l.Activate(
+		ctx,
+		uuid.NewString(),
+		Component{Name: "Board", Fingerprint: board},
+		Component{Name: "Drive", Fingerprint: disk},
+		Component{Name: "CPU", Fingerprint: cpu},
+	)
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	mic, err := machine.Checkout(ctx, CheckoutInclude(IncludeCodeLicense, IncludeCodeComponents, IncludeCodeLicensePolicy), CheckoutTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("Should not fail checkout: err=%v", err)
+	}
+
+	dataset, err := mic.Validate(license.Key, ValidateFingerprint(machine.Fingerprint), ValidateComponents(board, disk, uuid.NewString()))
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	switch {
+	case dataset.Machine.ID != machine.ID:
+		t.Fatalf("Should have the correct machine ID: actual=%s expected=%s", dataset.Machine.ID, machine.ID)
+	case dataset.License.LastValidation == nil || dataset.License.LastValidation.Code != ValidationCodeValid:
+		t.Fatalf("Should store the validation result: result=%+v", dataset.License.LastValidation)
+	case dataset.License.LastValidation.Scope.Fingerprint != machine.Fingerprint:
+		t.Fatalf("Should be scoped to fingerprint: scope=%+v", dataset.License.LastValidation.Scope)
+	}
+
+	// MATCH_MOST requires a majority of the components to match
+	if _, err := mic.Validate(license.Key, ValidateFingerprint(machine.Fingerprint), ValidateComponents(board, uuid.NewString(), uuid.NewString())); !errors.Is(err, ErrComponentNotActivated) {
+		t.Fatalf("Should be invalid: err=%v", err)
+	}
+
+	if _, err := mic.Validate(license.Key, ValidateFingerprint(uuid.NewString())); err != ErrLicenseNotActivated {
+		t.Fatalf("Should be invalid: err=%v", err)
+	}
+
+	if _, err := mic.Validate(license.Key); err != ErrValidationFingerprintMissing {
+		t.Fatalf("Should require a fingerprint: err=%v", err)
+	}
+
+	if _, err := (&MachineFile{Certificate: strings.Replace(mic.Certificate, "A", "B", 1)}).Validate(license.Key, ValidateFingerprint(machine.Fingerprint)); err == nil {
+		t.Fatalf("Should not validate a tampered machine file")
+	}
+
+	// Only a failed decryption is a mismatch, and not e.g. a malformed file
+	if _, code, _, err := mic.validate(uuid.NewString(), ValidateOptions{Fingerprint: machine.Fingerprint}); err != nil || code != ValidationCodeFingerprintScopeMismatch {
+		t.Fatalf("Should not match another key: code=%s err=%v", code, err)
+	}
+
+	for _, enc := range []string{"invalid", "a.b.c", "YQ==.YQ==.YQ=="} {
+		payload, _ := json.Marshal(certificate{Enc: enc, Alg: "aes-256-gcm+ed25519"})
+		malformed := &MachineFile{Certificate: "-----BEGIN MACHINE FILE-----\n" + base64.StdEncoding.EncodeToString(payload) + "\n-----END MACHINE FILE-----\n"}
+
+		if _, code, _, err := malformed.validate(license.Key, ValidateOptions{Fingerprint: machine.Fingerprint}); !errors.Is(err, ErrFileFormatInvalid) {
+			t.Fatalf("Should be an invalid format: enc=%s code=%s err=%v", enc, code, err)
+		}
+	}
+
+	// Unencrypted machine files are checked against the fingerprint directly
+	cert, err := srv.MachineFile(machine.ID, keygentest.CheckoutOptions{TTL: time.Hour, Include: []string{"license"}})
+	if err != nil {
+		t.Fatalf("Should not fail minting machine file: err=%v", err)
+	}
+
+	if _, err := (&MachineFile{Certificate: cert}).Validate("", ValidateFingerprint(uuid.NewString())); err != ErrLicenseNotActivated {
+		t.Fatalf("Should be invalid: err=%v", err)
+	}
+
+	if err := srv.UpdateLicense(license.ID, func(l *keygentest.License) { expired := time.Now().Add(-time.Minute); l.Expiry = &expired }); err != nil {
+		t.Fatalf("Should not fail updating license: err=%v", err)
+	}
+
+	cert, err = srv.MachineFile(machine.ID, keygentest.CheckoutOptions{Encrypt: true, TTL: time.Hour, Include: []string{"license"}})
+	if err != nil {
+		t.Fatalf("Should not fail minting machine file: err=%v", err)
+	}
+
+	dataset, err = (&MachineFile{Certificate: cert}).Validate(license.Key, ValidateFingerprint(machine.Fingerprint))
+	if err != ErrLicenseExpired {
+		t.Fatalf("Should be expired: err=%v", err)
+	}
+
+	if e := dataset.License.LastValidationError(); e == nil || e.Result.Code != ValidationCodeExpired || e.License != &dataset.License {
+		t.Fatalf("Should return the validation result: err=%#v", e)
+	}
+
+	// Mint files on a server with a skewed clock
+	for _, tt := range []struct {
+		skew time.Duration
+		err  error
+		code ValidationCode
+	}{
+		{-2 * time.Hour, ErrMachineFileExpired, ValidationCodeMachineFileExpired},
+		{time.Hour, ErrSystemClockUnsynced, ValidationCodeClockUnsynced},
+	} {
+		skewed := keygentest.NewServer()
+		skewed.Now = func() time.Time { return time.Now().Add(tt.skew) }
+		defer skewed.Close()
+
+		license := skewed.AddLicense(keygentest.License{})
+		machine, err := skewed.AddMachine(keygentest.Machine{LicenseID: license.ID, Fingerprint: uuid.NewString()})
+		if err != nil {
+			t.Fatalf("Should not fail adding machine: err=%v", err)
+		}
+
+		cert, err := skewed.MachineFile(machine.ID, keygentest.CheckoutOptions{Encrypt: true, TTL: time.Hour})
+		if err != nil {
+			t.Fatalf("Should not fail minting machine file: err=%v", err)
+		}
+
+		mic := &MachineFile{Certificate: cert, client: NewClientWithOptions(&ClientOptions{PublicKey: skewed.PublicKey})}
+
+		dataset, err := mic.Validate(license.Key, ValidateFingerprint(machine.Fingerprint))
+		if err != tt.err {
+			t.Fatalf("Should be invalid: err=%v expected=%v", err, tt.err)
+		}
+
+		if e := dataset.License.LastValidationError(); e == nil || e.Result.Code != tt.code {
+			t.Fatalf("Should have the correct code: err=%#v", e)
+		}
+	}
+}
+
+func TestCheckoutInclude(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{
+		UserID:      uuid.NewString(),
+		UserEmail:   "owner@example.com",
+		GroupID:     uuid.NewString(),
+		MaxMachines: 3,
+	})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	l, err := client.Validate(ctx)
+	if !errors.Is(err, ErrLicenseNotActivated) {
+		t.Fatalf("Should not be activated: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	lic, err := l.Checkout(ctx, CheckoutInclude(
+		IncludeCodePolicy,
+		IncludeCodeProduct,
+		IncludeCodeOwner,
+		IncludeCodeGroup,
+		IncludeCodeMachines,
+	))
+	if err != nil {
+		t.Fatalf("Should not fail checkout: err=%v", err)
+	}
+
+	dataset, err := lic.Decrypt(license.Key)
+	if err != nil {
+		t.Fatalf("Should not fail decrypting license file: err=%v", err)
+	}
+
+	switch {
+	case dataset.Policy == nil || dataset.Policy.ID != license.PolicyID || dataset.Policy.MaxMachines != 3:
+		t.Fatalf("Should include the policy: policy=%+v", dataset.Policy)
+	case dataset.Product == nil || dataset.Product.ID != license.ProductID:
+		t.Fatalf("Should include the product: product=%+v", dataset.Product)
+	case dataset.User == nil || dataset.User.Email != "owner@example.com":
+		t.Fatalf("Should include the owner: user=%+v", dataset.User)
+	case dataset.Group == nil || dataset.Group.ID != license.GroupID:
+		t.Fatalf("Should include the group: group=%+v", dataset.Group)
+	case len(dataset.Machines) != 1 || dataset.Machines[0].ID != machine.ID:
+		t.Fatalf("Should include the machines: machines=%+v", dataset.Machines)
+	case dataset.License.UserID != license.UserID || dataset.License.GroupID != license.GroupID:
+		t.Fatalf("Should have the license's relationships: license=%+v", dataset.License)
+	}
+
+	mic, err := machine.Checkout(ctx, CheckoutInclude(
+		IncludeCodeLicense,
+		IncludeCodeLicensePolicy,
+		IncludeCodeLicenseOwner,
+		IncludeCodeLicenseGroup,
+	))
+	if err != nil {
+		t.Fatalf("Should not fail checkout: err=%v", err)
+	}
+
+	machineDataset, err := mic.Decrypt(license.Key + machine.Fingerprint)
+	if err != nil {
+		t.Fatalf("Should not fail decrypting machine file: err=%v", err)
+	}
+
+	switch {
+	case machineDataset.Policy == nil || machineDataset.Policy.ID != license.PolicyID:
+		t.Fatalf("Should include the policy: policy=%+v", machineDataset.Policy)
+	case machineDataset.User == nil || machineDataset.User.Email != "owner@example.com":
+		t.Fatalf("Should include the owner: user=%+v", machineDataset.User)
+	case machineDataset.Group == nil || machineDataset.Group.ID != license.GroupID:
+		t.Fatalf("Should include the group: group=%+v", machineDataset.Group)
+	case machineDataset.Product != nil || len(machineDataset.Machines) != 0:
+		t.Fatalf("Should not include other relationships: dataset=%+v", machineDataset)
+	}
+}
+
 func TestMachineFile(t *testing.T) {
-	lic := &MachineFile{Certificate: "-----BEGIN MACHINE FILE-----\neyJlbmMiOiI0dFpUc2xpb3gxSUlyMlp2U1BjdWpnSmZUV0RadWdpU3ZaVDUy\nL2FTbS8vYlBHeUJTbTFockc5NWNRejRIbCt2b2lodzEzNk9ZaTRuUlhmQWEv\nS3pNMktXcm1tMHdaMWx6eG92QXErNkV6dUFnb3haT1VtZlJqVmx0ZGp1aXhr\nb2V3T0NvMjRRMFFtUU5uaC9EZDgzSnBYb3BOMnU1MEdqbE85RFFxQi9pM2pM\nLzE4Y2JUL01LdlQ3MlRxejkwcWM2aDVTY2k2TWRmUkhpZlcrVDQ5N01pZ1pU\nQ2dkMjNPTitBWVBDY2V3b2cyU0RqaENFWXhiKzFGaGc5Z3p5VmxXVFpNRTBl\ndUtHZ2R6dzVTeW5WQVNqbnlSK1kwVUFBc1UvVnRGd1dDV3RkRnIvblUxVnFs\nQlgwSVphQk9uS0hYMmNpRWt0NGF3aDAraElETmVzajVMR2ZTTUsrYTJNeGFi\nQ0w3cndWTVNNZTBsWGdlRHppR29jTUVHRjJJcGZKM3VIdEVTQW4wNlRHN0dR\nN0NlR0RocmhDTGdNZk1RUlhiNWVjWks4d25MNTk4MVJwc0hqWnFDSWVZNUdu\ndXBPWlFBWFI2VXVIVnh0YU5WNEhRNzZyYzdDcHpDaEZiSnBCSDFQTjNkZCtz\ndHgxYUk0M2NVZ29sRU1kTmprOEI2VndrT2ZhUFdqUC9XVVhQeG9US2J2Q3d6\nZ1c3end3c280czIzU25lQ1JhRkdZdmN1RU9RSC9UVnJEc2k5T0FWZ2RBTTRa\nYkRRM1RpbHM3cXJrV25BbE9vTzVOK2NmRUI4R3AzTUFrRHV2QW1nbE1WSE9x\nak5aYVFaRHcrbDJZL1d4VmtHTk5LalRBWlduYmlwMG54ZURDc0RqZEltU3Fr\nVm05NmhGbElBWEpQRWRUbmgvMmFXV0g4RXZnS0RyYmNKcWJIYUNqMjJHT2ls\naXR3SjRPWWl2OFAxUktUUDZCTlhZdW5QaGZuUEdQdS96bXVDRFFsbXV6anlk\nNlBiZG50c1RMNjJwaWtMLytUNUZBUTgxblpXRDRrSk1RNDZ0b0tDaHRSSVBs\nc2dmZVJmOEdZSm5Ta096S0E0VUwvbitFbEVNckdzR2xRaFFSMDJYbjk2clh3\nQUp0bjVFOUQ0YStUbUdRZ0NGQzRHOFBCN1EvL2czV1h4RVQ2QWZwV2hOdDNx\nTURBTG8ydDRzdmdWQW91KzlyRUpUMUtoTHVOV1hWNG93YnNrSFVCditBenpq\nYlJmYm5RbzFkckFvUmpqNk9XQmJkQlBFQ2M0T2VDMlpVUE8wUDI1aEJtbmlQ\neGZqUHJVaHZsS1B1dFRTTWJMUkl0Q2N2WTZlY2lXMUJ2WlZwbUl6Rm1KQTY0\neHFENjdaaVpKTGVMamhUQUJ2c1NxKzhZZGtxWUo5RFZHOHZCMnZCOTQvSUJ4\nT1NjV0FRdXE5TjAxS2R3Zi8rc3lTKzk3aTFyNjJ1dmcrK3ZxZk9NS2dQYkZV\nMndhRnExYVNlb3lrNEdENEZIZC9DYTBaV0xZc2dLamRiK3M4Q2JBZjlEeFBt\nUjBNd00wNit4cUpOTnJtbDFQV2ZyVWtObGZ6TEg1S1Y2UDQ4MU9BMXNJeTFW\ndVE3WE5MdUJhWEVPZEJpd3Jpa2VwVVlNQ1RkTUdObytldzkwQ0MzQVF4WTlU\nNkRtYXJSYktad0w1NFdhUE1iOXNKOG9UaC8zand3dmZqUUVlWGFabWp4U1lw\ncGJzWjhYc0dxNDVWS2xGNE5rSGsyS1Z4ZW5BakZtMXo1Sm1vTTFsY0hJSjlj\nOEZWMEZ4TkVuZGRFTnN2THpwTitmRHIyWURrVDNrNDNWNVd0OU1RRit4SnhN\nbHZ5bG1hR3Z6eFAwUjVOV3VoMGFoSVRYWUV5bG5YTldSbTNCQ2cvVG9QVzhw\nK2hpMU1oNXM3cXI4Y1k1TXRBQWRoYzB2WGljZ3hVVTFreHBNVmp6elp3dGcz\ndWJlQkN5YlNjck5KcVR4QW45ODJSVHBLdFpaV3l0Z3RtalNwczltOWpZV2ZM\nWWxwYUtJVUxwcldWVVdvSi9SdUlQWXlmWU5LQ0Jsd2VCc3NRUzFNYzdZQkxL\nU2tNK2E5elJTVzIvcWxJaFNoSExTU2srOHZ1eDNTOGsrdHpLQlY2c25lRG9S\nQ1BnblEyV283WlJLTHE0a0ZpdVFDTmhWNG5XV1RLUUZGRTNjdFgydTdvMHhr\nUWFCRUxQQW5ieWYzUkwySTNrN2sxRHpXRlcvRzlZd3RvNVRlSUJjaHdzWVBt\nS1dkTnltNmtZZXZsbUZMUmtzKzV0RzRsaW9WZVhtc0dRTmFoU3piWktMVSsv\nRWhWTDZhcjdoNkpHNlB2RWJtVVhnSmNpUUtPT2hKRFNQZ2tSWnRGalJKVU1S\nRHZlOG41MjVzK05oZEVtSTZSbHFRMVg3R1FLY1krMzIzdHVlZzd5MlJ4VDBM\ndnlzWVN0ekFPOHhwTThTVVdiMEk3dU8zRUwxU0R3YUJGK3V4RmNzcGRML2JG\nT3lKdVVkaGxOaVBZRXNWYlhRT0J5NTcwVC9wQ3BiYTlmdnRyRmdsWmIwc2hD\nZ1RCQ3k2WmJibWJ6T2hleTdQUHBFekhVLzJyVFkza3VuNGpaMDRMc0JPK1Nx\nMDdHYjZwM0d0eFR1d2N5cC9COFRobXJrVHVibVZoV2cxVHd0eWFsSnRxRWQ2\ncEx6bmU5cVRMYUQzdzYzSlpXUXdBNTR3VXFFNUtYZEZuTVVxdGJoTUVOb2Rp\nbHN3OWVpaUgzMGd2c0YrSE1FcG1zU1o4QytJRGdGUkJMVlRPZXdubWROUlVp\nL2RXRVNGdHRRQzY3L1BBSFRwc2FqTCtqeFlBOFk5eWpSc0VFUDNTQWxoU3RP\nSVg2Z2V4MTc4SkVUOE5YRWxvNWt6LzJ1NVl1UlZLM0V6MkIwRjJHR3dvTW9h\ndnNJRDF0SUNwbVZQcXhZZU9DTmlGQVlDQkFSVXNOY2dqODRMWC90TzViNGty\nYW81NTBuMDBHbWZlQ3BNUVc5RGNPSVRucXUvWWRjQ3JTUmYycEx1WklBUmZ1\nUlRUY1luSlAyYURmYkg2Qm1USzBOVXhYd1NVT1JJSzNTTERVNmlyd2RLM3dw\nbjZhNTl2dHpKTThRaDFwRGlYYnQ5dmdsVURHakFVQVpFOXRqVmxncFJzNC9w\nRGhYdlBaZVhYc244UGdkUXhFVElMK3NhUEFqOHRqVFZtalhISjRZQzFXSXBO\nL1ZYdHoyR0UvQlUzTDFyQUdocVBhM0lkL29Uc1VLQ1JtMkd3ZCtzeXA3cDRo\nKzBiU3JZSCtua2piQW9ObWJRS2R5KzlLVnhvbjdUcUszdlZ3a29CbzhzK2lW\nMEIwUGxaOHlXUi9HY1ZUS3dUdStzS2E5R0ZyUkp6RHNUVmVOYVF0Ym1SaERW\nTDlkS1JHZUk1UXBJWUdmSXhseHJyd3lvNytuY0FwS05LUnJmMUtQVG5MYWh3\nR2RPaE05OEFncmNKQlUrWkVKc0swaE5RdW8xVWROMXVkTXlITlB1Tm4xenRV\nb1lJVkZuZVM1b2R5OS9zQ1RDOG5kdE1SSTh5cVE1RkZpbVZEUW5KUXlrRTR6\nZ0lMQ1pMc3k0SUN2OElja0tDLzhmZU9kaHBRbkZDcmFSSFpPMEdCY0NJVkhR\nWTJ2bUxGL1pGVUdFSlIxMy9nckpGc2ZtWVFITjFkQ0dLTkY2YllQZ0tHdFlz\nUDJWOTVYZjk1NjVHL05aSmdnMmZhZnhpclRRRk1pZzAwOWRVQXpzZFhGSFB3\nVFB5Vk1aZGthSkhBaUxkS0pFN2hWRmwvVUJjaUU3dXJWT280SWFmeXE0T3hk\nZmpLVUJsMmtJTTBQNHRueWxUM0l5WkRwYlkxMWNOdkp3ZWVyMFpTN0pYOE10\neUZmb0xuK2IvcjVnR2JpcFo1bEZDODdZVlhtK0JmN1lCY2QyZjRYbnAvRmM5\nMEZHaVRCTXZQbkV1U2QyODdXWllqMEZ6eElCaEpieUc3cE1BSVVCdEtqQkhs\nV1VYcDltQWJhVDFhTlBXSkhnakVNWGdxZjMwaGF3YVJhOTBMSFlpNC9ScXFB\nUGs3cElkT1RiUm4xL042eEFnM0FvYzIwUGVTSWlpU3FSc3pqTzBwSTlaZUdH\nWXk5OFBNWVl2U0EzTE5KV0lJaFdjM2xmSWxtTEIwS1VDUjBqcHE4N3lCaXlC\nb2tQSlBsWmlna3Z5VktwNEdZT1NQby9yRVJTUVBENFNQS1lwaTBLaWxWSmVS\nWHlxYnd3V0k5UzVIT0d0UThyUXMydVB3NHdQanBvQk5wVVVlK3N0SExsUm0z\nSm13TVZrZlhDcTJ6UGFSdit0UnlrRGY3YXJXMHAyYnE1Z2gzdEw5UkkxcjJ0\nZThoRmZTN3ozWGxpdHFudjhGbDJpVUU0L293RkpVM0hFYUgrTXFISzFObWNz\nRVR4cmFJNFE3a1hjaTh1aWViRmhWM283S2JETnNlMk5yVTNKMzZKb1lyUG1Z\nWWFHeUo3M1ZTdjhHSHhoTDVoNWpxRjhDM0U0eHgzUVR0TWliVG1yVkF2MnUr\nMTBWRzEyd3Vpc2NKUGNIbThoTCtGNkxnYW94WUE2WHF2T3QvaHZ1aVh2MEpn\nTk5IakF3eUtpZ2pxNHRPNTlCbGwzOExCR2hzRHQwLzYzaExXYXBPbGY3UnAy\nWFAvblArYURqVHBaQjFiOExCb0dxUE5Na25aUmVsZ0p6ODA0S0hTQUhvaUZL\nbU9EUGJEaWdKR0puL2RjeHRiK29MdWVTYzNrVHBJamNqaUV3LzlLRytuaWFr\neGwvMzI5azBkemZ0c3JCa1hoVjVTbThMMzdwQUVQYXdvRFo0azZsVld4WXA2\nRFNLc3hDQXQxbVpYakFzY1lmeEwwSXFkR25reCs2aStPakJYY3h4ZzMzaVd2\ndWZjTTJ1TW4xZHM5Q0Z4S3M0MU9rVERiUzJFOElZUi9YUVlDS1VZeW9aY2FK\nT1UxUHhPTjByZEl5M0Z1SmQxYVY4cEFxY2FRaW82b0EremtJR0FkbUp3dTFx\nTFVZNFNYMmNhZGttNlFFNk5zWnM4enZZNUZabTdOL1dZMjk1RzVQSEJFS1JD\nRHdMM0pGQXE4UHNlU0I2S1R0eU9QeXIyM2FhOHlMcitjOGdLTmdxRnQzdzlD\nMmgrSXFYZ2tiangvY2oySFB1OWV2QXc0NjZOMkpidDhTVXNRRUszMWc0eGs5\nUEpvYmlyaUNLdmFQTVJJaFdFRHdXUFpNd2E1TkF0dENoTFRvVHZOVWZvOC9w\nRXJlSUx5NFZ0Z1ZCMGZLMUxrYlBCYjVnTTgxaDR2SXFUdHhtOUNsajlndGhw\nV2U5dHAzbDVGTkNVM2Z3Q0pyVDRBcDFjOHE0Y0d3MEZMQ2RiNFcxb1g0ajNo\nblYvS2FoSGFXeXVyVlJVSW40RjRXY3dWTTQzTnFoTmg2azh4MTNTNUh5aHNF\ncWdUYzRqaFN4Q1IzS0g4a3Yxb0VRU2xnWGI3cU1vaUlUQVFmNGZwempSRkxo\nS2o1UE5WMWcyL083Rk9qY1JLWTZNajU1WDVHc3VRZWJGWkFXd0ZuMy9LSWlu\nemZJUEUrRnBSTEswVXNMbHkrMWRhcTBnd3B3QUFQLzh1Q2JuSHVFTG1ZRzhE\nUnVBeDRVRzdmYjJ1NVZ3RGV4RDZaTTR4T1NWaW5kYmhIN2g4bnQ0VUE0ZVhM\nWlh4SHZIQW4vU3JVazRZYnJKc1FnRlV3Z3ZaV1BUVFNZY0REeitFd1VZeVVU\nV0c3ckhMMnlBUDA4VzRRQ3ZoZTRIdGM3eEwxTHdWcWRVb0F4TmtUbmQ1OWZt\ncWpIS0VnSVlOOGhMSVlmano5dG8xbm94aDBlbkpSaW11OGJlVWFpRnVIOEhu\naCt1TXJTNEhYTS9HR0VXektiVjVRZEhLRDl0a1BBbnlTWW8wWVArdkpwQS9E\neU5CbmkrNUNHd05kWElpVEZIcEs4QlE4MGtRdVE2UXNWZktDNkRYNjhrdTdr\nL0dwQUtxSHBNYXNxeDBIZmRiTlVPZEZYM2hxK3pLc0tTNDg0NURBUVhSMFNO\nQmF2VlR5WG0vcjBKajQvNUMrT3FESjNFWlhJd0JDUVdSMEJSdW5YZ1ZOT2JS\nLzdVd2h5bnVIZDZYUHAwWjJDZ3V2aVB5NS9vanM1dG1hSm5pSzQzVlUvaVpR\nZytqMHRFeU5USGYwRkVmRDVtVVBRTUllTUlvTkM0U2xRMjRRSmxhWGRHY0JE\nTGUxelh3QTZBY0NHcFBGRFd0REJ3MTVueXBoNDRXK251ZmxvRExvSnovMmJ3\nNnl3ZDBUMlRpZllTUFEwQ3R0dG9aSm9LTm4xWExPVFFPSmJSa0duQzhiQWFj\nakVoWUx4MXNxUXZHdWZTUGRERE9HYithOFJ5MFFLMjN5Y3BUMFVsYXB4bnVi\nQ2RVMmgzSnBRL3NPL2FPUW9tYlREZkVod2QrKytreVNmMGxBU3ZNY0xhd29F\neGhwb3NXNTFua2NYZEFOVm5uSTZzMXRTUzM4NzhLc2h3bjZXSExORXBxNno2\ncytCZTdsNzgrMXBxbHh6OVYraURLKzRPa05yQUFiM2JzNTE5TnU1bnJxODMy\nRmRGS1NCTWFKRUgwa2NCOEVuRjlROHZidVd1SDZuSVhrSVpFUXkrVjVFU2Rm\nNWkwcHBYUGNaTGE0SDQ4dm5TWDdOcU9UbFBqOTlYSmtvOW1QWSs1VVFXYzc2\nNUZZRS8xRFMyM2xmWEpzYWVvRWpBTUNxV0loNlVNR3JaK2dsRmdJVDRSRTRZ\nR3RRd0VOeUk1LzRTbGJ3bG1zdlRsUHBRWmVaVHVSenpEaVhLQ2d2cHNJRFhy\nYXNBWTlRYyt1UkgzNzJING1aMVB1bUZIYk5LZmdUUTA1c2VYbGUxRXlROU4z\ndmRQL1JPYjlYeUNYeExCa0J1ZTRRUENaU1RjVGVyWEpTNGhNSnVGb2lDZUcr\nMm9YeHozaEloRmRKV1hpRFo1NWtqSU45SWo2YndZRFlnRytQNkdiWk9tVDRV\naFJDT1ovcHZocUx2aFJ4TkVvazlkcmduaEFrMkkwWVZBbjd0NlRBaEdCVnFj\nNW83aFo1TkcvaWJEVDFxVXNUY3B4T245Q2ZoK2lZb2E2NU9GVDZGM2xQR0tL\najJQWjhjdk1YdzN3cXVITmdLcE5IM1BzMitlbjk4RFIzd1VWOGNnenZnNG9S\ncGVMK1J2eXR1YWdEV0phWTFXYW9TWEh2S3VNT1NKMHNBWjFSQUVEYTllemMz\neUlPc2RkcGdqdGlhb0RFekRGd2U2cGJQbzJRblAwWU5adHVXYTlVT2MvbVho\ndlJtcE5wSXRXZzR2dmFCNjJ6SjNrcDZhWkY5YndrVkcvV3hGSC9pWWpiZlZl\nalNEVlNYUnltdk0zWXQzKzNDV3BlcWwvWU0raEJ0enhkR1lndGhNK0JBYVFJ\ncXFJSCtFbjlVcWtuMHMwN25ueWxDcjJKWkkwa3EyN2pqbGJOeWlFV2gzQWZO\nbkhsQUhmanpRck9OcU5zdklEald5WDB4QmQ1TG9UbE5EajRqdHo2VDhsVGUr\ndWxDWDRocjZSdTVkcEVYUFI3aDBmc2I5c3plWW1HcDNXMU4xS21VRmtsaDhU\ncTVWODJDUU5aRUxNQUlrOWQrRWNTSDlaWTRjNStRc2hiblA2TkxGd2ZNcUNM\nYlZZcy9lVlRGNCtqMnpicy9PSjNZUEpHeGQzVGV5R29rSWVPQVJGaS91L0xo\ndmJidVVJeXhQZnpacVZhRWptdDdnUmNaK0lLQnAyWWZhRnVsb3MwbHpQU2lK\nSHgrMXRDWGFqdndlOHVzTDlBd3hPOENkdW1Vc1VpNUQ3cEg1UWRPM0h1bmgx\nV3p4YTY3cGYvcUY0NVJ0Zklqc2NKdm1aRVp0SDA5ajdjZnpTeW5vQklBK3lx\nd1p6a2pTL2RNUlgzL1F1M1RURzNxaE5UdCtSTkp2WGxURXAyNzN0Mi9GKzNF\nYVpNOGhHcDJlTVFOdGpFWWlJVlljTHl1TFJjbHFrazRZZWNRa29IY0NSRURY\nZE9nZGwxVHA3eUZ1bVY5RHcrcEJ6TmdBaDU5R0U0WktNM1pqaE9IMG0vUTJa\nZlY1UVpDdk1kVlVET0I5aDJwdmtGNG92OVZzcEJQWTJOdEp2ZG9aT1dpbkV6\nZElsdXVLZkJ2MXJyWGI3UzBQZmhmdklHcmVQdmNqTndiaEFrZDNvTmZ4cU1S\nYm8zNThDZHJrQW54Ym8wNDlpTDJRN1BLdVQzbkhrMEVUS3JRZWRzL05tSFVF\ndXNQb2tqTkNGY0JuRmNuZEwrZ2tzTWxuZytjT0lnQnBPbjdsS1pZYVVweUF1\nUWZYSlB2SDFycjBCTHVHSVd4cTFrMUI2VDQyWmJqbGdtM2o0K1RYTWRSSFVv\nSWRmZmhrMU5KbkEwakduWEZ2RFM0dlduVFNDOGVxN3B4cTJlTGFCdXZIZ0c1\nT2JPbzJnSWVMSThDU2I4OGE5ZUR4Z1pvZGY2bHlCZ0dxYmFVYWdVWFlTSGsy\nMVlXY2lPeW0rQXRVQktxWTVjM1lkaWMwcnEwKzA4dTE1YzdvVElSNmVKYVlw\nOXNXeUNlSktsdHZrbGc2NmJMblBqT1QyTWMray9oZmh3ekF2UXJLZ2hOQT09\nLkhFYmswd2JnN2o1b3FpVUgucCtvWVZGR3FWL0oyd1ZCMzljeEcxQT09Iiwi\nc2lnIjoiTE5NVlBtNU5tK05rRXZISnRaMm5NRWlQTDZDaW5Ud0lYSWtJbGsx\nREZLZU5SR2hXcDBmc094MzAwdDAvYkpIeFcrMm1FSGU0UnFTMnpBV0Jhc2Vo\nQ1E9PSIsImFsZyI6ImFlcy0yNTYtZ2NtK2VkMjU1MTkifQ==\n-----END MACHINE FILE-----\n"}
+	license := srv.AddLicense(keygentest.License{})
+	machine, err := srv.AddMachine(keygentest.Machine{LicenseID: license.ID, Fingerprint: "39bb2cae-af5a-40c2-80f7-9e2ea0f90d17"})
+	if err != nil {
+		t.Fatalf("Should not fail adding machine: err=%v", err)
+	}
+
+	cert, err := srv.MachineFile(machine.ID, keygentest.CheckoutOptions{Encrypt: true, TTL: time.Hour, Include: []string{"license"}})
+	if err != nil {
+		t.Fatalf("Should not fail minting machine file: err=%v", err)
+	}
+
+	lic := &MachineFile{Certificate: cert}
 
-	err := lic.Verify()
+	err = lic.Verify()
 	switch {
 	case err == ErrMachineFileNotGenuine:
 		t.Fatalf("Machine file is not genuine: err=%v", err)
@@ -499,7 +963,7 @@ func TestMachineFile(t *testing.T) {
 		t.Fatalf("Machine file verification failed: err=%v", err)
 	}
 
-	dataset, err := lic.Decrypt(LicenseKey + "39bb2cae-af5a-40c2-80f7-9e2ea0f90d17")
+	dataset, err := lic.Decrypt(license.Key + "39bb2cae-af5a-40c2-80f7-9e2ea0f90d17")
 	switch {
 	case err == ErrMachineFileExpired:
 		// noop
@@ -511,9 +975,15 @@ func TestMachineFile(t *testing.T) {
 }
 
 func TestLicenseFileNoTTL(t *testing.T) {
-	lic := &LicenseFile{Certificate: "-----BEGIN LICENSE FILE-----\neyJlbmMiOiJBTy9VZVBRMzJwbTlSeU43bzdWeEI4UlRhRmJPTVl2aWNTMzBY\neUkwQ1FwMloyRTRkRW9rd1g2c3RDZ0xyNUhaZElCUjVDTGx0REk4QjRuK2tE\nSDd4QjAwM2pTWVAvTTRoK0tmTTJNSFZEclZWVklJRm8xY0Nrb29wYWZCUVBw\nWDg4UTRrWWNLYWNua0E2MDRkRDl1L2YzWEh2MUZDZGdRYWxGOFhpZnV4QTE4\neVdXSCtTTlVPNVZZRDRqNDhKaDN4MS81TUtWN3pyNGJqd3Jubk85NGhZaUd4\nZ3c0VWYyM3dMUEZwTTBOaU9jLzRpZ0FPT2ZQOWU2bUVFSTgxa0hOTTlBellD\nOUJlbjJmdkZ1YlN6UTl6UWhjUDJwdWtaNWR6L2kwVTd0VGpCUWYwMXJabENl\nYzdYb05sQ0s2MXp5cms4eVI5blhkMXZZWWgzdWpSU0V4V25LM0NYcllrOHQ1\nREg0ei85TnYxSENWR2dha0RFU2pIN2wrSUQ0b0o0NTFOMThjVUd4S1hSTldT\nVytWdi93WHZnZUFTSEJCRWhScVVEM3d3cWZleGhNRnBsZkJsMTkxeTBKdWxm\nK1NxRy8xWk4vVXhjdEJDdUlac2duU2dkMjdhOU5ubVNHenk2ZUJSOWhPZWo2\nVmhva205KzYzWExVeVBIa0Y0S1NKUGRqcVFrdUlVSFh1bTR2Z3JFZnVWNVJu\nZDZlTkRVYkpDSUhOWmM4bGJCRjdERHpLWjQ0VFdwTkhlZVlYRjJCR2JNeTJZ\nZEN6UnlJQWlONDRmK2g2b1ZPQTJ5cHliSHhBRkRTcGtLWEgzOEt3K0tsNTIx\nczd2S05pUVFqM1BFS3l0clJzdzFGRWoySXd5TGlZbWZzdGFHM3JiUkUydjhr\nWjloSTZkYWpEN2I5M2ZtaytMNjEvaGV4VDhzRzg2VDU2N2pMRStkS04zdWQz\nMysxMXJBT2wvVG9vV2tPNWVaM3ZNeW1SeG9raEhhR01BV2VhWFBKN1ZqM1pI\nTElVcUsvM2VOV3JPZUtPTytyL2gvWGxjRTBDOFFUcnZxS2hWMFJWeWZLc1RD\ndGdreGpEREMycXc0akJGblFsZHpRZjlLSkJXNVNrOWQ3MWhkU0RpZVowdysw\nZlNIN1c0ODBpNjVFa2pNTFloN1c5TzIxRDRDUzV3QkF0d3R3TXRFY2NoeVNv\nUWdyWjNZZHZmM2RIem4zSzlJVjBUL1VsQUcwVUFOZk51S1JSWFVWZGlaend1\nUm1mYndHU3Y5cEpHcWZSYk04TWcweGswRUJlU2UwRFhvN1NsY3VLMStCVFlC\ncE9aMVE3R05ma2FYaUh4L2dlRUx0Z2k1RVVNZ3p4U2VNYThhc1JwUGxnaWNt\ncFh3UDZNSHVmMzVhUDg4VlJVVGpXazR6Z1VLa2w0MVJaMVBRV0d1OG5lWktN\nMkwvQmtEVDRHZWF4U1UvVkNOckxHbTBxeEk4YnZ6Z0RiWTFBdXNta1oxelBk\nUGFRbDdSekZWbzV4TWQrZXNWcUdFVVJEUmpxVVlPWEY4MGFrYjNac3NaSmF6\neFJla203VjNoczNsTEFsbkZzcnFvY0dtM2tQZTFMSzRsYThBZFNzUTdoQyto\ndDgvbDdUUkVjZThmUjFDSmU4N09nNmpZTGZ6anpiZkRxaWM0MXBFZXRDOVJk\ncHN6VFkxaVlGbTM1bFh5TmxMaU95M0dBSHVBV2lpTWxtZWtwYnQyTFYyek9D\namEvRHorZ0g1K1QwV0hlR3dSSmI4bnRjeEdIUURHbW1kZnR6bFEwRkpQWUR5\nZHVYQTB6T3M1a3FzQ1dCNUwyRlJNWW1YeGZMOGFYbkZxNW4ybWlGQXhxZ0pZ\nZk5CMjZvZ211T05Bbkk0ZkNULzJab2l6K0RBbFNkWXR0MW9GR21kRVdmZG5M\neUlhczhGTGVmcTB2N3Q2bEpMcFZNUkM5SXIxcUs2K1cvTksyeHhGZEVnMjha\nbDlDeG1xVXMzUDRZMjh0ZnVVTW1Gcmo2aHA4UWNwODlUM0d2VDBEQ3ZRRCt4\ndzBuNDM2N3RqM1g0emZ4RXloVEwwRUtuQ01zS0VoT2V0T2xoWHdSNXJseGQ3\nc3J3aG1ya2Z0WHRjendwMmM2aUNTTk9mR3V3RTRmZnJ3TnBmdGxFbWJlY0V6\nTGVXeFFjbFhEMlhBMVFJcXcwOTdzQ1hQNWd3SE1DNlh4azhCTGFKSUpGZkZq\naXVVMnM1SzN6UGIzZGV4cVdCcGRLN09ud3pLcXNKNFBjOHVZVG14cXlCYVBR\naTFTVGgwVmVuSG42emtWTkQvejdxSElCakYwd1pmcTZWUUkvdkVUWTduSXNB\nM2E3UjYvcU9XOFRiNG41V3RFd1doWWhFVlZPalFEY2haZzNkSEl1MDlLSk1z\nV0RIV1EzMUJoT2xBMDRYd1hRUkxZMWlzZHVWVjNMbGVJNlBLR2hSWlAweHg4\nejdud296SEZaeTNuOEU5Q2tQN0FGbUt6SDBXblhySnpnQ1h1MlJJeVZtbkZC\nU1hLVnBLOFkveVNpZHNTMHlsamZSSE9OTEZDT2hiQmtFcHdIc1h2ZEFVaFoy\nWHNDM2JOL0piRWpVMHpSNjJKZllpQXNjTHlwRjVlYUU1STUzV2FtWUpyU0Fz\nVTRybkF5cVN0UEt5Y0YvNExNbkUwRXkrWWh3RHFGaUQ5cUN5dzNscGswTk9T\nNkgxK2VhSDYwbytlY3RESHBzb0Q0ZFhDSkVZT0o3NGh4MTJLcG5XNUwzaHlq\nVDlmakxHb2lYQmJHWFA1MGVVTjNiaEk0alVyZHVMQTgwdDJjcENuT2hWcG9R\nMjZkZ1VhVmFqU3IxYjVHWEt6YndVMTBqMnYzRFdSaTFGdlFZWWprb0JJUW9z\nRlJYc1RpWitmMnk5ZG1LZStmZlRaYXpuV0d5eGFEQWVTa2R4WTJwdDU3RFNs\nOUx4dXpoVVk2eUlZQzBpSjkxeWZKaHRtaHNwdG0raktWVnNqbXcvakFlZkNG\nOUVrTjN6SFpZQ3l5cHlVLzg5cDZEU3BsNWd0d2NpL3hEdG93N2RNdFNtTll4\nVGdmengzWWdiMFMxVWZFdWdXOTVZeHFrUHdCamg3SFk4bTNTeDRQYkJ2S3RQ\nbm0vNkE2MTM5blVMNE4wVm0yRmNmZDhhVzl4LzQ4azBMeWxJMkdyTFRFMDhm\ncnBNMlp4dFlyRURENUI5ZXdRTFZUNDhJRUdnSk1KNnMrOUFncHdKYTZYOTBw\nUEdPRGpPN2RDcWEvaE1RTTZGYWtQaHVBbWhGS09acS9JZlg1Ym9FZDRDcWRx\nN1VpYzNtYWxNNTFkeEtuNGNTT0I3UXdyY0dsSkRxWXFPVmUxWDJURmlOU0R0\nOWwvTGlxeUpGZitKUVdHMHd3MTJYTFpwSjBzbkkyWEp6UG9hekQ0VU83Qm5V\nOVZCbStTbThTTUxzQUtFZzJQYkVXRGVHT0dYcHZVTFNRNHJzUElKZE40bFM3\nNmU5b1o4NUtzVTFCSDQveGJUTGdSeVZwSTB6QXFYTGdISjJpNFM0QnpicnRp\nTTUvK3pMV0tQaUl2MmRjQlJSb2YxNFM3UjNKOFp5ck4wdmxOcE9hWFZoVG9B\nTkJObEk5dWovTlNQYlhkMDV3WDVSdklmWGdYMFNUZ0NncFdseWhTUnhIS2Zs\ncmdFOThteXp4L1RpeGlaWFV1VUZUYy9La2NYQTJwOThlRytYTUxOK2FmZ25K\nM3pYNHYrclJjamdEYy9RNUdlNlIxdWJIS2VwRC9qZUVleGdwdzJBSTg1eDRB\ncGR2R0NlYTU0bUwzQVRidjE4UmdiK3cyQXV6b0xidjBZdlpVZCtxY1I3U2JQ\nZVBtd1V2aytnbkRzYWk5RXRzZnRPdkdUU2prdXhULzkxOEJvd3N0ajc5NkVJ\naHJaaG50TGtsUXNTcW9PbmkyR3dUVnpJcHhYQVU0YVgrZlpVZmdDU2kweFJQ\nRmJWdG54WTNpOVpCVVlVQTR3NXArTnI2Ti91TDF1NEdjbHRxM0RBNFF6TFpu\nNkRSdG0wREdVU3lIdzJ3Z0d3SHNrTGRxVjE0cDZ4N3VpYjFXU2tIcHJ1bXdH\nWTZQZGxpaVhtbllRV3Y5UEVraFIrb1M0VVZJZDRZTzdqODUya2Z1czVPTFRx\ndXhFazFIWWxQd2R0SCtuMlI4eG9uU3lNbTByVmlHNVh1QUNLK0RYM0pPZFMz\nOEQyOXcvR1dIckxHcDdQdUpEcmNpenR3QTYzSVhBWGdyYUZxaGl4YldJTjNu\nVUxQeWJLOENUbFhZWXo1bGR4UlpQMHdQR1pwK0d3dlBFNThCZWZ3YVM5cXRw\naXpvT0xZMkxZVitZalRxYlhKQ0J5aDJUYWJ3ekJwdUtHTjlMNk1CRys4SHlL\nTmltNFMvaUVZcHR1L2VmV1pmajR2TnM0RFRUMFZDSVg4UzQrR0xtWWNiS1o0\nWGpSOG0zd2xEWWVDWWZ2Sm52b3cxcFZnZXc3SVpiLzdvQXFKY1BSMnVXYkZu\nTXdrS3ltamJhVDVQOVJOWmNDeDJ6THJqdlBqT3dMZitVSXBpZENOK0tJQ3hy\nSy9yZHFlcFZQN0ZpdmJzOTJ3aUQ4TkM5UmhtQXpCZzdTQT09LmJndnE2Uy9h\nb094SzFwTlMuYmdVcTEwcEI5Ti9EbUcvZExrNU1VQT09Iiwic2lnIjoiOFEw\nTmV3b0JzaTNlMlpBR3RQaG9mVFBIT0JZVUFOWHlYVEU0UHFpSzhCU0FWWUdB\nUUFNdkM1bXhNLzBLeXR3a1NSekRsR01NWVRERzBITXhYbEpvQlE9PSIsImFs\nZyI6ImFlcy0yNTYtZ2NtK2VkMjU1MTkifQ==\n-----END LICENSE FILE-----\n"}
+	license := srv.AddLicense(keygentest.License{})
+	cert, err := srv.LicenseFile(license.ID, keygentest.CheckoutOptions{Encrypt: true})
+	if err != nil {
+		t.Fatalf("Should not fail minting license file: err=%v", err)
+	}
 
-	err := lic.Verify()
+	lic := &LicenseFile{Certificate: cert}
+
+	err = lic.Verify()
 	switch {
 	case err == ErrLicenseFileNotGenuine:
 		t.Fatalf("License file is not genuine: err=%v", err)
@@ -521,7 +991,7 @@ func TestLicenseFileNoTTL(t *testing.T) {
 		t.Fatalf("License file verification failed: err=%v", err)
 	}
 
-	dataset, err := lic.Decrypt(LicenseKey)
+	dataset, err := lic.Decrypt(license.Key)
 	switch {
 	case err == ErrLicenseFileExpired:
 		t.Fatalf("License file should not be expired: err=%v", err)
@@ -547,8 +1017,25 @@ func TestSignedKey(t *testing.T) {
 
 func TestUpgrade(t *testing.T) {
 	ctx := context.Background()
+	filename := "test_" + runtime.GOOS + "_" + runtime.GOARCH
+	if Ext != "" {
+		filename += "." + Ext
+	}
+
+	for _, release := range []keygentest.Release{
+		{Version: "1.0.0", Channel: "stable"},
+		{Version: "1.0.1", Channel: "stable"},
+		{Version: "1.1.0-beta.1", Channel: "beta"},
+	} {
+		release.Artifacts = []keygentest.Artifact{
+			{Filename: filename, Platform: runtime.GOOS, Arch: runtime.GOARCH, Content: []byte("v" + release.Version)},
+		}
+
+		srv.AddRelease(release)
+	}
+
 	opts := UpgradeOptions{
-		PublicKey:      os.Getenv("PERSONAL_PUBLIC_KEY"),
+		PublicKey:      srv.PersonalPublicKey,
 		Filename:       `test_{{.platform}}_{{.arch}}{{if .ext}}.{{.ext}}{{end}}`,
 		CurrentVersion: "1.0.0",
 		Channel:        "stable",
@@ -604,6 +1091,9 @@ func TestUpgrade(t *testing.T) {
 }
 
 func TestWebhook(t *testing.T) {
+	drift := MaxClockDrift
+	t.Cleanup(func() { MaxClockDrift = drift })
+
 	MaxClockDrift = -1
 
 	body := []byte(`{"data":{"id":"dfd66777-8a60-411c-b61c-ad51c671c0bd","type":"webhook-events","attributes":{"endpoint":"https://5173-2600-1700-3e90-a450-533-a11e-339-f87b.ngrok.io","payload":"{\"data\":{\"id\":\"1598f237-f82f-448a-91f7-18d2c7e6fd41\",\"type\":\"licenses\",\"attributes\":{\"name\":\"Floating Demo License\",\"key\":\"DEMO-DAD877-FCBF82-B83D5A-03E644-V3\",\"expiry\":\"2023-01-01T00:00:00.000Z\",\"status\":\"ACTIVE\",\"uses\":0,\"suspended\":false,\"scheme\":null,\"encrypted\":false,\"strict\":false,\"floating\":true,\"concurrent\":false,\"protected\":true,\"maxMachines\":10,\"maxProcesses\":null,\"maxCores\":null,\"maxUses\":null,\"requireHeartbeat\":false,\"requireCheckIn\":false,\"lastValidated\":\"2022-06-06T16:03:28.185Z\",\"lastCheckIn\":null,\"nextCheckIn\":null,\"metadata\":{\"token\":\"activ-cd4f3a6c17707b94bacab29ab489ddf5v3\"},\"created\":\"2021-04-20T16:14:46.713Z\",\"updated\":\"2022-06-06T16:03:28.190Z\"},\"relationships\":{\"account\":{\"links\":{\"related\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52\"},\"data\":{\"type\":\"accounts\",\"id\":\"1fddcec8-8dd3-4d8d-9b16-215cac0f9b52\"}},\"product\":{\"links\":{\"related\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/licenses/1598f237-f82f-448a-91f7-18d2c7e6fd41/product\"},\"data\":{\"type\":\"products\",\"id\":\"42b9731d-21f2-4911-a066-d380a96c3a94\"}},\"policy\":{\"links\":{\"related\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/licenses/1598f237-f82f-448a-91f7-18d2c7e6fd41/policy\"},\"data\":{\"type\":\"policies\",\"id\":\"d048c5e6-b813-4e94-a346-d70726397457\"}},\"group\":{\"links\":{\"related\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/licenses/1598f237-f82f-448a-91f7-18d2c7e6fd41/group\"},\"data\":null},\"user\":{\"links\":{\"related\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/licenses/1598f237-f82f-448a-91f7-18d2c7e6fd41/user\"},\"data\":null},\"machines\":{\"links\":{\"related\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/licenses/1598f237-f82f-448a-91f7-18d2c7e6fd41/machines\"},\"meta\":{\"cores\":0,\"count\":1}},\"tokens\":{\"links\":{\"related\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/licenses/1598f237-f82f-448a-91f7-18d2c7e6fd41/tokens\"}},\"entitlements\":{\"links\":{\"related\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/licenses/1598f237-f82f-448a-91f7-18d2c7e6fd41/entitlements\"}}},\"links\":{\"self\":\"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/licenses/1598f237-f82f-448a-91f7-18d2c7e6fd41\"}},\"meta\":{\"ts\":\"2022-06-06T16:03:28.206Z\",\"valid\":true,\"detail\":\"is valid\",\"constant\":\"VALID\",\"scope\":{\"fingerprint\":\"cbce3fc7-0568-476d-a078-069a5d0500a2\",\"entitlements\":[\"DEMO_ENTITLEMENT\"]}}}","event":"license.validation.succeeded","status":"DELIVERING","lastResponseCode":null,"lastResponseBody":null,"created":"2022-06-06T16:03:28.243Z","updated":"2022-06-06T16:03:28.243Z"},"relationships":{"account":{"links":{"related":"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52"},"data":{"type":"accounts","id":"1fddcec8-8dd3-4d8d-9b16-215cac0f9b52"}}},"links":{"self":"/v1/accounts/1fddcec8-8dd3-4d8d-9b16-215cac0f9b52/webhook-events/dfd66777-8a60-411c-b61c-ad51c671c0bd"},"meta":{"idempotencyToken":"99b89d681aecdff9a0435c9f507d00c5345a7c2d6e773f1756e4a9d42e4b14v3"}}}`)
@@ -618,7 +1108,11 @@ func TestWebhook(t *testing.T) {
 	req.Header.Add("Digest", `sha-256=9QceiZktviddaBO8zKZe18/L2kZSFwpGDcmvFkvIH3k=`)
 	req.Header.Add("Date", `Mon, 06 Jun 2022 16:13:37 GMT`)
 
-	if err := VerifyWebhook(req); err != nil {
+	// The webhook was signed by a real account, so verify it using the
+	// account's public key rather than the test server's
+	client := NewClientWithOptions(&ClientOptions{PublicKey: "e8601e48b69383ba520245fd07971e983d06d22c4257cfd82304601479cee788"})
+
+	if err := client.VerifyWebhook(req); err != nil {
 		t.Fatalf("Should verify webhook: err=%v", err)
 	}
 
@@ -634,9 +1128,2670 @@ func TestWebhook(t *testing.T) {
 }
 
 func TestHTTPClient(t *testing.T) {
+	client := HTTPClient
+	t.Cleanup(func() { HTTPClient = client })
+
 	re := retryablehttp.NewClient()
 	re.Backoff = retryablehttp.LinearJitterBackoff
 	re.RetryMax = 5
 
 	HTTPClient = re.StandardClient()
 }
+
+func TestClientWithOptions(t *testing.T) {
+	ctx := context.Background()
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		requests <- r
+		bodies <- body
+
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/me":
+			w.Write([]byte(`{"data":{"id":"a2c7a9b4-1d4a-4b4a-9f0e-2b3f8c7e6d51","type":"licenses","attributes":{"key":"key-a"}}}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/licenses/a2c7a9b4-1d4a-4b4a-9f0e-2b3f8c7e6d51/actions/validate":
+			var params struct {
+				Meta struct {
+					Nonce int64 `json:"nonce"`
+				} `json:"meta"`
+			}
+			json.Unmarshal(body, &params)
+
+			fmt.Fprintf(w, `{"data":{"id":"a2c7a9b4-1d4a-4b4a-9f0e-2b3f8c7e6d51","type":"licenses","attributes":{"key":"key-a"}},"meta":{"valid":false,"detail":"fingerprint is not activated","code":"NO_MACHINE","nonce":%d}}`, params.Meta.Nonce)
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/machines":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"data":{"id":"f4b1c3a2-0e7d-4c5b-8a9f-1e2d3c4b5a69","type":"machines","attributes":{"fingerprint":"fp-a"}}}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1/machines/f4b1c3a2-0e7d-4c5b-8a9f-1e2d3c4b5a69":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"title":"Not found","code":"NOT_FOUND"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClientWithOptions(&ClientOptions{
+		Account:     "b1a2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d",
+		Product:     "product-a",
+		Environment: "environment-a",
+		LicenseKey:  "key-a",
+		APIURL:      srv.URL,
+		HTTPClient:  srv.Client(),
+		Logger:      NewNilLogger(),
+	})
+
+	license, err := client.Validate(ctx, "fp-a")
+	if !errors.Is(err, ErrLicenseNotActivated) {
+		t.Fatalf("Should not be activated: err=%v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req, body := <-requests, <-bodies
+
+		switch {
+		case req.Header.Get("Authorization") != "License key-a":
+			t.Fatalf("Should use the client's license key: header=%s", req.Header.Get("Authorization"))
+		case req.Header.Get("Keygen-Environment") != "environment-a":
+			t.Fatalf("Should use the client's environment: header=%s", req.Header.Get("Keygen-Environment"))
+		case req.Method == http.MethodPost && !bytes.Contains(body, []byte(`"product":"product-a"`)):
+			t.Fatalf("Should scope the validation to the client's product: body=%s", body)
+		}
+	}
+
+	machine, err := license.Activate(ctx, "fp-a")
+	if err != nil {
+		t.Fatalf("Should activate using the client: err=%v", err)
+	}
+
+	<-requests
+	<-bodies
+
+	if err := machine.Deactivate(ctx); err != nil {
+		t.Fatalf("Should deactivate using the client: err=%v", err)
+	}
+
+	if req := <-requests; req.Header.Get("Authorization") != "License key-a" {
+		t.Fatalf("Should use the client's license key: header=%s", req.Header.Get("Authorization"))
+	}
+}
+
+func TestClientConcurrency(t *testing.T) {
+	ctx := context.Background()
+	concurrency := 25
+
+	var mu sync.Mutex
+	var inflight, peak int
+
+	arrived := make(chan struct{})
+	once := sync.Once{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		if peak == concurrency {
+			once.Do(func() { close(arrived) })
+		}
+		mu.Unlock()
+
+		// Hold each request open until every request is in-flight at once, which
+		// would never happen if requests were serialized.
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+		}
+
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/machines/"):
+			w.Write([]byte(`{"data":{"id":"f4b1c3a2-0e7d-4c5b-8a9f-1e2d3c4b5a69","type":"machines","attributes":{"heartbeatStatus":"ALIVE"}}}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/processes/"):
+			w.Write([]byte(`{"data":{"id":"c0ffee00-1d4a-4b4a-9f0e-2b3f8c7e6d51","type":"processes","attributes":{"status":"ALIVE"}}}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/releases/"):
+			w.Header().Set("Location", "https://example.com/artifact")
+			w.WriteHeader(http.StatusSeeOther)
+			w.Write([]byte(`{"data":{"id":"a1b2c3d4-1d4a-4b4a-9f0e-2b3f8c7e6d51","type":"artifacts","attributes":{"filename":"app"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	clients := []*Client{
+		NewClientWithOptions(&ClientOptions{Account: "a", LicenseKey: "key-a", APIURL: srv.URL, Logger: NewNilLogger()}),
+		NewClientWithOptions(&ClientOptions{Account: "b", LicenseKey: "key-b", APIURL: srv.URL, Logger: NewNilLogger()}),
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		client := clients[i%len(clients)]
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			switch i % 3 {
+			case 0:
+				machine := &Machine{ID: "f4b1c3a2-0e7d-4c5b-8a9f-1e2d3c4b5a69", client: client}
+
+				errs <- machine.ping(ctx)
+			case 1:
+				process := &Process{ID: "c0ffee00-1d4a-4b4a-9f0e-2b3f8c7e6d51", client: client}
+
+				errs <- process.ping(ctx)
+			case 2:
+				release := &Release{ID: "a1b2c3d4-1d4a-4b4a-9f0e-2b3f8c7e6d51", opts: UpgradeOptions{Filename: "app"}, client: client}
+				artifact, err := release.artifact(ctx)
+				if err == nil && artifact.URL != "https://example.com/artifact" {
+					err = fmt.Errorf("unexpected artifact URL: url=%s", artifact.URL)
+				}
+
+				errs <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Should not fail concurrent request: err=%v", err)
+		}
+	}
+
+	if peak != concurrency {
+		t.Fatalf("Should perform requests in parallel: actual=%d expected=%d", peak, concurrency)
+	}
+
+	if HTTPClient.CheckRedirect != nil {
+		t.Fatalf("Should not mutate the shared HTTP client")
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.Method+" "+r.URL.Path]++
+		n := attempts[r.Method+" "+r.URL.Path]
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+
+		switch {
+		case r.URL.Path == "/v1/machines/flaky" && n < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/v1/machines/flaky":
+			w.Write([]byte(`{"data":{"id":"flaky","type":"machines","attributes":{}}}`))
+		case (r.URL.Path == "/v1/machines/limited" || r.URL.Path == "/v1/machines/capped") && n < 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors":[{"title":"Throttle limit reached"}]}`))
+		case r.URL.Path == "/v1/machines/limited", r.URL.Path == "/v1/machines/capped":
+			w.Write([]byte(`{"data":{"id":"limited","type":"machines","attributes":{}}}`))
+		case r.URL.Path == "/v1/machines/beating/actions/ping" && n < 2:
+			w.Write([]byte(`{"data":{"id":"beating","type":"machines","attributes":{"heartbeatStatus":"ALIVE","heartbeatDuration":600}}}`))
+		case r.URL.Path == "/v1/machines/lost" && n < 2:
+			// The machine is deleted, but its response is lost
+			w.WriteHeader(http.StatusBadGateway)
+		case r.URL.Path == "/v1/machines/lost", r.URL.Path == "/v1/machines/gone":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"title":"Not found","code":"NOT_FOUND"}]}`))
+		case r.URL.Path == "/v1/machines/throttled":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors":[{"title":"Throttle limit reached"}]}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClientWithOptions(&ClientOptions{
+		Account: "a",
+		APIURL:  srv.URL,
+		Logger:  NewNilLogger(),
+		Retries: &RetryOptions{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+	})
+
+	// Retries idempotent requests on 5xx
+	if _, err := client.Get(ctx, "machines/flaky", nil, &Machine{}); err != nil {
+		t.Fatalf("Should retry server errors: err=%v", err)
+	}
+
+	if n := attempts["GET /v1/machines/flaky"]; n != 3 {
+		t.Fatalf("Should make 3 attempts: attempts=%d", n)
+	}
+
+	// Gives up after max attempts
+	_, err := client.Get(ctx, "machines/down", nil, &Machine{})
+	if _, ok := err.(*ServerError); !ok {
+		t.Fatalf("Should return a server error: err=%v", err)
+	}
+
+	if n := attempts["GET /v1/machines/down"]; n != 3 {
+		t.Fatalf("Should make 3 attempts: attempts=%d", n)
+	}
+
+	// Does not retry non-idempotent requests on 5xx
+	_, err = client.Post(ctx, "machines", &Machine{Fingerprint: "fp"}, &Machine{})
+	if _, ok := err.(*ServerError); !ok {
+		t.Fatalf("Should return a server error: err=%v", err)
+	}
+
+	if n := attempts["POST /v1/machines"]; n != 1 {
+		t.Fatalf("Should not retry an activation: attempts=%d", n)
+	}
+
+	// Retries idempotent actions on 5xx, with the same body
+	_, err = client.Post(ctx, "machines/down/actions/ping", nil, &Machine{})
+	if _, ok := err.(*ServerError); !ok {
+		t.Fatalf("Should return a server error: err=%v", err)
+	}
+
+	if n := attempts["POST /v1/machines/down/actions/ping"]; n != 3 {
+		t.Fatalf("Should retry a ping: attempts=%d", n)
+	}
+
+	// Does not retry other actions on 5xx
+	_, err = client.Post(ctx, "licenses/down/actions/renew", nil, &License{})
+	if _, ok := err.(*ServerError); !ok {
+		t.Fatalf("Should return a server error: err=%v", err)
+	}
+
+	if n := attempts["POST /v1/licenses/down/actions/renew"]; n != 1 {
+		t.Fatalf("Should not retry a renewal: attempts=%d", n)
+	}
+
+	// Does not retry heartbeat pings sent by a monitor, which has its own backoff
+	failed := make(chan error, 1)
+	monitor, err := (&Machine{ID: "beating", client: client}).MonitorWithOptions(ctx, MonitorOptions{
+		Interval: time.Millisecond,
+		OnError: func(err error) {
+			select {
+			case failed <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should start the monitor: err=%v", err)
+	}
+
+	<-failed
+	monitor.Stop()
+
+	mu.Lock()
+	n := attempts["POST /v1/machines/beating/actions/ping"]
+	mu.Unlock()
+
+	if n != 2 {
+		t.Fatalf("Should not retry a monitor's ping: attempts=%d", n)
+	}
+
+	// Treats a retried deletion that's not found as deleted
+	if err := (&Machine{ID: "lost", client: client}).Deactivate(ctx); err != nil {
+		t.Fatalf("Should deactivate when the response is lost: err=%v", err)
+	}
+
+	if n := attempts["DELETE /v1/machines/lost"]; n != 2 {
+		t.Fatalf("Should retry a deactivation: attempts=%d", n)
+	}
+
+	// Still fails a deletion that's not found on the first attempt
+	if err := (&Machine{ID: "gone", client: client}).Deactivate(ctx); !notFound(err) {
+		t.Fatalf("Should not find machine: err=%v", err)
+	}
+
+	// Caps Retry-After by MaxBackoff
+	start := time.Now()
+
+	if _, err := client.Get(ctx, "machines/capped", nil, &Machine{}); err != nil {
+		t.Fatalf("Should retry rate limited requests: err=%v", err)
+	}
+
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("Should cap Retry-After: duration=%s", d)
+	}
+
+	// Honors Retry-After
+	patient := NewClientWithOptions(&ClientOptions{
+		Account: "a",
+		APIURL:  srv.URL,
+		Logger:  NewNilLogger(),
+		Retries: &RetryOptions{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Minute},
+	})
+
+	start = time.Now()
+
+	if _, err := patient.Get(ctx, "machines/limited", nil, &Machine{}); err != nil {
+		t.Fatalf("Should retry rate limited requests: err=%v", err)
+	}
+
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("Should wait for Retry-After: duration=%s", d)
+	}
+
+	// Does not retry certificate errors
+	tlsSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tlsSrv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	transport := &slowDeleteTransport{}
+	untrusted := NewClientWithOptions(&ClientOptions{
+		Account:    "a",
+		APIURL:     tlsSrv.URL,
+		Logger:     NewNilLogger(),
+		HTTPClient: &http.Client{Transport: transport},
+		Retries:    &RetryOptions{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+	})
+
+	if err := (&Machine{ID: "untrusted", client: untrusted}).Deactivate(ctx); err == nil {
+		t.Fatalf("Should fail with an untrusted certificate")
+	}
+
+	if n := transport.count(); n != 1 {
+		t.Fatalf("Should not retry a certificate error: attempts=%d", n)
+	}
+
+	// Gives up when Retry-After exceeds the context's deadline
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	_, err = patient.Get(ctx, "machines/throttled", nil, &Machine{})
+	if e, ok := err.(*RateLimitError); !ok || e.RetryAfter != 60 {
+		t.Fatalf("Should return a rate limit error: err=%v", err)
+	}
+
+	if n := attempts["GET /v1/machines/throttled"]; n != 1 {
+		t.Fatalf("Should not retry past the deadline: attempts=%d", n)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	ctx := context.Background()
+	pages := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages++
+
+		if r.URL.Path != "/v1/licenses/lic/machines" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		size, _ := strconv.Atoi(r.URL.Query().Get("page[size]"))
+		number, _ := strconv.Atoi(r.URL.Query().Get("page[number]"))
+		total := 5
+
+		var data []string
+		for i := (number - 1) * size; i < number*size && i < total; i++ {
+			data = append(data, fmt.Sprintf(`{"id":"m%d","type":"machines","attributes":{"fingerprint":"fp%d"}}`, i, i))
+		}
+
+		next := "null"
+		if number*size < total {
+			next = fmt.Sprintf(`"/v1/licenses/lic/machines?page%%5Bnumber%%5D=%d&page%%5Bsize%%5D=%d"`, number+1, size)
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		fmt.Fprintf(w, `{"data":[%s],"links":{"next":%s}}`, strings.Join(data, ","), next)
+	}))
+	defer srv.Close()
+
+	client := NewClientWithOptions(&ClientOptions{Account: "a", APIURL: srv.URL, Logger: NewNilLogger()})
+	license := &License{ID: "lic", client: client}
+
+	machines, err := license.Machines(ctx, ListPageSize(2))
+	if err != nil {
+		t.Fatalf("Should not fail listing machines: err=%v", err)
+	}
+
+	switch {
+	case len(machines) != 5:
+		t.Fatalf("Should list machines across all pages: machines=%v", machines)
+	case pages != 3:
+		t.Fatalf("Should follow next links: pages=%d", pages)
+	case machines[4].Fingerprint != "fp4":
+		t.Fatalf("Should list machines in order: machines=%v", machines)
+	case machines[4].client != client:
+		t.Fatalf("Should bind machines to the client")
+	}
+
+	// Starting from a later page
+	pages = 0
+
+	it := license.IterMachines(ctx, ListPageSize(2), ListPageNumber(3))
+	n := 0
+	for it.Next() {
+		n++
+	}
+
+	if err := it.Err(); err != nil || n != 1 || pages != 1 {
+		t.Fatalf("Should start from the given page: n=%d pages=%d err=%v", n, pages, err)
+	}
+
+	// Cancellation
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	it = license.IterMachines(ctx, ListPageSize(2))
+	for it.Next() {
+		cancel()
+	}
+
+	if err := it.Err(); err != context.Canceled {
+		t.Fatalf("Should stop iterating when canceled: err=%v", err)
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	ctx := context.Background()
+	queries := make(chan url.Values, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+
+		switch r.URL.Path {
+		case "/v1/machines/m/processes":
+			w.Write([]byte(`{"data":[{"id":"p","type":"processes","attributes":{"status":"ALIVE"}}],"links":{"next":null}}`))
+		case "/v1/releases":
+			w.Write([]byte(`{"data":[{"id":"r","type":"releases","attributes":{"version":"1.0.0"}}],"links":{"next":null}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClientWithOptions(&ClientOptions{Account: "a", APIURL: srv.URL, Logger: NewNilLogger()})
+	machine := &Machine{ID: "m", client: client}
+
+	processes, err := machine.Processes(
+		ctx,
+		FilterProcessStatus(ProcessStatusCodeAlive),
+		ListSort("-created", "pid"),
+		ListFields("processes", "pid", "status"),
+		ListInclude("machine"),
+	)
+	if err != nil {
+		t.Fatalf("Should not fail listing processes: err=%v", err)
+	}
+
+	if len(processes) != 1 || processes[0].Status != ProcessStatusCodeAlive {
+		t.Fatalf("Should list processes: processes=%v", processes)
+	}
+
+	q := <-queries
+	expected := url.Values{
+		"status":            {"ALIVE"},
+		"sort":              {"-created,pid"},
+		"fields[processes]": {"pid,status"},
+		"include":           {"machine"},
+		"page[size]":        {"100"},
+		"page[number]":      {"1"},
+	}
+
+	if q.Encode() != expected.Encode() {
+		t.Fatalf("Should encode list options: actual=%s expected=%s", q.Encode(), expected.Encode())
+	}
+
+	releases, err := client.Releases(ctx, FilterReleasePlatform("linux"), FilterReleaseChannel("stable"))
+	if err != nil {
+		t.Fatalf("Should not fail listing releases: err=%v", err)
+	}
+
+	if len(releases) != 1 || releases[0].Version != "1.0.0" {
+		t.Fatalf("Should list releases: releases=%v", releases)
+	}
+
+	if q := <-queries; q.Get("platform") != "linux" || q.Get("channel") != "stable" {
+		t.Fatalf("Should filter releases: query=%s", q.Encode())
+	}
+}
+
+func TestLicenseExpired(t *testing.T) {
+	ctx := context.Background()
+	expiry := time.Now().Add(-time.Hour)
+	license := srv.AddLicense(keygentest.License{Expiry: &expiry})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	if _, err := client.Validate(ctx); !errors.Is(err, ErrLicenseExpired) {
+		t.Fatalf("Should be expired: err=%v", err)
+	}
+
+	err := srv.UpdateLicense(license.ID, func(l *keygentest.License) {
+		l.Expiry = nil
+		l.Suspended = true
+	})
+	if err != nil {
+		t.Fatalf("Should not fail updating license: err=%v", err)
+	}
+
+	if _, err := client.Validate(ctx); !errors.Is(err, ErrLicenseSuspended) {
+		t.Fatalf("Should be suspended: err=%v", err)
+	}
+}
+
+func TestHeartbeatDead(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{RequireHeartbeat: true})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	if err := machine.ping(ctx); err != nil {
+		t.Fatalf("Should not fail heartbeat ping: err=%v", err)
+	}
+
+	if err := srv.KillMachine(machine.ID); err != nil {
+		t.Fatalf("Should not fail killing machine: err=%v", err)
+	}
+
+	if err := machine.ping(ctx); err != ErrHeartbeatDead {
+		t.Fatalf("Should have a dead heartbeat: err=%v", err)
+	}
+
+	if err := l.Validate(ctx, machine.Fingerprint); !errors.Is(err, ErrHeartbeatDead) {
+		t.Fatalf("Should be invalid: err=%v", err)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	if d := heartbeatInterval(10 * time.Second); d != 5*time.Second {
+		t.Fatalf("Should have a positive interval for a short heartbeat window: interval=%s", d)
+	}
+
+	if d := heartbeatInterval(10 * time.Minute); d != 10*time.Minute-30*time.Second {
+		t.Fatalf("Should account for network lag: interval=%s", d)
+	}
+
+	activate := func(license keygentest.License) (*Machine, error) {
+		license = srv.AddLicense(license)
+		client := NewClientWithOptions(&ClientOptions{
+			Account:    srv.Account,
+			Product:    srv.Product,
+			PublicKey:  srv.PublicKey,
+			LicenseKey: license.Key,
+			APIURL:     srv.URL,
+			Retries:    &RetryOptions{MaxAttempts: 1},
+		})
+
+		l, err := client.Validate(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		return l.Activate(context.Background(), uuid.NewString())
+	}
+
+	t.Run("stops when canceled", func(t *testing.T) {
+		machine, err := activate(keygentest.License{RequireHeartbeat: true, HeartbeatDuration: 10 * time.Second})
+		if err != nil {
+			t.Fatalf("Should not fail activation: err=%v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		monitor, err := machine.MonitorWithOptions(ctx, MonitorOptions{})
+		if err != nil {
+			t.Fatalf("Should not fail first heartbeat ping: err=%v", err)
+		}
+
+		if monitor.Status() != HeartbeatStatusCodeAlive {
+			t.Fatalf("Should have a heartbeat that is alive: status=%s", monitor.Status())
+		}
+
+		cancel()
+
+		select {
+		case <-monitor.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("Should stop when its context is canceled")
+		}
+
+		if err := monitor.Err(); err != nil {
+			t.Fatalf("Should not have an error when canceled: err=%v", err)
+		}
+	})
+
+	t.Run("retries transient failures", func(t *testing.T) {
+		machine, err := activate(keygentest.License{RequireHeartbeat: true})
+		if err != nil {
+			t.Fatalf("Should not fail activation: err=%v", err)
+		}
+
+		errs := make(chan error, 16)
+		monitor, err := machine.MonitorWithOptions(context.Background(), MonitorOptions{
+			Interval: 10 * time.Millisecond,
+			OnError: func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+		})
+		if err != nil {
+			t.Fatalf("Should not fail first heartbeat ping: err=%v", err)
+		}
+		defer monitor.Stop()
+
+		srv.FailNext(1, http.StatusServiceUnavailable)
+
+		select {
+		case err := <-errs:
+			var serverErr *ServerError
+			if !errors.As(err, &serverErr) {
+				t.Fatalf("Should report a server error: err=%v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Should report a failed heartbeat ping")
+		}
+
+		if err := srv.KillMachine(machine.ID); err != nil {
+			t.Fatalf("Should not fail killing machine: err=%v", err)
+		}
+
+		select {
+		case err := <-errs:
+			if err != ErrHeartbeatDead {
+				t.Fatalf("Should report a dead heartbeat: err=%v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Should report a dead heartbeat")
+		}
+
+		select {
+		case <-monitor.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("Should stop when the heartbeat is dead")
+		}
+
+		if err := monitor.Err(); err != ErrHeartbeatDead {
+			t.Fatalf("Should be stopped by a dead heartbeat: err=%v", err)
+		}
+	})
+
+	t.Run("handles resurrection", func(t *testing.T) {
+		machine, err := activate(keygentest.License{RequireHeartbeat: true, HeartbeatResurrectionStrategy: "ALWAYS_REVIVE"})
+		if err != nil {
+			t.Fatalf("Should not fail activation: err=%v", err)
+		}
+
+		resurrected := make(chan struct{}, 1)
+		monitor, err := machine.MonitorWithOptions(context.Background(), MonitorOptions{
+			Interval: 10 * time.Millisecond,
+			OnResurrected: func() {
+				select {
+				case resurrected <- struct{}{}:
+				default:
+				}
+			},
+		})
+		if err != nil {
+			t.Fatalf("Should not fail first heartbeat ping: err=%v", err)
+		}
+
+		if err := srv.KillMachine(machine.ID); err != nil {
+			t.Fatalf("Should not fail killing machine: err=%v", err)
+		}
+
+		select {
+		case <-resurrected:
+		case <-time.After(time.Second):
+			t.Fatalf("Should report a resurrected heartbeat")
+		}
+
+		monitor.Stop()
+
+		select {
+		case <-monitor.Done():
+		default:
+			t.Fatalf("Should be stopped")
+		}
+
+		if err := monitor.Err(); err != nil {
+			t.Fatalf("Should keep monitoring a resurrected heartbeat: err=%v", err)
+		}
+	})
+}
+
+func TestProcessLifecycle(t *testing.T) {
+	spawned := keygentest.NewServer()
+	defer spawned.Close()
+
+	// Count the scheduler's goroutines, to check that none are leaked
+	schedulers := func() int {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+
+		return strings.Count(string(buf), "(*HeartbeatScheduler).")
+	}
+
+	before := schedulers()
+	scheduler := NewHeartbeatScheduler(SchedulerOptions{Workers: 2})
+	license := spawned.AddLicense(keygentest.License{MaxProcesses: 5, RequireHeartbeat: true})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    spawned.Account,
+		Product:    spawned.Product,
+		PublicKey:  spawned.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     spawned.URL,
+		Retries:    &RetryOptions{MaxAttempts: 1},
+		Scheduler:  scheduler,
+	})
+
+	ctx := context.Background()
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	errs := make(chan error, 16)
+	opts := SpawnOptions{
+		Metadata: map[string]interface{}{"worker": "a"},
+		Interval: 10 * time.Millisecond,
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	}
+
+	alive := func(process *Process) bool {
+		t.Helper()
+
+		processes, err := machine.Processes(ctx)
+		if err != nil {
+			t.Fatalf("Should not fail listing processes: err=%v", err)
+		}
+
+		for _, p := range processes {
+			if p.ID == process.ID {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	stopped, err := machine.SpawnWithOptions(ctx, uuid.NewString(), opts)
+	if err != nil {
+		t.Fatalf("Should not fail spawning process: err=%v", err)
+	}
+
+	if stopped.Metadata["worker"] != "a" {
+		t.Fatalf("Should have spawn metadata: metadata=%v", stopped.Metadata)
+	}
+
+	stopped.Stop()
+
+	requests := spawned.Requests()
+	time.Sleep(50 * time.Millisecond)
+
+	if n := spawned.Requests(); n != requests {
+		t.Fatalf("Should not ping after stop: requests=%d", n-requests)
+	}
+
+	if !alive(stopped) {
+		t.Fatalf("Should not kill a stopped process: process=%v", stopped)
+	}
+
+	if err := stopped.Kill(ctx); err != nil {
+		t.Fatalf("Should not fail killing process: err=%v", err)
+	}
+
+	killed, err := machine.SpawnWithOptions(ctx, uuid.NewString(), opts)
+	if err != nil {
+		t.Fatalf("Should not fail spawning process: err=%v", err)
+	}
+
+	if err := killed.Kill(ctx); err != nil {
+		t.Fatalf("Should not fail killing process: err=%v", err)
+	}
+
+	select {
+	case <-killed.Done():
+	default:
+		t.Fatalf("Should stop pinging when killed")
+	}
+
+	if alive(killed) {
+		t.Fatalf("Should be killed: process=%v", killed)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+
+	canceled, err := machine.SpawnWithOptions(cctx, uuid.NewString(), opts)
+	if err != nil {
+		t.Fatalf("Should not fail spawning process: err=%v", err)
+	}
+
+	cancel()
+
+	select {
+	case <-canceled.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Should stop when its context is canceled")
+	}
+
+	if alive(canceled) {
+		t.Fatalf("Should be killed when its context is canceled: process=%v", canceled)
+	}
+
+	dead, err := machine.SpawnWithOptions(ctx, uuid.NewString(), opts)
+	if err != nil {
+		t.Fatalf("Should not fail spawning process: err=%v", err)
+	}
+
+	spawned.FailNext(1, http.StatusServiceUnavailable)
+
+	select {
+	case err := <-errs:
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) {
+			t.Fatalf("Should report a server error: err=%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Should report a failed heartbeat ping")
+	}
+
+	if err := spawned.KillProcess(dead.ID); err != nil {
+		t.Fatalf("Should not fail killing process: err=%v", err)
+	}
+
+	select {
+	case <-dead.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Should stop when the heartbeat is dead")
+	}
+
+	if err := dead.Err(); err != ErrHeartbeatDead {
+		t.Fatalf("Should be stopped by a dead heartbeat: err=%v", err)
+	}
+
+	if n := scheduler.Metrics().Monitors; n != 0 {
+		t.Fatalf("Should not have any scheduled monitors: monitors=%d", n)
+	}
+
+	scheduler.Close()
+
+	// A goroutine may still be exiting right after Close returns
+	for i := 0; schedulers() != before; i++ {
+		if i == 100 {
+			t.Fatalf("Should not leak goroutines: before=%d after=%d", before, schedulers())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// concurrencyTransport records the peak number of concurrent requests.
+type concurrencyTransport struct {
+	mu       sync.Mutex
+	inflight int
+	peak     int
+}
+
+func (c *concurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.inflight++
+	if c.inflight > c.peak {
+		c.peak = c.inflight
+	}
+	c.mu.Unlock()
+
+	// Hold the request briefly, so that concurrent requests overlap
+	time.Sleep(time.Millisecond)
+
+	res, err := http.DefaultTransport.RoundTrip(req)
+
+	c.mu.Lock()
+	c.inflight--
+	c.mu.Unlock()
+
+	return res, err
+}
+
+func TestHeartbeatScheduler(t *testing.T) {
+	queue := heartbeatQueue{}
+	now := time.Now()
+	for _, offset := range []int{3, 1, 4, 1, 5, 9, 2, 6} {
+		heap.Push(&queue, &HeartbeatMonitor{due: now.Add(time.Duration(offset) * time.Second)})
+	}
+
+	var prev time.Time
+	for queue.Len() > 0 {
+		h := heap.Pop(&queue).(*HeartbeatMonitor)
+		if h.due.Before(prev) {
+			t.Fatalf("Should pop monitors in order of when they're due: due=%v prev=%v", h.due, prev)
+		}
+
+		prev = h.due
+	}
+
+	scheduled := keygentest.NewServer()
+	defer scheduled.Close()
+
+	transport := &concurrencyTransport{}
+	scheduler := NewHeartbeatScheduler(SchedulerOptions{Workers: 2})
+	license := scheduled.AddLicense(keygentest.License{RequireHeartbeat: true})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    scheduled.Account,
+		Product:    scheduled.Product,
+		PublicKey:  scheduled.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     scheduled.URL,
+		HTTPClient: &http.Client{Transport: transport},
+		Retries:    &RetryOptions{MaxAttempts: 1},
+		Scheduler:  scheduler,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	processes := []*Process{}
+	for i := 0; i < 20; i++ {
+		process, err := machine.SpawnWithOptions(ctx, uuid.NewString(), SpawnOptions{Interval: 5 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("Should not fail spawning process: err=%v", err)
+		}
+
+		processes = append(processes, process)
+	}
+
+	if n := scheduler.Metrics().Monitors; n != len(processes) {
+		t.Fatalf("Should schedule every process: monitors=%d", n)
+	}
+
+	// Processes sharing a context are watched using its Done channel once
+	scheduler.mu.Lock()
+	watched := len(scheduler.watched)
+	scheduler.mu.Unlock()
+
+	if watched != 1 {
+		t.Fatalf("Should watch the shared context once: watched=%d", watched)
+	}
+
+	// Reset the peak after spawning, which isn't bounded by the scheduler
+	transport.mu.Lock()
+	transport.peak = 0
+	transport.mu.Unlock()
+
+	for i := 0; scheduler.Metrics().Pings < 100; i++ {
+		if i == 500 {
+			t.Fatalf("Should send heartbeat pings: metrics=%+v", scheduler.Metrics())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	transport.mu.Lock()
+	peak := transport.peak
+	transport.mu.Unlock()
+
+	if peak > 2 {
+		t.Fatalf("Should not send more pings concurrently than there are workers: peak=%d", peak)
+	}
+
+	if err := scheduled.KillProcess(processes[0].ID); err != nil {
+		t.Fatalf("Should not fail killing process: err=%v", err)
+	}
+
+	select {
+	case <-processes[0].Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Should stop a dead process")
+	}
+
+	if err := processes[0].Err(); err != ErrHeartbeatDead {
+		t.Fatalf("Should be stopped by a dead heartbeat: err=%v", err)
+	}
+
+	metrics := scheduler.Metrics()
+	if metrics.Failures == 0 {
+		t.Fatalf("Should count failed pings: metrics=%+v", metrics)
+	}
+
+	if metrics.Monitors != len(processes)-1 {
+		t.Fatalf("Should unschedule a dead process: metrics=%+v", metrics)
+	}
+
+	scheduler.Close()
+
+	for _, process := range processes {
+		select {
+		case <-process.Done():
+		default:
+			t.Fatalf("Should stop every process when closed: process=%v", process)
+		}
+	}
+
+	if _, err := machine.SpawnWithOptions(ctx, uuid.NewString(), SpawnOptions{}); err != ErrHeartbeatSchedulerClosed {
+		t.Fatalf("Should not schedule a monitor once closed: err=%v", err)
+	}
+}
+
+// blockingTransport holds DELETE requests, e.g. to kill a process, until
+// release is closed.
+type blockingTransport struct {
+	release chan struct{}
+}
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodDelete {
+		<-b.release
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHeartbeatCallbacks(t *testing.T) {
+	callbacks := keygentest.NewServer()
+	defer callbacks.Close()
+
+	transport := &blockingTransport{release: make(chan struct{})}
+	scheduler := NewHeartbeatScheduler(SchedulerOptions{Workers: 1})
+	defer scheduler.Close()
+
+	license := callbacks.AddLicense(keygentest.License{RequireHeartbeat: true})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    callbacks.Account,
+		Product:    callbacks.Product,
+		PublicKey:  callbacks.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     callbacks.URL,
+		HTTPClient: &http.Client{Transport: transport},
+		Retries:    &RetryOptions{MaxAttempts: 1},
+		Scheduler:  scheduler,
+	})
+
+	ctx := context.Background()
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	// Stop the monitor from its own callback
+	monitors := make(chan *HeartbeatMonitor, 1)
+	stopped := make(chan struct{})
+
+	monitor, err := machine.MonitorWithOptions(ctx, MonitorOptions{
+		Interval: 5 * time.Millisecond,
+		OnError: func(err error) {
+			(<-monitors).Stop()
+
+			close(stopped)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Should not fail monitor: err=%v", err)
+	}
+
+	monitors <- monitor
+
+	callbacks.FailNext(1, http.StatusServiceUnavailable)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Should not deadlock when stopped from a callback")
+	}
+
+	select {
+	case <-monitor.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Should stop the monitor once the callback returns")
+	}
+
+	if err := monitor.Err(); err != nil {
+		t.Fatalf("Should not fail a stopped monitor: err=%v", err)
+	}
+
+	// Kill a canceled process without blocking the only worker
+	pctx, cancel := context.WithCancel(ctx)
+
+	process, err := machine.SpawnWithOptions(pctx, uuid.NewString(), SpawnOptions{Interval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Should not fail spawning process: err=%v", err)
+	}
+
+	other, err := machine.MonitorWithOptions(ctx, MonitorOptions{Interval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Should not fail monitor: err=%v", err)
+	}
+	defer other.Stop()
+
+	cancel()
+
+	pings := scheduler.Metrics().Pings
+	for i := 0; scheduler.Metrics().Pings < pings+10; i++ {
+		if i == 500 {
+			t.Fatalf("Should keep sending pings while killing a process: metrics=%+v", scheduler.Metrics())
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case <-process.Done():
+		t.Fatalf("Should not be done until the process is killed")
+	default:
+	}
+
+	close(transport.release)
+
+	select {
+	case <-process.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Should be done once the process is killed")
+	}
+
+	if processes, err := machine.Processes(ctx); err != nil || len(processes) != 0 {
+		t.Fatalf("Should kill the process: processes=%v err=%v", processes, err)
+	}
+}
+
+// slowDeleteTransport delays DELETE requests, e.g. to kill a process, counting
+// them.
+type slowDeleteTransport struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	deletes int
+}
+
+func (s *slowDeleteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodDelete {
+		s.mu.Lock()
+		s.deletes++
+		s.mu.Unlock()
+
+		time.Sleep(s.delay)
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (s *slowDeleteTransport) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deletes
+}
+
+func TestProcessKillCanceled(t *testing.T) {
+	killed := keygentest.NewServer()
+	defer killed.Close()
+
+	transport := &slowDeleteTransport{delay: 200 * time.Millisecond}
+	scheduler := NewHeartbeatScheduler(SchedulerOptions{Workers: 1})
+	defer scheduler.Close()
+
+	license := killed.AddLicense(keygentest.License{RequireHeartbeat: true})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    killed.Account,
+		Product:    killed.Product,
+		PublicKey:  killed.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     killed.URL,
+		HTTPClient: &http.Client{Transport: transport},
+		Retries:    &RetryOptions{MaxAttempts: 1},
+		Scheduler:  scheduler,
+	})
+
+	ctx := context.Background()
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	pctx, cancel := context.WithCancel(ctx)
+
+	process, err := machine.Spawn(pctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail spawning process: err=%v", err)
+	}
+
+	cancel()
+
+	// Kill while the kill after the context was canceled is in flight
+	for i := 0; transport.count() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("Should kill the process when its context is canceled")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := process.Kill(ctx); err != nil {
+		t.Fatalf("Should not fail killing a canceled process: err=%v", err)
+	}
+
+	if n := transport.count(); n != 1 {
+		t.Fatalf("Should only delete the process once: deletes=%d", n)
+	}
+
+	if processes, err := machine.Processes(ctx); err != nil || len(processes) != 0 {
+		t.Fatalf("Should kill the process: processes=%v err=%v", processes, err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	newClient := func() *Client {
+		license := srv.AddLicense(keygentest.License{MaxMachines: 1, MaxProcesses: 1, RequireHeartbeat: true})
+
+		return NewClientWithOptions(&ClientOptions{
+			Account:    srv.Account,
+			Product:    srv.Product,
+			PublicKey:  srv.PublicKey,
+			LicenseKey: license.Key,
+			APIURL:     srv.URL,
+			Retries:    &RetryOptions{MaxAttempts: 1},
+		})
+	}
+
+	t.Run("deactivates on signal", func(t *testing.T) {
+		ctx := context.Background()
+		client := newClient()
+
+		var mu sync.Mutex
+		events := []SessionEvent{}
+
+		session, err := client.StartSession(ctx, SessionOptions{
+			Fingerprint: uuid.NewString(),
+			Activate:    true,
+			Deactivate:  true,
+			Spawn:       true,
+			Signals:     []os.Signal{os.Interrupt},
+			OnEvent: func(event SessionEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				events = append(events, event)
+			},
+		})
+		if err != nil {
+			t.Fatalf("Should not fail starting session: err=%v", err)
+		}
+
+		if session.State() != SessionStateCodeActive {
+			t.Fatalf("Should be active: state=%s", session.State())
+		}
+
+		if session.Machine() == nil || session.Process() == nil {
+			t.Fatalf("Should have a machine and a process: machine=%v process=%v", session.Machine(), session.Process())
+		}
+
+		// Deliver the signal directly, rather than interrupting the test
+		session.signals <- os.Interrupt
+
+		select {
+		case <-session.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("Should end when signaled")
+		}
+
+		if err := session.Err(); err != nil {
+			t.Fatalf("Should not fail ending session: err=%v", err)
+		}
+
+		mu.Lock()
+		states := []SessionStateCode{}
+		for _, event := range events {
+			states = append(states, event.State)
+		}
+
+		signaled := events[3].Signal
+		mu.Unlock()
+
+		expected := []SessionStateCode{
+			SessionStateCodeValidating,
+			SessionStateCodeActivating,
+			SessionStateCodeActive,
+			SessionStateCodeStopping,
+			SessionStateCodeDeactivating,
+			SessionStateCodeClosed,
+		}
+
+		if fmt.Sprint(states) != fmt.Sprint(expected) {
+			t.Fatalf("Should report transitions: states=%v", states)
+		}
+
+		if signaled != os.Interrupt {
+			t.Fatalf("Should report the signal: signal=%v", signaled)
+		}
+
+		machines, err := session.License().Machines(ctx)
+		if err != nil {
+			t.Fatalf("Should not fail listing machines: err=%v", err)
+		}
+
+		if len(machines) != 0 {
+			t.Fatalf("Should deactivate the machine: machines=%v", machines)
+		}
+	})
+
+	t.Run("requires activation", func(t *testing.T) {
+		var state SessionStateCode
+
+		_, err := newClient().StartSession(context.Background(), SessionOptions{
+			Fingerprint: uuid.NewString(),
+			OnEvent:     func(event SessionEvent) { state = event.State },
+		})
+		if !errors.Is(err, ErrLicenseNotActivated) {
+			t.Fatalf("Should not be activated: err=%v", err)
+		}
+
+		if state != SessionStateCodeFailed {
+			t.Fatalf("Should fail: state=%s", state)
+		}
+	})
+
+	t.Run("frees seat when canceled", func(t *testing.T) {
+		client := newClient()
+		options := SessionOptions{Fingerprint: uuid.NewString(), Activate: true, Deactivate: true}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		session, err := client.StartSession(ctx, options)
+		if err != nil {
+			t.Fatalf("Should not fail starting session: err=%v", err)
+		}
+
+		cancel()
+
+		select {
+		case <-session.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("Should end when canceled")
+		}
+
+		options.Fingerprint = uuid.NewString()
+
+		other, err := client.StartSession(context.Background(), options)
+		if err != nil {
+			t.Fatalf("Should activate a freed seat: err=%v", err)
+		}
+
+		if err := other.Close(); err != nil {
+			t.Fatalf("Should not fail closing session: err=%v", err)
+		}
+	})
+
+	t.Run("ends when heartbeat dies", func(t *testing.T) {
+		session, err := newClient().StartSession(context.Background(), SessionOptions{
+			Fingerprint: uuid.NewString(),
+			Activate:    true,
+			Deactivate:  true,
+			Monitor:     MonitorOptions{Interval: 10 * time.Millisecond},
+		})
+		if err != nil {
+			t.Fatalf("Should not fail starting session: err=%v", err)
+		}
+
+		if err := srv.KillMachine(session.Machine().ID); err != nil {
+			t.Fatalf("Should not fail killing machine: err=%v", err)
+		}
+
+		select {
+		case <-session.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("Should end when the heartbeat dies")
+		}
+
+		if err := session.Err(); err != ErrHeartbeatDead {
+			t.Fatalf("Should end with a dead heartbeat: err=%v", err)
+		}
+	})
+}
+
+func TestActivateWithOptions(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{MaxCores: 4})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.ActivateWithOptions(ctx, uuid.NewString(),
+		ActivateName("Build Agent"),
+		ActivateHostname("agent-1"),
+		ActivatePlatform("linux/arm64"),
+		ActivateCores(2),
+		ActivateIP("10.0.0.1"),
+		ActivateMetadata(map[string]interface{}{"region": "us-east-1"}),
+		ActivateComponents(Component{Fingerprint: uuid.NewString(), Name: "GPU"}),
+	)
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	switch {
+	case machine.Name != "Build Agent":
+		t.Fatalf("Should have a name: name=%s", machine.Name)
+	case machine.Hostname != "agent-1":
+		t.Fatalf("Should have a hostname: hostname=%s", machine.Hostname)
+	case machine.Platform != "linux/arm64":
+		t.Fatalf("Should have a platform: platform=%s", machine.Platform)
+	case machine.Cores != 2:
+		t.Fatalf("Should have cores: cores=%d", machine.Cores)
+	case machine.IP != "10.0.0.1":
+		t.Fatalf("Should have an IP: ip=%s", machine.IP)
+	case machine.Metadata["region"] != "us-east-1":
+		t.Fatalf("Should have metadata: metadata=%v", machine.Metadata)
+	}
+
+	components, err := machine.Components(ctx)
+	if err != nil {
+		t.Fatalf("Should not fail listing components: err=%v", err)
+	}
+
+	if len(components) != 1 || components[0].Name != "GPU" {
+		t.Fatalf("Should have components: components=%v", components)
+	}
+
+	_, err = l.ActivateWithOptions(ctx, uuid.NewString(), ActivateCores(4))
+	if err == nil {
+		t.Fatalf("Should fail over-limit activation: machine=%v", machine)
+	}
+
+	// Defaults to the current machine's attributes
+	machine, err = l.ActivateWithOptions(ctx, uuid.NewString(), ActivateCores(1))
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	if machine.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Fatalf("Should have the current platform: platform=%s", machine.Platform)
+	}
+}
+
+func TestMachineUpdate(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.ActivateWithOptions(ctx, uuid.NewString(),
+		ActivateName("Build Agent"),
+		ActivateMetadata(map[string]interface{}{"region": "us-east-1"}),
+	)
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	if err := machine.UpdateName(ctx, "Release Agent"); err != nil {
+		t.Fatalf("Should not fail updating name: err=%v", err)
+	}
+
+	switch {
+	case machine.Name != "Release Agent":
+		t.Fatalf("Should have a new name: name=%s", machine.Name)
+	case machine.Metadata["region"] != "us-east-1":
+		t.Fatalf("Should not update metadata: metadata=%v", machine.Metadata)
+	}
+
+	if err := machine.UpdateMetadata(ctx, map[string]interface{}{"region": "eu-west-1"}); err != nil {
+		t.Fatalf("Should not fail updating metadata: err=%v", err)
+	}
+
+	switch {
+	case machine.Metadata["region"] != "eu-west-1":
+		t.Fatalf("Should have new metadata: metadata=%v", machine.Metadata)
+	case machine.Name != "Release Agent":
+		t.Fatalf("Should not update name: name=%s", machine.Name)
+	}
+
+	if err := machine.UpdateMetadata(ctx, nil); err != nil {
+		t.Fatalf("Should not fail clearing metadata: err=%v", err)
+	}
+
+	if len(machine.Metadata) != 0 {
+		t.Fatalf("Should clear metadata: metadata=%v", machine.Metadata)
+	}
+
+	fetched, err := l.Machine(ctx, machine.ID)
+	if err != nil {
+		t.Fatalf("Should not fail retrieving machine: err=%v", err)
+	}
+
+	if fetched.Name != "Release Agent" {
+		t.Fatalf("Should persist name: name=%s", fetched.Name)
+	}
+
+	gone := &Machine{ID: uuid.NewString(), client: client}
+	if err := gone.UpdateName(ctx, "Ghost"); !notFound(err) {
+		t.Fatalf("Should not find machine: err=%v", err)
+	}
+}
+
+func TestSyncComponents(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{ComponentMatchingStrategy: "MATCH_ALL"})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	fingerprint := uuid.NewString()
+	board := Component{Name: "Motherboard", Fingerprint: uuid.NewString()}
+	disk := Component{Name: "Disk", Fingerprint: uuid.NewString()}
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, fingerprint, board, disk)
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	// Nothing to sync
+	changes, err := machine.SyncComponents(ctx, board, disk)
+	if err != nil {
+		t.Fatalf("Should not fail sync: err=%v", err)
+	}
+
+	if len(changes.Added) != 0 || len(changes.Removed) != 0 {
+		t.Fatalf("Should not change components: changes=%v", changes)
+	}
+
+	// Swap the disk
+	replacement := Component{Name: "Disk", Fingerprint: uuid.NewString()}
+
+	changes, err = machine.SyncComponents(ctx, board, replacement)
+	if err != nil {
+		t.Fatalf("Should not fail sync: err=%v", err)
+	}
+
+	switch {
+	case len(changes.Added) != 1 || changes.Added[0].Fingerprint != replacement.Fingerprint:
+		t.Fatalf("Should add the new disk: changes=%v", changes)
+	case len(changes.Removed) != 1 || changes.Removed[0].Fingerprint != disk.Fingerprint:
+		t.Fatalf("Should remove the old disk: changes=%v", changes)
+	}
+
+	components, err := machine.Components(ctx)
+	if err != nil {
+		t.Fatalf("Should not fail listing components: err=%v", err)
+	}
+
+	if len(components) != 2 {
+		t.Fatalf("Should have components: components=%v", components)
+	}
+
+	if _, err := client.ValidateWithOptions(ctx, ValidateFingerprint(fingerprint), ValidateComponents(board.Fingerprint, replacement.Fingerprint)); err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	if _, err := client.ValidateWithOptions(ctx, ValidateFingerprint(fingerprint), ValidateComponents(board.Fingerprint, disk.Fingerprint)); !errors.Is(err, ErrComponentNotActivated) {
+		t.Fatalf("Should be invalid: err=%v", err)
+	}
+
+	// Duplicate local fingerprints
+	requests := srv.Requests()
+
+	if _, err := machine.SyncComponents(ctx, board, board); !errors.Is(err, ErrComponentConflict) {
+		t.Fatalf("Should conflict: err=%v", err)
+	}
+
+	if srv.Requests() != requests {
+		t.Fatalf("Should not send requests: requests=%d", srv.Requests()-requests)
+	}
+
+	// A fingerprint in use by another of the license's machines
+	other, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	changes, err = other.SyncComponents(ctx, Component{Name: "NIC", Fingerprint: uuid.NewString()}, board)
+	if !errors.Is(err, ErrComponentAlreadyActivated) {
+		t.Fatalf("Should already be activated: err=%v", err)
+	}
+
+	if len(changes.Added) != 1 || len(changes.Removed) != 0 {
+		t.Fatalf("Should return the changes so far: changes=%v", changes)
+	}
+
+	if _, err := other.AddComponent(ctx, replacement); !errors.Is(err, ErrComponentAlreadyActivated) {
+		t.Fatalf("Should already be activated: err=%v", err)
+	}
+
+	// A taken machine fingerprint is still reported as a machine's
+	if _, err := l.Activate(ctx, other.Fingerprint); err != ErrMachineAlreadyActivated {
+		t.Fatalf("Should already be activated: err=%v", err)
+	}
+
+	if err := other.RemoveComponent(ctx, uuid.NewString()); !notFound(err) {
+		t.Fatalf("Should not find component: err=%v", err)
+	}
+}
+
+func TestAvailableCores(t *testing.T) {
+	write := func(t *testing.T, path string, data string) {
+		t.Helper()
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Should not fail creating dir: err=%v", err)
+		}
+
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Should not fail writing file: err=%v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		self  string
+		files map[string]string
+		cores int
+		ok    bool
+	}{
+		{"v2 quota", "0::/\n", map[string]string{"cpu.max": "200000 100000\n"}, 2, true},
+		{"v2 fractional quota", "0::/\n", map[string]string{"cpu.max": "150000 100000\n"}, 2, true},
+		{"v2 unlimited", "0::/\n", map[string]string{"cpu.max": "max 100000\n"}, 0, false},
+		{"v2 nested quota", "0::/user.slice/app.scope\n", map[string]string{"user.slice/app.scope/cpu.max": "300000 100000\n", "user.slice/cpu.max": "max 100000\n"}, 3, true},
+		{"v2 parent quota", "0::/user.slice/app.scope\n", map[string]string{"user.slice/app.scope/cpu.max": "400000 100000\n", "user.slice/cpu.max": "100000 100000\n"}, 1, true},
+		{"v2 unmounted cgroup", "0::/docker/abc\n", map[string]string{"cpu.max": "200000 100000\n"}, 2, true},
+		{"v1 quota", "", map[string]string{"cpu/cpu.cfs_quota_us": "50000\n", "cpu/cpu.cfs_period_us": "100000\n"}, 1, true},
+		{"v1 cpuacct quota", "", map[string]string{"cpu,cpuacct/cpu.cfs_quota_us": "400000\n", "cpu,cpuacct/cpu.cfs_period_us": "100000\n"}, 4, true},
+		{"v1 nested quota", "4:memory:/\n3:cpu,cpuacct:/docker/abc\n", map[string]string{"cpu,cpuacct/docker/abc/cpu.cfs_quota_us": "200000\n", "cpu,cpuacct/docker/abc/cpu.cfs_period_us": "100000\n"}, 2, true},
+		{"v1 unlimited", "", map[string]string{"cpu/cpu.cfs_quota_us": "-1\n", "cpu/cpu.cfs_period_us": "100000\n"}, 0, false},
+		{"no cgroup", "", map[string]string{}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for path, data := range tt.files {
+				write(t, filepath.Join(root, path), data)
+			}
+
+			self := filepath.Join(t.TempDir(), "cgroup")
+			if tt.self != "" {
+				write(t, self, tt.self)
+			}
+
+			cores, ok := cgroupCores(root, self)
+			if cores != tt.cores || ok != tt.ok {
+				t.Fatalf("Should read cgroup quota: cores=%d ok=%v", cores, ok)
+			}
+		})
+	}
+
+	root := t.TempDir()
+	write(t, filepath.Join(root, "cpu.max"), "100000 100000\n")
+
+	prevRoot, prevSelf := cgroupRoot, cgroupSelf
+	t.Cleanup(func() { cgroupRoot, cgroupSelf = prevRoot, prevSelf })
+
+	cgroupRoot = root
+	cgroupSelf = filepath.Join(root, "self")
+
+	if cores := AvailableCores(); cores != 1 {
+		t.Fatalf("Should honor the cgroup quota: cores=%d", cores)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{MaxMachines: 1})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	fingerprint := uuid.NewString()
+	l, err := client.Validate(ctx, fingerprint)
+
+	// Validations keep returning the sentinel error, so existing comparisons work
+	if err != ErrLicenseNotActivated {
+		t.Fatalf("Should be a not activated error: err=%v", err)
+	}
+
+	e := l.LastValidationError()
+	if e == nil {
+		t.Fatalf("Should have a validation error: err=%v", err)
+	}
+
+	if e.Result.Code != ValidationCodeNoMachine || e.Result.Detail == "" {
+		t.Fatalf("Should have a validation result: result=%+v", e.Result)
+	}
+
+	if e.Result.Scope == nil || e.Result.Scope.Fingerprint != fingerprint {
+		t.Fatalf("Should have a validation scope: scope=%+v", e.Result.Scope)
+	}
+
+	if e.License == nil || e.License.ID != license.ID {
+		t.Fatalf("Should have a license: license=%+v", e.License)
+	}
+
+	if e.ResponseID == "" {
+		t.Fatalf("Should have a response ID: err=%v", e)
+	}
+
+	if !errors.Is(e, ErrLicenseNoMachine) {
+		t.Fatalf("Should be a no machine error: err=%v", e)
+	}
+
+	if !errors.Is(e, ErrLicenseNotActivated) {
+		t.Fatalf("Should be a not activated error: err=%v", e)
+	}
+
+	if errors.Is(e, ErrLicenseInvalid) {
+		t.Fatalf("Should not be an invalid error: err=%v", e)
+	}
+
+	if _, err := l.Activate(ctx, fingerprint); err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	if err := l.Validate(ctx, fingerprint); err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	if e := l.LastValidationError(); e != nil {
+		t.Fatalf("Should not have a validation error: err=%v", e)
+	}
+}
+
+func TestValidateWithOptions(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{
+		Entitlements: []string{"PREMIUM"},
+		PolicyID:     uuid.NewString(),
+		UserID:       uuid.NewString(),
+	})
+	release := srv.AddRelease(keygentest.Release{
+		Version:   "1.0.0",
+		Channel:   "stable",
+		Artifacts: []keygentest.Artifact{{Filename: "app", Content: []byte("genuine")}},
+	})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	sum := sha512.Sum512(release.Artifacts[0].Content)
+	checksum := base64.RawStdEncoding.EncodeToString(sum[:])
+
+	l, err = client.ValidateWithOptions(ctx,
+		ValidateFingerprint(machine.Fingerprint),
+		ValidateEntitlements("PREMIUM"),
+		ValidatePolicy(license.PolicyID),
+		ValidateMachine(machine.ID),
+		ValidateUser(license.UserID),
+		ValidateChecksum(checksum),
+	)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	if scope := l.LastValidation.Scope; scope == nil || len(scope.Entitlements) != 1 || scope.Policy != license.PolicyID || scope.Machine != machine.ID {
+		t.Fatalf("Should have validation scopes: scope=%+v", scope)
+	}
+
+	tests := []struct {
+		option ValidateOption
+		err    error
+	}{
+		{ValidateEntitlements("PREMIUM", "ENTERPRISE"), ErrLicenseEntitlementsMissing},
+		{ValidatePolicy(uuid.NewString()), ErrValidationPolicyScopeMismatch},
+		{ValidateMachine(uuid.NewString()), ErrValidationMachineScopeMismatch},
+		{ValidateUser(uuid.NewString()), ErrValidationUserScopeMismatch},
+		{ValidateChecksum("invalid"), ErrValidationChecksumScopeMismatch},
+	}
+
+	for _, test := range tests {
+		if err := l.ValidateWithOptions(ctx, test.option); err != ErrLicenseInvalid {
+			t.Fatalf("Should be an invalid error: err=%v", err)
+		}
+
+		if e := l.LastValidationError(); !errors.Is(e, test.err) {
+			t.Fatalf("Should be invalid: err=%v expected=%v", e, test.err)
+		}
+	}
+}
+
+// replayTransport replays the first validation response for every following
+// validation, like a MITM proxy would.
+type replayTransport struct {
+	header http.Header
+	body   []byte
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/actions/validate") {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	if t.body != nil {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     t.header.Clone(),
+			Body:       io.NopCloser(bytes.NewReader(t.body)),
+			Request:    req,
+		}, nil
+	}
+
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	t.header = res.Header.Clone()
+	t.body = body
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	return res, nil
+}
+
+func TestValidationNonce(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+		HTTPClient: &http.Client{Transport: &replayTransport{}},
+	})
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	if l.LastValidation.Nonce == 0 {
+		t.Fatalf("Should have a nonce: result=%+v", l.LastValidation)
+	}
+
+	if err := l.Validate(ctx); err != ErrValidationNonceMismatch {
+		t.Fatalf("Should reject a replayed validation: err=%v", err)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{Entitlements: []string{"PREMIUM"}})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:   srv.Account,
+		Product:   srv.Product,
+		PublicKey: srv.PublicKey,
+		APIURL:    srv.URL,
+	})
+
+	requests := srv.Requests()
+
+	l, err := client.ValidateKey(ctx, license.Key, ValidateEntitlements("PREMIUM"))
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	if n := srv.Requests() - requests; n != 1 {
+		t.Fatalf("Should validate in a single request: requests=%d", n)
+	}
+
+	if l.ID != license.ID || l.LastValidation == nil || l.LastValidation.Code != ValidationCodeValid {
+		t.Fatalf("Should have a validated license: license=%+v", l)
+	}
+
+	l, err = client.ValidateKey(ctx, license.Key, ValidateEntitlements("ENTERPRISE"))
+	if err != ErrLicenseInvalid {
+		t.Fatalf("Should be invalid: err=%v", err)
+	}
+
+	if e := l.LastValidationError(); !errors.Is(e, ErrLicenseEntitlementsMissing) {
+		t.Fatalf("Should be missing entitlements: err=%v", e)
+	}
+
+	l, err = client.ValidateKey(ctx, uuid.NewString())
+	if err != ErrLicenseInvalid {
+		t.Fatalf("Should be invalid: err=%v", err)
+	}
+
+	if e := l.LastValidationError(); !errors.Is(e, ErrLicenseNotFound) {
+		t.Fatalf("Should not be found: err=%v", e)
+	}
+}
+
+func TestVerifyLicenseKey(t *testing.T) {
+	drift := MaxClockDrift
+	MaxClockDrift = time.Minute
+	t.Cleanup(func() { MaxClockDrift = drift })
+
+	client := NewClientWithOptions(&ClientOptions{PublicKey: srv.PublicKey})
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	license := srv.AddLicense(keygentest.License{
+		Scheme: "ED25519_SIGN",
+		Key:    fmt.Sprintf(`{"expiry":"%s","entitlements":["PREMIUM"],"policy":"policy-a","metadata":{"seats":5}}`, expiry.Format(time.RFC3339)),
+	})
+
+	dataset := &LicenseKeyDataset{}
+	if err := client.VerifyLicenseKey(license.Key, dataset); err != nil {
+		t.Fatalf("Should be a genuine license key: err=%v", err)
+	}
+
+	switch {
+	case dataset.Expiry == nil || !dataset.Expiry.Equal(expiry):
+		t.Fatalf("Should have an expiry: expiry=%v", dataset.Expiry)
+	case len(dataset.Entitlements) != 1 || dataset.Entitlements[0] != "PREMIUM":
+		t.Fatalf("Should have entitlements: entitlements=%v", dataset.Entitlements)
+	case dataset.Policy != "policy-a":
+		t.Fatalf("Should have a policy: policy=%s", dataset.Policy)
+	case dataset.Metadata["seats"] != float64(5):
+		t.Fatalf("Should have metadata: metadata=%v", dataset.Metadata)
+	}
+
+	custom := &struct {
+		Metadata struct {
+			Seats int `json:"seats"`
+		} `json:"metadata"`
+	}{}
+	if err := client.VerifyLicenseKey(license.Key, custom); err != nil || custom.Metadata.Seats != 5 {
+		t.Fatalf("Should decode a custom dataset: err=%v dataset=%+v", err, custom)
+	}
+
+	expired := srv.AddLicense(keygentest.License{
+		Scheme: "ED25519_SIGN",
+		Key:    fmt.Sprintf(`{"expiry":"%s"}`, time.Now().Add(-time.Hour).Format(time.RFC3339)),
+	})
+	if err := client.VerifyLicenseKey(expired.Key, nil); err != ErrLicenseKeyExpired {
+		t.Fatalf("Should be an expired license key: err=%v", err)
+	}
+
+	future := srv.AddLicense(keygentest.License{
+		Scheme: "ED25519_SIGN",
+		Key:    fmt.Sprintf(`{"issued":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339)),
+	})
+	if err := client.VerifyLicenseKey(future.Key, nil); err != ErrSystemClockUnsynced {
+		t.Fatalf("Should be an unsynced clock: err=%v", err)
+	}
+
+	tampered := strings.Replace(license.Key, "key/", "key/e30", 1)
+	if err := client.VerifyLicenseKey(tampered, nil); err != ErrLicenseKeyNotGenuine {
+		t.Fatalf("Should not be a genuine license key: err=%v", err)
+	}
+
+	if err := client.VerifyLicenseKey("key/malformed", nil); err != ErrLicenseNotSigned {
+		t.Fatalf("Should not be a signed license key: err=%v", err)
+	}
+
+	if err := client.VerifyLicenseKey("C1B6DE-39A6E3-DE1529-8559A0-4AF593-V3", nil); err != ErrLicenseNotSigned {
+		t.Fatalf("Should not be a signed license key: err=%v", err)
+	}
+}
+
+func TestRSASchemes(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Should not fail generating key: err=%v", err)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Should not fail generating key: err=%v", err)
+	}
+
+	pkix, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Should not fail marshaling key: err=%v", err)
+	}
+
+	pkixKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+	pkcs1Key := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)}))
+	otherPKIX, err := x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Should not fail marshaling key: err=%v", err)
+	}
+
+	otherPEMKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherPKIX}))
+	dataset := `{"entitlements":["PREMIUM"]}`
+
+	sign := func(pss bool) string {
+		enc := base64.URLEncoding.EncodeToString([]byte(dataset))
+		digest := sha256.Sum256([]byte("key/" + enc))
+
+		var sig []byte
+		if pss {
+			sig, err = rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, digest[:], nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+		}
+		if err != nil {
+			t.Fatalf("Should not fail signing key: err=%v", err)
+		}
+
+		return "key/" + enc + "." + base64.URLEncoding.EncodeToString(sig)
+	}
+
+	// Encrypting with the private key is an unhashed PKCS1 v1.5 signature
+	ciphertext, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.Hash(0), []byte(dataset))
+	if err != nil {
+		t.Fatalf("Should not fail encrypting key: err=%v", err)
+	}
+
+	pkcs1Sign, pssSign := sign(false), sign(true)
+	encrypt := base64.URLEncoding.EncodeToString(ciphertext)
+	tampered := pkcs1Sign[:len(pkcs1Sign)-8] + "AAAAAAA="
+
+	tests := []struct {
+		name      string
+		scheme    SchemeCode
+		key       string
+		publicKey string
+		err       error
+	}{
+		{"pkcs1 sign", SchemeCodeRSAPKCS1Sign, pkcs1Sign, pkixKey, nil},
+		{"pkcs1 sign with pkcs1 public key", SchemeCodeRSAPKCS1Sign, pkcs1Sign, pkcs1Key, nil},
+		{"pss sign", SchemeCodeRSAPSSSign, pssSign, pkixKey, nil},
+		{"pkcs1 encrypt", SchemeCodeRSAPKCS1Encrypt, encrypt, pkixKey, nil},
+		{"tampered signature", SchemeCodeRSAPKCS1Sign, tampered, pkixKey, ErrLicenseKeyNotGenuine},
+		{"wrong padding", SchemeCodeRSAPSSSign, pkcs1Sign, pkixKey, ErrLicenseKeyNotGenuine},
+		{"wrong public key", SchemeCodeRSAPKCS1Sign, pkcs1Sign, otherPEMKey, ErrLicenseKeyNotGenuine},
+		{"wrong public key for encrypt", SchemeCodeRSAPKCS1Encrypt, encrypt, otherPEMKey, ErrLicenseKeyNotGenuine},
+		{"invalid public key", SchemeCodeRSAPKCS1Sign, pkcs1Sign, "invalid", ErrPublicKeyInvalid},
+		{"missing public key", SchemeCodeRSAPKCS1Sign, pkcs1Sign, "", ErrPublicKeyMissing},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := &verifier{RSAPublicKey: test.publicKey}
+
+			data, err := verifier.VerifyLicense(&License{Scheme: test.scheme, Key: test.key})
+			if err != test.err {
+				t.Fatalf("Should verify the license key: err=%v expected=%v", err, test.err)
+			}
+
+			if test.err == nil && string(data) != dataset {
+				t.Fatalf("Should decode the dataset: dataset=%s", data)
+			}
+
+			// Detecting the scheme tries both paddings, so a padding mismatch
+			// is still genuine
+			if test.name == "wrong padding" {
+				return
+			}
+
+			client := NewClientWithOptions(&ClientOptions{RSAPublicKey: test.publicKey})
+
+			decoded := &LicenseKeyDataset{}
+			if err := client.VerifyLicenseKey(test.key, decoded); err != test.err {
+				t.Fatalf("Should verify the license key: err=%v expected=%v", err, test.err)
+			}
+
+			if test.err == nil && (len(decoded.Entitlements) != 1 || decoded.Entitlements[0] != "PREMIUM") {
+				t.Fatalf("Should decode the dataset: dataset=%+v", decoded)
+			}
+		})
+	}
+}
+
+func TestRSAFiles(t *testing.T) {
+	client := NewClientWithOptions(&ClientOptions{PublicKey: srv.PublicKey, RSAPublicKey: srv.RSAPublicKey})
+
+	tests := []struct {
+		scheme  string
+		encrypt bool
+		alg     string
+	}{
+		{"RSA_2048_PKCS1_PSS_SIGN_V2", true, "aes-256-gcm+rsa-pss-sha256"},
+		{"RSA_2048_PKCS1_PSS_SIGN_V2", false, "base64+rsa-pss-sha256"},
+		{"RSA_2048_PKCS1_SIGN_V2", true, "aes-256-gcm+rsa-sha256"},
+		{"RSA_2048_PKCS1_SIGN_V2", false, "base64+rsa-sha256"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.alg, func(t *testing.T) {
+			license := srv.AddLicense(keygentest.License{Scheme: test.scheme, Key: `{"entitlements":[]}`})
+			machine, err := srv.AddMachine(keygentest.Machine{LicenseID: license.ID, Fingerprint: uuid.NewString()})
+			if err != nil {
+				t.Fatalf("Should not fail adding machine: err=%v", err)
+			}
+
+			opts := keygentest.CheckoutOptions{Encrypt: test.encrypt, TTL: time.Hour}
+
+			licenseCert, err := srv.LicenseFile(license.ID, opts)
+			if err != nil {
+				t.Fatalf("Should not fail minting license file: err=%v", err)
+			}
+
+			machineCert, err := srv.MachineFile(machine.ID, opts)
+			if err != nil {
+				t.Fatalf("Should not fail minting machine file: err=%v", err)
+			}
+
+			lic := &LicenseFile{Certificate: licenseCert, client: client}
+			if cert, err := lic.certificate(); err != nil || cert.Alg != test.alg {
+				t.Fatalf("Should have the algorithm: cert=%+v err=%v", cert, err)
+			}
+
+			if err := lic.Verify(); err != nil {
+				t.Fatalf("Should be a genuine license file: err=%v", err)
+			}
+
+			mac := &MachineFile{Certificate: machineCert, client: client}
+			if err := mac.Verify(); err != nil {
+				t.Fatalf("Should be a genuine machine file: err=%v", err)
+			}
+
+			if test.encrypt {
+				if dataset, err := lic.Decrypt(license.Key); err != nil || dataset.License.ID != license.ID {
+					t.Fatalf("Should decrypt the license file: err=%v", err)
+				}
+
+				if dataset, err := mac.Decrypt(license.Key + machine.Fingerprint); err != nil || dataset.Machine.ID != machine.ID {
+					t.Fatalf("Should decrypt the machine file: err=%v", err)
+				}
+			}
+
+			// The Ed25519 public key can't verify an RSA signature
+			lic.client = NewClientWithOptions(&ClientOptions{PublicKey: srv.PublicKey})
+			if err := lic.Verify(); !errors.Is(err, ErrPublicKeyMissing) {
+				t.Fatalf("Should require an RSA public key: err=%v", err)
+			}
+
+			lic.client = NewClientWithOptions(&ClientOptions{RSAPublicKey: srv.RSAPublicKey})
+			lic.Certificate, _ = srv.LicenseFile(srv.AddLicense(keygentest.License{}).ID, opts)
+			if err := lic.Verify(); !errors.Is(err, ErrPublicKeyMissing) {
+				t.Fatalf("Should require an Ed25519 public key: err=%v", err)
+			}
+		})
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	ctx := context.Background()
+	license := srv.AddLicense(keygentest.License{})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+		Retries:    &RetryOptions{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+	})
+
+	// Server errors
+	{
+		srv.FailNext(2, http.StatusServiceUnavailable)
+		requests := srv.Requests()
+
+		if _, err := client.Validate(ctx); err != nil {
+			t.Fatalf("Should retry server errors: err=%v", err)
+		}
+
+		if n := srv.Requests() - requests; n != 4 {
+			t.Fatalf("Should retry failed request: actual=%d expected=%d", n, 4)
+		}
+
+		srv.FailNext(3, http.StatusInternalServerError)
+
+		_, err := client.Validate(ctx)
+		if _, ok := err.(*ServerError); !ok {
+			t.Fatalf("Should fail after max attempts: err=%v", err)
+		}
+	}
+
+	// Rate limits
+	{
+		srv.RateLimitNext(1, 0)
+
+		if _, err := client.Validate(ctx); err != nil {
+			t.Fatalf("Should retry rate limited request: err=%v", err)
+		}
+
+		client.Retries = &RetryOptions{MaxAttempts: 1}
+		srv.RateLimitNext(1, 30)
+
+		_, err := client.Validate(ctx)
+		if e, ok := err.(*RateLimitError); !ok || e.RetryAfter != 30 {
+			t.Fatalf("Should be rate limited: err=%v", err)
+		}
+	}
+}
+
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	t       time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	t time.Time
+	c chan time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.t
+}
+
+func (c *fakeClock) until(t time.Time) (<-chan time.Time, func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if !t.After(c.t) {
+		ch <- c.t
+	} else {
+		c.waiters = append(c.waiters, fakeWaiter{t, ch})
+	}
+
+	return ch, func() bool { return true }
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.t = c.t.Add(d)
+
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.t.After(c.t) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- c.t
+		}
+	}
+
+	c.waiters = waiters
+}
+
+func TestLease(t *testing.T) {
+	drift := MaxClockDrift
+	t.Cleanup(func() { MaxClockDrift = drift })
+
+	// The server's clock is controlled by the test, so skip clock drift checks
+	MaxClockDrift = -1
+
+	clock := &fakeClock{t: time.Now()}
+	leased := keygentest.NewServer()
+	leased.Now = clock.now
+	defer leased.Close()
+
+	license := leased.AddLicense(keygentest.License{})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    leased.Account,
+		Product:    leased.Product,
+		PublicKey:  leased.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     leased.URL,
+		Retries:    &RetryOptions{MaxAttempts: 1},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	path := t.TempDir() + "/license.lic"
+	events := make(chan LeaseEvent, 16)
+	opts := LeaseOptions{
+		Path:    path,
+		TTL:     time.Hour,
+		OnEvent: func(event LeaseEvent) { events <- event },
+	}
+
+	expect := func(codes ...LeaseEventCode) LeaseEvent {
+		t.Helper()
+
+		var event LeaseEvent
+		for _, code := range codes {
+			select {
+			case event = <-events:
+				if event.Code != code {
+					t.Fatalf("Should send event: actual=%s expected=%s err=%v", event.Code, code, event.Err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Should send event: expected=%s", code)
+			}
+		}
+
+		return event
+	}
+
+	lease, err := startLease(ctx, opts, l.leaseSource(""), clock)
+	if err != nil {
+		t.Fatalf("Should not fail starting lease: err=%v", err)
+	}
+
+	issued := clock.now()
+	if expiry := lease.Expiry(); !expiry.Equal(issued.Add(time.Hour).Truncate(time.Second)) {
+		t.Fatalf("Should have an expiry: expiry=%v", expiry)
+	}
+
+	if persisted, err := LoadLicenseFile(path); err != nil || persisted.Certificate != lease.File().(*LicenseFile).Certificate {
+		t.Fatalf("Should persist the license file: err=%v", err)
+	}
+
+	// Renews halfway to the file's expiry
+	clock.Advance(31 * time.Minute)
+
+	event := expect(LeaseEventCodeRenewed)
+	if !event.Expiry.After(issued.Add(time.Hour)) {
+		t.Fatalf("Should renew the license file: expiry=%v", event.Expiry)
+	}
+
+	// Offline, until the file expires
+	leased.FailNext(3, http.StatusServiceUnavailable)
+
+	clock.Advance(31 * time.Minute)
+
+	if event := expect(LeaseEventCodeRenewalFailed); event.Err == nil {
+		t.Fatalf("Should have a renewal error: event=%+v", event)
+	}
+
+	clock.Advance(23 * time.Minute)
+	expect(LeaseEventCodeExpiringSoon, LeaseEventCodeRenewalFailed)
+
+	clock.Advance(6 * time.Minute)
+	expect(LeaseEventCodeExpired, LeaseEventCodeRenewalFailed)
+
+	// Back online
+	clock.Advance(time.Minute)
+	expect(LeaseEventCodeRenewed)
+
+	cancel()
+
+	select {
+	case <-lease.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Should stop the lease on cancellation")
+	}
+
+	// Restarts offline using the persisted file
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := leased.Requests()
+
+	restarted, err := startLease(ctx, opts, l.leaseSource(""), clock)
+	if err != nil {
+		t.Fatalf("Should not fail restarting lease: err=%v", err)
+	}
+
+	switch {
+	case leased.Requests() != requests:
+		t.Fatalf("Should not check out a license file: requests=%d", leased.Requests()-requests)
+	case restarted.File().(*LicenseFile).Certificate != lease.File().(*LicenseFile).Certificate:
+		t.Fatalf("Should use the persisted license file")
+	}
+
+	// Fails to start offline without a persisted file
+	leased.FailNext(1, http.StatusServiceUnavailable)
+
+	if _, err := startLease(ctx, LeaseOptions{Path: t.TempDir() + "/license.lic"}, l.leaseSource(""), clock); err == nil {
+		t.Fatalf("Should fail starting lease without a license file")
+	}
+}
+
+func TestMachineLease(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	license := srv.AddLicense(keygentest.License{})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+	})
+
+	l, err := client.Validate(ctx)
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	machine, err := l.Activate(ctx, uuid.NewString())
+	if err != nil {
+		t.Fatalf("Should not fail activation: err=%v", err)
+	}
+
+	path := t.TempDir() + "/machine.lic"
+
+	lease, err := machine.Lease(ctx, LeaseOptions{Path: path})
+	if err != nil {
+		t.Fatalf("Should not fail starting lease: err=%v", err)
+	}
+
+	mic, ok := lease.File().(*MachineFile)
+	if !ok {
+		t.Fatalf("Should lease a machine file: file=%T", lease.File())
+	}
+
+	if dataset, err := mic.Decrypt(license.Key + machine.Fingerprint); err != nil || dataset.Machine.ID != machine.ID {
+		t.Fatalf("Should decrypt the leased machine file: err=%v", err)
+	}
+
+	if _, err := LoadMachineFile(path); err != nil {
+		t.Fatalf("Should persist the machine file: err=%v", err)
+	}
+
+	cancel()
+
+	select {
+	case <-lease.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Should stop the lease on cancellation")
+	}
+}
+
+func TestTrustedClock(t *testing.T) {
+	drift := MaxClockDrift
+	t.Cleanup(func() { MaxClockDrift = drift })
+
+	MaxClockDrift = 5 * time.Minute
+
+	path := t.TempDir() + "/clock"
+
+	clock, err := NewTrustedClock(path)
+	if err != nil {
+		t.Fatalf("Should not fail creating trusted clock: err=%v", err)
+	}
+
+	if mark := clock.HighWaterMark(); !mark.IsZero() {
+		t.Fatalf("Should not have a high-water mark: mark=%v", mark)
+	}
+
+	license := srv.AddLicense(keygentest.License{})
+	client := NewClientWithOptions(&ClientOptions{
+		Account:    srv.Account,
+		Product:    srv.Product,
+		PublicKey:  srv.PublicKey,
+		LicenseKey: license.Key,
+		APIURL:     srv.URL,
+		Clock:      clock,
+	})
+
+	// Records the date of verified responses
+	l, err := client.Validate(context.Background())
+	if err != nil {
+		t.Fatalf("Should be valid: err=%v", err)
+	}
+
+	if mark := clock.HighWaterMark(); time.Since(mark) > time.Minute {
+		t.Fatalf("Should record the response date: mark=%v", mark)
+	}
+
+	lic, err := l.Checkout(context.Background(), CheckoutTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("Should not fail checkout: err=%v", err)
+	}
+
+	if _, err := lic.Decrypt(license.Key); err != nil {
+		t.Fatalf("Should not be expired: err=%v", err)
+	}
+
+	// Turning the clock back, i.e. the high-water mark is in the future
+	if err := clock.Observe(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("Should not fail observing time: err=%v", err)
+	}
+
+	if _, err := clock.Now(); err != ErrSystemClockUnsynced {
+		t.Fatalf("Should detect the clock was turned back: err=%v", err)
+	}
+
+	if _, err := lic.Decrypt(license.Key); err != ErrSystemClockUnsynced {
+		t.Fatalf("Should detect the clock was turned back: err=%v", err)
+	}
+
+	MaxClockDrift = -1
+
+	if _, err := lic.Decrypt(license.Key); err != ErrLicenseFileExpired {
+		t.Fatalf("Should be expired using the high-water mark: err=%v", err)
+	}
+
+	// Persists the high-water mark
+	restored, err := NewTrustedClock(path)
+	if err != nil {
+		t.Fatalf("Should not fail restoring trusted clock: err=%v", err)
+	}
+
+	if !restored.HighWaterMark().Equal(clock.HighWaterMark()) {
+		t.Fatalf("Should restore the high-water mark: actual=%v expected=%v", restored.HighWaterMark(), clock.HighWaterMark())
+	}
+
+	// Records the issued timestamp of verified files
+	fresh, err := NewTrustedClock("")
+	if err != nil {
+		t.Fatalf("Should not fail creating trusted clock: err=%v", err)
+	}
+
+	lic.client = NewClientWithOptions(&ClientOptions{PublicKey: srv.PublicKey, Clock: fresh})
+
+	dataset, err := lic.Decrypt(license.Key)
+	if err != nil {
+		t.Fatalf("Should not be expired: err=%v", err)
+	}
+
+	if mark := fresh.HighWaterMark(); !mark.Equal(dataset.Issued) {
+		t.Fatalf("Should record the issued timestamp: mark=%v issued=%v", mark, dataset.Issued)
+	}
+}
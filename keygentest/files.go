@@ -0,0 +1,298 @@
+package keygentest
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// CheckoutOptions stores options used when minting a license file or a
+// machine file.
+type CheckoutOptions struct {
+	// Encrypt encrypts the file's dataset, using the license key (and the
+	// machine fingerprint, for a machine file) as the secret.
+	Encrypt bool
+
+	// TTL is the file's time-to-live. A zero TTL mints a file that never
+	// expires.
+	TTL time.Duration
+
+	// Include are the relationships to include in the file's dataset, e.g.
+	// entitlements and policy for a license file, or license, license.policy
+	// and components for a machine file.
+	Include []string
+}
+
+type file struct {
+	certificate string
+	issued      time.Time
+	expiry      *time.Time
+	ttl         *int
+}
+
+// LicenseFile mints a license file certificate for a license, as if it had
+// been checked out, e.g. to test a license file that never expires.
+func (s *Server) LicenseFile(id string, opts CheckoutOptions) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	license, ok := s.licenses[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	file, err := s.licenseFile(license, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return file.certificate, nil
+}
+
+// MachineFile mints a machine file certificate for a machine, as if it had
+// been checked out.
+func (s *Server) MachineFile(id string, opts CheckoutOptions) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	machine, ok := s.machines[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	file, err := s.machineFile(machine, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return file.certificate, nil
+}
+
+func (s *Server) licenseFile(license *License, opts CheckoutOptions) (*file, error) {
+	included := []interface{}{}
+
+	for _, include := range opts.Include {
+		switch include {
+		case "entitlements":
+			for _, code := range license.Entitlements {
+				included = append(included, s.entitlementObject(s.entitlement(code)))
+			}
+		case "machines":
+			for _, machine := range s.licenseMachines(license.ID) {
+				included = append(included, s.machineObject(machine))
+			}
+		default:
+			if object := s.licenseRelationship(license, include); object != nil {
+				included = append(included, object)
+			}
+		}
+	}
+
+	return s.certify("LICENSE", license.Scheme, s.licenseObject(license), included, license.Key, opts)
+}
+
+func (s *Server) machineFile(machine *Machine, opts CheckoutOptions) (*file, error) {
+	license := s.licenses[machine.LicenseID]
+	included := []interface{}{}
+
+	for _, include := range opts.Include {
+		switch include {
+		case "license":
+			included = append(included, s.licenseObject(license))
+		case "license.entitlements":
+			for _, code := range license.Entitlements {
+				included = append(included, s.entitlementObject(s.entitlement(code)))
+			}
+		case "license.machines":
+			for _, machine := range s.licenseMachines(license.ID) {
+				included = append(included, s.machineObject(machine))
+			}
+		case "components":
+			for _, component := range s.machineComponents(machine.ID) {
+				included = append(included, s.componentObject(component))
+			}
+		default:
+			if strings.HasPrefix(include, "license.") {
+				if object := s.licenseRelationship(license, strings.TrimPrefix(include, "license.")); object != nil {
+					included = append(included, object)
+				}
+			}
+		}
+	}
+
+	return s.certify("MACHINE", license.Scheme, s.machineObject(machine), included, license.Key+machine.Fingerprint, opts)
+}
+
+// licenseRelationship returns the license's related object for an include,
+// e.g. its policy, or nil when the license has no such relationship.
+func (s *Server) licenseRelationship(license *License, include string) map[string]interface{} {
+	switch {
+	case include == "policy":
+		return s.policyObject(license)
+	case include == "product":
+		return s.productObject(license)
+	case (include == "owner" || include == "user") && license.UserID != "":
+		return s.userObject(license)
+	case include == "group" && license.GroupID != "":
+		return s.groupObject(license)
+	default:
+		return nil
+	}
+}
+
+// certify signs, and optionally encrypts, the dataset into a certificate
+// using the same format as the real API. Like the real API, the signing
+// algorithm depends on the license's scheme.
+func (s *Server) certify(kind string, scheme string, data map[string]interface{}, included []interface{}, secret string, opts CheckoutOptions) (*file, error) {
+	issued := s.now().UTC().Truncate(time.Second)
+	f := &file{issued: issued}
+
+	if opts.TTL > 0 {
+		expiry := issued.Add(opts.TTL)
+		ttl := int(opts.TTL.Seconds())
+
+		f.expiry = &expiry
+		f.ttl = &ttl
+	}
+
+	dataset, err := json.Marshal(map[string]interface{}{
+		"data":     data,
+		"included": included,
+		"meta":     map[string]interface{}{"issued": f.issued, "expiry": f.expiry, "ttl": f.ttl},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var enc, alg string
+
+	if opts.Encrypt {
+		enc, err = encrypt(dataset, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		alg = "aes-256-gcm"
+	} else {
+		enc = base64.StdEncoding.EncodeToString(dataset)
+		alg = "base64"
+	}
+
+	var sig []byte
+
+	msg := []byte(strings.ToLower(kind) + "/" + enc)
+	digest := sha256.Sum256(msg)
+
+	switch scheme {
+	case "RSA_2048_PKCS1_PSS_SIGN_V2":
+		alg += "+rsa-pss-sha256"
+		sig, err = rsa.SignPSS(rand.Reader, s.rsaKey, crypto.SHA256, digest[:], nil)
+	case "RSA_2048_PKCS1_SIGN_V2", "RSA_2048_PKCS1_ENCRYPT":
+		alg += "+rsa-sha256"
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:])
+	default:
+		alg += "+ed25519"
+		sig = ed25519.Sign(s.privateKey, msg)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := json.Marshal(map[string]string{
+		"enc": enc,
+		"sig": base64.StdEncoding.EncodeToString(sig),
+		"alg": alg,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Wrap the encoded certificate like the real API does
+	encoded := base64.StdEncoding.EncodeToString(cert)
+	lines := []string{"-----BEGIN " + kind + " FILE-----"}
+
+	for len(encoded) > 60 {
+		lines = append(lines, encoded[:60])
+		encoded = encoded[60:]
+	}
+
+	lines = append(lines, encoded, "-----END "+kind+" FILE-----")
+	f.certificate = strings.Join(lines, "\n") + "\n"
+
+	return f, nil
+}
+
+// encrypt encrypts the plaintext with AES-256-GCM, keyed with the SHA256
+// digest of the secret. It returns the ciphertext, IV and tag, base64 encoded
+// and joined by a period.
+func encrypt(plaintext []byte, secret string) (string, error) {
+	key := sha256.Sum256([]byte(secret))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nil, iv, plaintext, nil)
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		base64.StdEncoding.EncodeToString(ciphertext),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// signKey signs the dataset into a license key using the scheme, i.e.
+// key/{dataset}.{signature}, or encrypts it using the private key for the
+// RSA_2048_PKCS1_ENCRYPT scheme.
+func (s *Server) signKey(scheme string, dataset string) (string, error) {
+	enc := base64.URLEncoding.EncodeToString([]byte(dataset))
+	msg := []byte("key/" + enc)
+	digest := sha256.Sum256(msg)
+
+	var sig []byte
+	var err error
+
+	switch scheme {
+	case "RSA_2048_PKCS1_ENCRYPT":
+		// Encrypting with the private key is an unhashed PKCS1 v1.5 signature
+		ciphertext, err := rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.Hash(0), []byte(dataset))
+		if err != nil {
+			return "", err
+		}
+
+		return base64.URLEncoding.EncodeToString(ciphertext), nil
+	case "RSA_2048_PKCS1_PSS_SIGN_V2":
+		sig, err = rsa.SignPSS(rand.Reader, s.rsaKey, crypto.SHA256, digest[:], nil)
+	case "RSA_2048_PKCS1_SIGN_V2":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:])
+	default:
+		sig = ed25519.Sign(s.privateKey, msg)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return "key/" + enc + "." + base64.URLEncoding.EncodeToString(sig), nil
+}
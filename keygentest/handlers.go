@@ -0,0 +1,922 @@
+package keygentest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type identifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type validationParams struct {
+	Meta struct {
+		Key   string                 `json:"key,omitempty"`
+		Nonce interface{}            `json:"nonce,omitempty"`
+		Scope map[string]interface{} `json:"scope,omitempty"`
+	} `json:"meta"`
+}
+
+type machineParams struct {
+	Data struct {
+		Attributes struct {
+			Fingerprint string                 `json:"fingerprint"`
+			Name        string                 `json:"name"`
+			Hostname    string                 `json:"hostname"`
+			Platform    string                 `json:"platform"`
+			IP          string                 `json:"ip"`
+			Cores       int                    `json:"cores"`
+			Metadata    map[string]interface{} `json:"metadata"`
+		} `json:"attributes"`
+		Relationships struct {
+			License struct {
+				Data identifier `json:"data"`
+			} `json:"license"`
+			Components struct {
+				Data []struct {
+					Attributes struct {
+						Fingerprint string                 `json:"fingerprint"`
+						Name        string                 `json:"name"`
+						Metadata    map[string]interface{} `json:"metadata"`
+					} `json:"attributes"`
+				} `json:"data"`
+			} `json:"components"`
+		} `json:"relationships"`
+	} `json:"data"`
+}
+
+type machineUpdateParams struct {
+	Data struct {
+		Attributes struct {
+			Name     *string                 `json:"name"`
+			Metadata *map[string]interface{} `json:"metadata"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+type componentParams struct {
+	Data struct {
+		Attributes struct {
+			Fingerprint string                 `json:"fingerprint"`
+			Name        string                 `json:"name"`
+			Metadata    map[string]interface{} `json:"metadata"`
+		} `json:"attributes"`
+		Relationships struct {
+			Machine struct {
+				Data identifier `json:"data"`
+			} `json:"machine"`
+		} `json:"relationships"`
+	} `json:"data"`
+}
+
+type processParams struct {
+	Data struct {
+		Attributes struct {
+			Pid      string                 `json:"pid"`
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"attributes"`
+		Relationships struct {
+			Machine struct {
+				Data identifier `json:"data"`
+			} `json:"machine"`
+		} `json:"relationships"`
+	} `json:"data"`
+}
+
+func (s *Server) getLicense(license *License, id string) *response {
+	if !matches(license, id) {
+		return notFound()
+	}
+
+	return document(http.StatusOK, map[string]interface{}{"data": s.licenseObject(license)})
+}
+
+func (s *Server) validateLicense(r *http.Request, license *License, id string) *response {
+	if !matches(license, id) {
+		return notFound()
+	}
+
+	params, res := decodeValidation(r)
+	if res != nil {
+		return res
+	}
+
+	valid, detail, code := s.validate(license, params.Meta.Scope)
+	now := s.now()
+
+	license.LastValidated = &now
+
+	return document(http.StatusOK, map[string]interface{}{
+		"data": s.licenseObject(license),
+		"meta": validationMeta(params, now, valid, detail, code),
+	})
+}
+
+// validateKey validates a license by its key. Like the real API, it doesn't
+// require authentication, and an unknown key is not a 404.
+func (s *Server) validateKey(r *http.Request) *response {
+	params, res := decodeValidation(r)
+	if res != nil {
+		return res
+	}
+
+	now := s.now()
+
+	var license *License
+	for _, l := range s.licenses {
+		if params.Meta.Key != "" && l.Key == params.Meta.Key {
+			license = l
+		}
+	}
+
+	if license == nil {
+		return document(http.StatusOK, map[string]interface{}{
+			"data": nil,
+			"meta": validationMeta(params, now, false, "does not exist", "NOT_FOUND"),
+		})
+	}
+
+	valid, detail, code := s.validate(license, params.Meta.Scope)
+
+	license.LastValidated = &now
+
+	return document(http.StatusOK, map[string]interface{}{
+		"data": s.licenseObject(license),
+		"meta": validationMeta(params, now, valid, detail, code),
+	})
+}
+
+func decodeValidation(r *http.Request) (validationParams, *response) {
+	params := validationParams{}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return params, errorResponse(http.StatusBadRequest, "", "Bad request", err.Error(), "")
+	}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &params); err != nil {
+			return params, errorResponse(http.StatusBadRequest, "", "Bad request", "The request data was invalid: "+err.Error(), "")
+		}
+	}
+
+	return params, nil
+}
+
+// validationMeta returns the validation result, echoing the scope and nonce.
+func validationMeta(params validationParams, now time.Time, valid bool, detail string, code string) map[string]interface{} {
+	meta := map[string]interface{}{"ts": now, "valid": valid, "detail": detail, "code": code}
+	if params.Meta.Scope != nil {
+		meta["scope"] = params.Meta.Scope
+	}
+
+	if params.Meta.Nonce != nil {
+		meta["nonce"] = params.Meta.Nonce
+	}
+
+	return meta
+}
+
+// validate validates the license against the scope, in roughly the same
+// order as the real API. It returns the validity, detail and code.
+func (s *Server) validate(license *License, scope map[string]interface{}) (bool, string, string) {
+	machines := s.licenseMachines(license.ID)
+
+	switch {
+	case license.Suspended:
+		return false, "is suspended", "SUSPENDED"
+	case license.Expiry != nil && license.Expiry.Before(s.now()):
+		return false, "is expired", "EXPIRED"
+	}
+
+	if product, ok := scope["product"].(string); ok && product != "" && product != license.ProductID {
+		return false, "product scope does not match", "PRODUCT_SCOPE_MISMATCH"
+	}
+
+	if policy, ok := scope["policy"].(string); ok && policy != license.PolicyID {
+		return false, "policy scope does not match", "POLICY_SCOPE_MISMATCH"
+	}
+
+	if codes, ok := stringSlice(scope["entitlements"]); ok {
+		if len(codes) == 0 {
+			return false, "entitlements scope is empty", "ENTITLEMENTS_SCOPE_EMPTY"
+		}
+
+		for _, code := range codes {
+			if !contains(license.Entitlements, code) {
+				return false, "is missing one or more required entitlements", "ENTITLEMENTS_MISSING"
+			}
+		}
+	}
+
+	if user, ok := scope["user"].(string); ok && user != license.UserID {
+		return false, "user scope does not match", "USER_SCOPE_MISMATCH"
+	}
+
+	if sum, ok := scope["checksum"].(string); ok && !s.hasChecksum(license, sum) {
+		return false, "checksum scope does not match", "CHECKSUM_SCOPE_MISMATCH"
+	}
+
+	var machine *Machine
+
+	if id, ok := scope["machine"].(string); ok {
+		for _, m := range machines {
+			if m.ID == id {
+				machine = m
+			}
+		}
+
+		if machine == nil {
+			return false, "machine scope does not match", "MACHINE_SCOPE_MISMATCH"
+		}
+	}
+
+	fingerprint, ok := scope["fingerprint"].(string)
+
+	switch {
+	case ok && fingerprint != "":
+		if len(machines) == 0 {
+			if license.MaxMachines == 1 {
+				return false, "fingerprint is not activated (has no associated machine)", "NO_MACHINE"
+			}
+
+			return false, "fingerprint is not activated (has no associated machines)", "NO_MACHINES"
+		}
+
+		machine = nil
+		for _, m := range machines {
+			if m.Fingerprint == fingerprint {
+				machine = m
+			}
+		}
+
+		if machine == nil {
+			return false, "fingerprint is not activated (does not match any associated machines)", "FINGERPRINT_SCOPE_MISMATCH"
+		}
+	case license.RequireFingerprintScope:
+		return false, "fingerprint scope is required", "FINGERPRINT_SCOPE_REQUIRED"
+	case machine == nil && license.MaxMachines > 0 && len(machines) == 0:
+		if license.MaxMachines == 1 {
+			return false, "must have exactly 1 associated machine", "NO_MACHINE"
+		}
+
+		return false, "must have at least 1 associated machine", "NO_MACHINES"
+	}
+
+	if fingerprints, ok := stringSlice(scope["components"]); ok {
+		if machine == nil {
+			return false, "fingerprint scope is required", "FINGERPRINT_SCOPE_REQUIRED"
+		}
+
+		if len(fingerprints) == 0 {
+			return false, "components scope is empty", "COMPONENTS_SCOPE_EMPTY"
+		}
+
+		matched := 0
+		for _, component := range s.machineComponents(machine.ID) {
+			if contains(fingerprints, component.Fingerprint) {
+				matched++
+			}
+		}
+
+		var ok bool
+
+		switch license.ComponentMatchingStrategy {
+		case "MATCH_ALL":
+			ok = matched == len(fingerprints)
+		case "MATCH_MOST":
+			ok = matched >= (len(fingerprints)+1)/2
+		case "MATCH_TWO":
+			ok = matched >= 2
+		default: // MATCH_ANY
+			ok = matched >= 1
+		}
+
+		if !ok {
+			return false, "one or more component is not activated (does not match any associated components)", "COMPONENTS_SCOPE_MISMATCH"
+		}
+	}
+
+	if machine != nil {
+		switch s.heartbeatStatus(license, machine.Created, machine.LastHeartbeat, machine.dead) {
+		case "DEAD":
+			return false, "machine heartbeat is dead", "HEARTBEAT_DEAD"
+		case "NOT_STARTED":
+			if license.RequireHeartbeat && license.HeartbeatBasis == "FROM_FIRST_PING" {
+				return false, "machine heartbeat is required", "HEARTBEAT_NOT_STARTED"
+			}
+		}
+
+		if license.MaxProcesses > 0 && len(s.machineProcesses(machine.ID)) > license.MaxProcesses {
+			return false, "has too many associated processes", "TOO_MANY_PROCESSES"
+		}
+	}
+
+	if license.MaxMachines > 0 && len(machines) > license.MaxMachines {
+		return false, "has too many associated machines", "TOO_MANY_MACHINES"
+	}
+
+	if license.MaxCores > 0 && cores(machines) > license.MaxCores {
+		return false, "has too many associated machine cores", "TOO_MANY_CORES"
+	}
+
+	return true, "is valid", "VALID"
+}
+
+func (s *Server) checkoutLicense(r *http.Request, license *License, id string) *response {
+	if !matches(license, id) {
+		return notFound()
+	}
+
+	if res := authorize(license, s.now()); res != nil {
+		return res
+	}
+
+	opts, res := checkoutOptions(r)
+	if res != nil {
+		return res
+	}
+
+	file, err := s.licenseFile(license, opts)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "", "Internal server error", err.Error(), "")
+	}
+
+	return document(http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":   uuid.NewString(),
+			"type": "license-files",
+			"attributes": map[string]interface{}{
+				"certificate": file.certificate,
+				"issued":      file.issued,
+				"expiry":      file.expiry,
+				"ttl":         file.ttl,
+			},
+			"relationships": map[string]interface{}{
+				"account": relationship("accounts", s.Account),
+				"license": relationship("licenses", license.ID),
+			},
+		},
+	})
+}
+
+func (s *Server) listMachines(r *http.Request, license *License, id string) *response {
+	if !matches(license, id) {
+		return notFound()
+	}
+
+	objects := []map[string]interface{}{}
+	for _, machine := range s.licenseMachines(license.ID) {
+		objects = append(objects, s.machineObject(machine))
+	}
+
+	return paginate(r, objects)
+}
+
+func (s *Server) listEntitlements(r *http.Request, license *License, id string) *response {
+	if !matches(license, id) {
+		return notFound()
+	}
+
+	objects := []map[string]interface{}{}
+	for _, code := range license.Entitlements {
+		objects = append(objects, s.entitlementObject(s.entitlement(code)))
+	}
+
+	return paginate(r, objects)
+}
+
+func (s *Server) activateMachine(r *http.Request, license *License) *response {
+	params := machineParams{}
+	if res := decode(r, &params); res != nil {
+		return res
+	}
+
+	if !matches(license, params.Data.Relationships.License.Data.ID) {
+		return unprocessable("LICENSE_NOT_FOUND", "must exist", "/data/relationships/license")
+	}
+
+	if res := authorize(license, s.now()); res != nil {
+		return res
+	}
+
+	attrs := params.Data.Attributes
+	if attrs.Fingerprint == "" {
+		return unprocessable("FINGERPRINT_BLANK", "can't be blank", "/data/attributes/fingerprint")
+	}
+
+	machines := s.licenseMachines(license.ID)
+
+	for _, machine := range machines {
+		if machine.Fingerprint == attrs.Fingerprint {
+			return unprocessable("FINGERPRINT_TAKEN", "has already been taken", "/data/attributes/fingerprint")
+		}
+	}
+
+	if license.MaxMachines > 0 && len(machines) >= license.MaxMachines {
+		return unprocessable("MACHINE_LIMIT_EXCEEDED", fmt.Sprintf("machine count has exceeded maximum allowed for license (%d)", license.MaxMachines), "/data")
+	}
+
+	if license.MaxCores > 0 && cores(machines)+attrs.Cores > license.MaxCores {
+		return unprocessable("MACHINE_CORE_LIMIT_EXCEEDED", fmt.Sprintf("machine core count has exceeded maximum allowed for license (%d)", license.MaxCores), "/data")
+	}
+
+	fingerprints := []string{}
+	for _, component := range params.Data.Relationships.Components.Data {
+		fingerprint := component.Attributes.Fingerprint
+		if contains(fingerprints, fingerprint) {
+			return unprocessable("COMPONENTS_FINGERPRINT_CONFLICT", "has already been taken", "/data/relationships/components")
+		}
+
+		for _, machine := range machines {
+			for _, c := range s.machineComponents(machine.ID) {
+				if c.Fingerprint == fingerprint {
+					return unprocessable("COMPONENTS_FINGERPRINT_TAKEN", "has already been taken", "/data/relationships/components")
+				}
+			}
+		}
+
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	now := s.now()
+	machine := &Machine{
+		ID:          uuid.NewString(),
+		Fingerprint: attrs.Fingerprint,
+		Name:        attrs.Name,
+		Hostname:    attrs.Hostname,
+		Platform:    attrs.Platform,
+		IP:          attrs.IP,
+		Cores:       attrs.Cores,
+		Metadata:    attrs.Metadata,
+		LicenseID:   license.ID,
+		Created:     now,
+		Updated:     now,
+	}
+
+	s.machines[machine.ID] = machine
+	s.track(machine.ID)
+
+	for _, c := range params.Data.Relationships.Components.Data {
+		component := &Component{
+			ID:          uuid.NewString(),
+			Fingerprint: c.Attributes.Fingerprint,
+			Name:        c.Attributes.Name,
+			Metadata:    c.Attributes.Metadata,
+			MachineID:   machine.ID,
+			Created:     now,
+			Updated:     now,
+		}
+
+		s.components[component.ID] = component
+		s.track(component.ID)
+	}
+
+	return document(http.StatusCreated, map[string]interface{}{"data": s.machineObject(machine)})
+}
+
+func (s *Server) getMachine(license *License, id string) *response {
+	machine := s.findMachine(license, id)
+	if machine == nil {
+		return notFound()
+	}
+
+	return document(http.StatusOK, map[string]interface{}{"data": s.machineObject(machine)})
+}
+
+func (s *Server) updateMachine(r *http.Request, license *License, id string) *response {
+	machine := s.findMachine(license, id)
+	if machine == nil {
+		return notFound()
+	}
+
+	params := machineUpdateParams{}
+	if res := decode(r, &params); res != nil {
+		return res
+	}
+
+	// Only the provided attributes are updated
+	attrs := params.Data.Attributes
+	if attrs.Name != nil {
+		machine.Name = *attrs.Name
+	}
+
+	if attrs.Metadata != nil {
+		machine.Metadata = *attrs.Metadata
+	}
+
+	machine.Updated = s.now()
+
+	return document(http.StatusOK, map[string]interface{}{"data": s.machineObject(machine)})
+}
+
+func (s *Server) deactivateMachine(license *License, id string) *response {
+	machine := s.findMachine(license, id)
+	if machine == nil {
+		return notFound()
+	}
+
+	for _, component := range s.machineComponents(machine.ID) {
+		delete(s.components, component.ID)
+	}
+
+	for _, process := range s.machineProcesses(machine.ID) {
+		delete(s.processes, process.ID)
+	}
+
+	delete(s.machines, machine.ID)
+
+	return &response{status: http.StatusNoContent}
+}
+
+func (s *Server) pingMachine(license *License, id string) *response {
+	machine := s.findMachine(license, id)
+	if machine == nil {
+		return notFound()
+	}
+
+	dead := s.heartbeatStatus(license, machine.Created, machine.LastHeartbeat, machine.dead) == "DEAD"
+	if dead && !license.resurrectable() {
+		return unprocessable("MACHINE_HEARTBEAT_DEAD", "is dead", "/data/attributes/heartbeatStatus")
+	}
+
+	now := s.now()
+	machine.LastHeartbeat = &now
+	machine.dead = false
+
+	obj := s.machineObject(machine)
+	if dead {
+		obj["attributes"].(map[string]interface{})["heartbeatStatus"] = "RESURRECTED"
+	}
+
+	return document(http.StatusOK, map[string]interface{}{"data": obj})
+}
+
+func (s *Server) checkoutMachine(r *http.Request, license *License, id string) *response {
+	machine := s.findMachine(license, id)
+	if machine == nil {
+		return notFound()
+	}
+
+	if res := authorize(license, s.now()); res != nil {
+		return res
+	}
+
+	opts, res := checkoutOptions(r)
+	if res != nil {
+		return res
+	}
+
+	file, err := s.machineFile(machine, opts)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, "", "Internal server error", err.Error(), "")
+	}
+
+	return document(http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":   uuid.NewString(),
+			"type": "machine-files",
+			"attributes": map[string]interface{}{
+				"certificate": file.certificate,
+				"issued":      file.issued,
+				"expiry":      file.expiry,
+				"ttl":         file.ttl,
+			},
+			"relationships": map[string]interface{}{
+				"account": relationship("accounts", s.Account),
+				"machine": relationship("machines", machine.ID),
+				"license": relationship("licenses", license.ID),
+			},
+		},
+	})
+}
+
+func (s *Server) listComponents(r *http.Request, license *License, id string) *response {
+	machine := s.findMachine(license, id)
+	if machine == nil {
+		return notFound()
+	}
+
+	objects := []map[string]interface{}{}
+	for _, component := range s.machineComponents(machine.ID) {
+		objects = append(objects, s.componentObject(component))
+	}
+
+	return paginate(r, objects)
+}
+
+func (s *Server) addComponent(r *http.Request, license *License) *response {
+	params := componentParams{}
+	if res := decode(r, &params); res != nil {
+		return res
+	}
+
+	machine := s.findMachine(license, params.Data.Relationships.Machine.Data.ID)
+	if machine == nil {
+		return unprocessable("MACHINE_NOT_FOUND", "must exist", "/data/relationships/machine")
+	}
+
+	if res := authorize(license, s.now()); res != nil {
+		return res
+	}
+
+	attrs := params.Data.Attributes
+	if attrs.Fingerprint == "" {
+		return unprocessable("FINGERPRINT_BLANK", "can't be blank", "/data/attributes/fingerprint")
+	}
+
+	// Like activations, a fingerprint is unique across the license's machines
+	for _, m := range s.licenseMachines(license.ID) {
+		for _, c := range s.machineComponents(m.ID) {
+			if c.Fingerprint == attrs.Fingerprint {
+				return unprocessable("FINGERPRINT_TAKEN", "has already been taken", "/data/attributes/fingerprint")
+			}
+		}
+	}
+
+	now := s.now()
+	component := &Component{
+		ID:          uuid.NewString(),
+		Fingerprint: attrs.Fingerprint,
+		Name:        attrs.Name,
+		Metadata:    attrs.Metadata,
+		MachineID:   machine.ID,
+		Created:     now,
+		Updated:     now,
+	}
+
+	s.components[component.ID] = component
+	s.track(component.ID)
+
+	return document(http.StatusCreated, map[string]interface{}{"data": s.componentObject(component)})
+}
+
+func (s *Server) removeComponent(license *License, id string) *response {
+	component, ok := s.components[id]
+	if !ok || s.findMachine(license, component.MachineID) == nil {
+		return notFound()
+	}
+
+	delete(s.components, component.ID)
+
+	return &response{status: http.StatusNoContent}
+}
+
+func (s *Server) listProcesses(r *http.Request, license *License, id string) *response {
+	machine := s.findMachine(license, id)
+	if machine == nil {
+		return notFound()
+	}
+
+	objects := []map[string]interface{}{}
+	for _, process := range s.machineProcesses(machine.ID) {
+		objects = append(objects, s.processObject(process))
+	}
+
+	return paginate(r, objects)
+}
+
+func (s *Server) spawnProcess(r *http.Request, license *License) *response {
+	params := processParams{}
+	if res := decode(r, &params); res != nil {
+		return res
+	}
+
+	machine := s.findMachine(license, params.Data.Relationships.Machine.Data.ID)
+	if machine == nil {
+		return unprocessable("MACHINE_NOT_FOUND", "must exist", "/data/relationships/machine")
+	}
+
+	if res := authorize(license, s.now()); res != nil {
+		return res
+	}
+
+	attrs := params.Data.Attributes
+	if attrs.Pid == "" {
+		return unprocessable("PID_BLANK", "can't be blank", "/data/attributes/pid")
+	}
+
+	processes := s.machineProcesses(machine.ID)
+
+	for _, process := range processes {
+		if process.Pid == attrs.Pid {
+			return unprocessable("PID_TAKEN", "has already been taken", "/data/attributes/pid")
+		}
+	}
+
+	if license.MaxProcesses > 0 && len(processes) >= license.MaxProcesses {
+		return unprocessable("MACHINE_PROCESS_LIMIT_EXCEEDED", fmt.Sprintf("process count has exceeded maximum allowed by policy (%d)", license.MaxProcesses), "/data")
+	}
+
+	now := s.now()
+	process := &Process{
+		ID:            uuid.NewString(),
+		Pid:           attrs.Pid,
+		Metadata:      attrs.Metadata,
+		MachineID:     machine.ID,
+		LastHeartbeat: &now,
+		Created:       now,
+		Updated:       now,
+	}
+
+	s.processes[process.ID] = process
+	s.track(process.ID)
+
+	return document(http.StatusCreated, map[string]interface{}{"data": s.processObject(process)})
+}
+
+func (s *Server) killProcess(license *License, id string) *response {
+	process := s.findProcess(license, id)
+	if process == nil {
+		return notFound()
+	}
+
+	delete(s.processes, process.ID)
+
+	return &response{status: http.StatusNoContent}
+}
+
+func (s *Server) pingProcess(license *License, id string) *response {
+	process := s.findProcess(license, id)
+	if process == nil {
+		return notFound()
+	}
+
+	if s.heartbeatStatus(license, process.Created, process.LastHeartbeat, process.dead) == "DEAD" {
+		return unprocessable("PROCESS_HEARTBEAT_DEAD", "is dead", "/data/attributes/status")
+	}
+
+	now := s.now()
+	process.LastHeartbeat = &now
+
+	return document(http.StatusOK, map[string]interface{}{"data": s.processObject(process)})
+}
+
+// authorize checks that the license can be used for e.g. an activation.
+func authorize(license *License, now time.Time) *response {
+	switch {
+	case license.Suspended:
+		return forbidden("LICENSE_SUSPENDED", "is suspended")
+	case license.Expiry != nil && license.Expiry.Before(now):
+		return forbidden("LICENSE_EXPIRED", "is expired")
+	default:
+		return nil
+	}
+}
+
+// checkoutOptions parses the check-out query parameters. Like the real API,
+// the TTL defaults to 1 month.
+func checkoutOptions(r *http.Request) (CheckoutOptions, *response) {
+	query := r.URL.Query()
+	opts := CheckoutOptions{
+		Encrypt: query.Get("encrypt") == "true" || query.Get("encrypt") == "1",
+		TTL:     2629746 * time.Second,
+	}
+
+	if ttl := query.Get("ttl"); ttl != "" {
+		i, err := strconv.Atoi(ttl)
+		if err != nil || i < 3600 {
+			return opts, errorResponse(http.StatusBadRequest, "CHECKOUT_TTL_INVALID", "Bad request", "must be greater than or equal to 3600 (1 hour)", "")
+		}
+
+		opts.TTL = time.Duration(i) * time.Second
+	}
+
+	if include := query.Get("include"); include != "" {
+		opts.Include = strings.Split(include, ",")
+	}
+
+	return opts, nil
+}
+
+func (s *Server) findMachine(license *License, id string) *Machine {
+	for _, machine := range s.licenseMachines(license.ID) {
+		if machine.ID == id || machine.Fingerprint == id {
+			return machine
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) findProcess(license *License, id string) *Process {
+	process, ok := s.processes[id]
+	if !ok {
+		return nil
+	}
+
+	if machine, ok := s.machines[process.MachineID]; !ok || machine.LicenseID != license.ID {
+		return nil
+	}
+
+	return process
+}
+
+func (s *Server) licenseMachines(licenseID string) []*Machine {
+	ids := []string{}
+	for id, machine := range s.machines {
+		if machine.LicenseID == licenseID {
+			ids = append(ids, id)
+		}
+	}
+
+	machines := []*Machine{}
+	for _, id := range s.sorted(ids) {
+		machines = append(machines, s.machines[id])
+	}
+
+	return machines
+}
+
+func (s *Server) machineComponents(machineID string) []*Component {
+	ids := []string{}
+	for id, component := range s.components {
+		if component.MachineID == machineID {
+			ids = append(ids, id)
+		}
+	}
+
+	components := []*Component{}
+	for _, id := range s.sorted(ids) {
+		components = append(components, s.components[id])
+	}
+
+	return components
+}
+
+func (s *Server) machineProcesses(machineID string) []*Process {
+	ids := []string{}
+	for id, process := range s.processes {
+		if process.MachineID == machineID {
+			ids = append(ids, id)
+		}
+	}
+
+	processes := []*Process{}
+	for _, id := range s.sorted(ids) {
+		processes = append(processes, s.processes[id])
+	}
+
+	return processes
+}
+
+// entitlement returns the entitlement for a code, creating it if needed.
+func (s *Server) entitlement(code string) *entitlement {
+	if e, ok := s.entitlements[code]; ok {
+		return e
+	}
+
+	e := &entitlement{ID: uuid.NewString(), Code: code, Created: s.now()}
+	s.entitlements[code] = e
+
+	return e
+}
+
+// matches reports whether the ID refers to the license, by its ID or key.
+func matches(license *License, id string) bool {
+	return id != "" && (id == license.ID || id == license.Key)
+}
+
+func cores(machines []*Machine) int {
+	n := 0
+	for _, machine := range machines {
+		n += machine.Cores
+	}
+
+	return n
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stringSlice converts a JSON array of strings.
+func stringSlice(v interface{}) ([]string, bool) {
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	strs := []string{}
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+
+	return strs, true
+}
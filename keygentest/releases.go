@@ -0,0 +1,309 @@
+package keygentest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	voi "github.com/oasisprotocol/curve25519-voi/primitives/ed25519"
+)
+
+// channels are the release channels, in order of stability. A channel
+// includes releases from any more stable channel, e.g. beta includes rc.
+var channels = []string{"stable", "rc", "beta", "alpha", "dev"}
+
+func (s *Server) listReleases(r *http.Request, license *License) *response {
+	platform := r.URL.Query().Get("platform")
+	objects := []map[string]interface{}{}
+
+	for _, release := range s.licenseReleases(license) {
+		if platform != "" && !release.hasPlatform(platform) {
+			continue
+		}
+
+		objects = append(objects, s.releaseObject(release))
+	}
+
+	return paginate(r, objects)
+}
+
+// upgradeRelease returns the latest release that is newer than the version,
+// within the requested product, package, channel and constraint.
+func (s *Server) upgradeRelease(r *http.Request, license *License, version string) *response {
+	current, ok := parseVersion(version)
+	if !ok {
+		return notFound()
+	}
+
+	query := r.URL.Query()
+	product := query.Get("product")
+	pkg := query.Get("package")
+	channel := query.Get("channel")
+	if channel == "" {
+		channel = "stable"
+	}
+
+	var constraint *semver
+	if c := query.Get("constraint"); c != "" {
+		v, ok := parseVersion(c)
+		if !ok {
+			return errorResponse(http.StatusBadRequest, "CONSTRAINT_INVALID", "Bad request", "must be a valid version constraint", "")
+		}
+
+		constraint = &v
+	}
+
+	var upgrade *Release
+	var latest semver
+
+	for _, release := range s.licenseReleases(license) {
+		v, ok := parseVersion(release.Version)
+
+		switch {
+		case !ok:
+			continue
+		case product != "" && release.ProductID != product:
+			continue
+		case pkg != "" && release.PackageID != pkg:
+			continue
+		case channelIndex(release.Channel) > channelIndex(channel):
+			continue
+		case constraint != nil && (v.major != constraint.major || v.compare(*constraint) < 0):
+			continue
+		case v.compare(current) <= 0:
+			continue
+		case upgrade != nil && v.compare(latest) <= 0:
+			continue
+		}
+
+		upgrade = release
+		latest = v
+	}
+
+	if upgrade == nil {
+		return notFound()
+	}
+
+	return document(http.StatusOK, map[string]interface{}{"data": s.releaseObject(upgrade)})
+}
+
+// getArtifact redirects to the artifact's download URL, like the real API.
+func (s *Server) getArtifact(license *License, id string, filename string) *response {
+	for _, release := range s.licenseReleases(license) {
+		if release.ID != id && release.Version != id {
+			continue
+		}
+
+		for i := range release.Artifacts {
+			artifact := &release.Artifacts[i]
+			if artifact.ID != filename && artifact.Filename != filename {
+				continue
+			}
+
+			res := document(http.StatusSeeOther, map[string]interface{}{"data": s.artifactObject(release, artifact)})
+			res.header = http.Header{"Location": {s.URL + "/downloads/" + release.ID + "/" + artifact.Filename}}
+
+			return res
+		}
+	}
+
+	return notFound()
+}
+
+// download serves an artifact's content. Like a real download URL, it does
+// not require authentication.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/downloads/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	s.mu.Lock()
+	release, ok := s.releases[parts[0]]
+	var content []byte
+
+	if ok {
+		for _, artifact := range release.Artifacts {
+			if artifact.Filename == parts[1] {
+				content = artifact.Content
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if content == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Write(content)
+}
+
+// licenseReleases returns the releases for the license's product.
+func (s *Server) licenseReleases(license *License) []*Release {
+	ids := []string{}
+	for id, release := range s.releases {
+		if release.ProductID == license.ProductID {
+			ids = append(ids, id)
+		}
+	}
+
+	releases := []*Release{}
+	for _, id := range s.sorted(ids) {
+		releases = append(releases, s.releases[id])
+	}
+
+	return releases
+}
+
+func (r *Release) hasPlatform(platform string) bool {
+	for _, artifact := range r.Artifacts {
+		if artifact.Platform == platform {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasChecksum reports whether any of the license's release artifacts have the
+// checksum.
+func (s *Server) hasChecksum(license *License, sum string) bool {
+	for _, release := range s.licenseReleases(license) {
+		for _, artifact := range release.Artifacts {
+			if checksum(artifact.Content) == sum {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checksum returns the artifact's SHA512 checksum, unpadded base64 encoded.
+func checksum(content []byte) string {
+	sum := sha512.Sum512(content)
+
+	return base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// signArtifact signs the artifact's SHA512 checksum using Ed25519ph, with
+// the release's product as the signature context. The signature is unpadded
+// base64 encoded.
+func (s *Server) signArtifact(release *Release, content []byte) string {
+	sum := sha512.Sum512(content)
+	opts := &voi.Options{Hash: crypto.SHA512, Context: release.ProductID}
+
+	sig, err := s.personalKey.Sign(rand.Reader, sum[:], opts)
+	if err != nil {
+		return ""
+	}
+
+	return base64.RawStdEncoding.EncodeToString(sig)
+}
+
+func channelIndex(channel string) int {
+	for i, c := range channels {
+		if c == channel {
+			return i
+		}
+	}
+
+	return len(channels)
+}
+
+// semver is a parsed semantic version. Build metadata is ignored.
+type semver struct {
+	major, minor, patch int
+	pre                 []string
+}
+
+// parseVersion parses a semantic version. A partial version, e.g. 1.0 for a
+// constraint, is also accepted.
+func parseVersion(version string) (semver, bool) {
+	v := semver{}
+
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.Index(version, "+"); i >= 0 {
+		version = version[:i]
+	}
+
+	if i := strings.Index(version, "-"); i >= 0 {
+		v.pre = strings.Split(version[i+1:], ".")
+		version = version[:i]
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+
+		*nums[i] = n
+	}
+
+	return v, true
+}
+
+// compare compares two versions, returning -1, 0 or 1. A pre-release version
+// has a lower precedence than its associated normal version.
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		switch {
+		case d < 0:
+			return -1
+		case d > 0:
+			return 1
+		}
+	}
+
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		a, b := v.pre[i], o.pre[i]
+		if a == b {
+			continue
+		}
+
+		x, errA := strconv.Atoi(a)
+		y, errB := strconv.Atoi(b)
+
+		switch {
+		case errA == nil && errB == nil && x < y, errA == nil && errB != nil, errA != nil && errB != nil && a < b:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	switch {
+	case len(v.pre) < len(o.pre):
+		return -1
+	case len(v.pre) > len(o.pre):
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,431 @@
+package keygentest
+
+import (
+	"time"
+)
+
+// License is a license served by the fake server. Policy attributes, such as
+// the machine limit, are set directly on the license.
+type License struct {
+	ID       string
+	Name     string
+	Key      string
+	Token    string
+	Expiry   *time.Time
+	Metadata map[string]interface{}
+
+	// Scheme is the license's signing scheme, e.g. ED25519_SIGN. When set, the
+	// Key is used as the signed key's dataset, and replaced by the signed key.
+	// An RSA scheme, e.g. RSA_2048_PKCS1_PSS_SIGN_V2, also signs the license's
+	// license files and machine files using RSA.
+	Scheme string
+
+	// Suspended marks the license as suspended.
+	Suspended bool
+
+	// Entitlements are the license's entitlement codes.
+	Entitlements []string
+
+	// UserID and GroupID are the license's owner and group, if any. When
+	// included in a license file or a machine file, the owner is served with
+	// UserEmail, and the group with placeholder attributes.
+	UserID    string
+	UserEmail string
+	GroupID   string
+
+	// HeartbeatResurrectionStrategy is the policy's heartbeat resurrection
+	// strategy, e.g. ALWAYS_REVIVE. When set to anything other than
+	// NO_REVIVE, a heartbeat ping for a dead machine resurrects it.
+	HeartbeatResurrectionStrategy string
+
+	PolicyID                  string
+	ProductID                 string
+	MaxMachines               int
+	MaxProcesses              int
+	MaxCores                  int
+	RequireHeartbeat          bool
+	HeartbeatDuration         time.Duration
+	HeartbeatBasis            string
+	RequireFingerprintScope   bool
+	ComponentMatchingStrategy string
+
+	LastValidated *time.Time
+	Created       time.Time
+	Updated       time.Time
+}
+
+// Machine is a machine served by the fake server.
+type Machine struct {
+	ID            string
+	Fingerprint   string
+	Name          string
+	Hostname      string
+	Platform      string
+	IP            string
+	Cores         int
+	Metadata      map[string]interface{}
+	LicenseID     string
+	LastHeartbeat *time.Time
+	Created       time.Time
+	Updated       time.Time
+
+	dead bool
+}
+
+// Component is a machine component served by the fake server.
+type Component struct {
+	ID          string
+	Fingerprint string
+	Name        string
+	Metadata    map[string]interface{}
+	MachineID   string
+	Created     time.Time
+	Updated     time.Time
+}
+
+// Process is a machine process served by the fake server.
+type Process struct {
+	ID            string
+	Pid           string
+	Metadata      map[string]interface{}
+	MachineID     string
+	LastHeartbeat *time.Time
+	Created       time.Time
+	Updated       time.Time
+
+	dead bool
+}
+
+// Release is a release served by the fake server.
+type Release struct {
+	ID        string
+	Name      string
+	Version   string
+	Channel   string
+	ProductID string
+	PackageID string
+	Metadata  map[string]interface{}
+	Artifacts []Artifact
+	Created   time.Time
+	Updated   time.Time
+}
+
+// Artifact is a release artifact served by the fake server. Its checksum and
+// signature are computed from Content.
+type Artifact struct {
+	ID       string
+	Filename string
+	Filetype string
+	Platform string
+	Arch     string
+	Content  []byte
+}
+
+type entitlement struct {
+	ID      string
+	Code    string
+	Created time.Time
+}
+
+// resurrectable reports whether the license's dead machines are resurrected by
+// a heartbeat ping.
+func (l *License) resurrectable() bool {
+	return l.HeartbeatResurrectionStrategy != "" && l.HeartbeatResurrectionStrategy != "NO_REVIVE"
+}
+
+func (l *License) heartbeatDuration() time.Duration {
+	if l.HeartbeatDuration > 0 {
+		return l.HeartbeatDuration
+	}
+
+	return 10 * time.Minute
+}
+
+// heartbeatStatus returns the heartbeat status for a machine or process. When
+// a heartbeat is required, with the default FROM_CREATION basis, a heartbeat
+// that was never started dies after its first heartbeat window, unlike with
+// the FROM_FIRST_PING basis.
+func (s *Server) heartbeatStatus(license *License, created time.Time, lastHeartbeat *time.Time, dead bool) string {
+	now := s.now()
+
+	switch {
+	case dead:
+		return "DEAD"
+	case lastHeartbeat == nil && license.RequireHeartbeat && license.HeartbeatBasis != "FROM_FIRST_PING" && now.Sub(created) > license.heartbeatDuration():
+		return "DEAD"
+	case lastHeartbeat == nil:
+		return "NOT_STARTED"
+	case now.Sub(*lastHeartbeat) > license.heartbeatDuration():
+		return "DEAD"
+	default:
+		return "ALIVE"
+	}
+}
+
+func relationship(typ string, id string) map[string]interface{} {
+	if id == "" {
+		return map[string]interface{}{"data": nil}
+	}
+
+	return map[string]interface{}{"data": map[string]interface{}{"type": typ, "id": id}}
+}
+
+func metadata(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+
+	return m
+}
+
+func (s *Server) licenseObject(l *License) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   l.ID,
+		"type": "licenses",
+		"attributes": map[string]interface{}{
+			"name":             l.Name,
+			"key":              l.Key,
+			"expiry":           l.Expiry,
+			"scheme":           nullable(l.Scheme),
+			"suspended":        l.Suspended,
+			"maxMachines":      nullableInt(l.MaxMachines),
+			"maxProcesses":     nullableInt(l.MaxProcesses),
+			"maxCores":         nullableInt(l.MaxCores),
+			"requireHeartbeat": l.RequireHeartbeat,
+			"lastValidated":    l.LastValidated,
+			"metadata":         metadata(l.Metadata),
+			"created":          l.Created,
+			"updated":          l.Updated,
+		},
+		"relationships": map[string]interface{}{
+			"account": relationship("accounts", s.Account),
+			"product": relationship("products", l.ProductID),
+			"policy":  relationship("policies", l.PolicyID),
+			"user":    relationship("users", l.UserID),
+			"owner":   relationship("users", l.UserID),
+			"group":   relationship("groups", l.GroupID),
+		},
+	}
+}
+
+func (s *Server) productObject(l *License) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   l.ProductID,
+		"type": "products",
+		"attributes": map[string]interface{}{
+			"name":                 "Test Product",
+			"code":                 nil,
+			"distributionStrategy": "LICENSED",
+			"platforms":            []string{},
+			"metadata":             map[string]interface{}{},
+			"created":              l.Created,
+			"updated":              l.Created,
+		},
+	}
+}
+
+func (s *Server) userObject(l *License) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   l.UserID,
+		"type": "users",
+		"attributes": map[string]interface{}{
+			"email":    l.UserEmail,
+			"status":   "ACTIVE",
+			"role":     "user",
+			"metadata": map[string]interface{}{},
+			"created":  l.Created,
+			"updated":  l.Created,
+		},
+		"relationships": map[string]interface{}{
+			"account": relationship("accounts", s.Account),
+			"group":   relationship("groups", l.GroupID),
+		},
+	}
+}
+
+func (s *Server) groupObject(l *License) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   l.GroupID,
+		"type": "groups",
+		"attributes": map[string]interface{}{
+			"name":        "Test Group",
+			"maxUsers":    nil,
+			"maxLicenses": nil,
+			"maxMachines": nil,
+			"metadata":    map[string]interface{}{},
+			"created":     l.Created,
+			"updated":     l.Created,
+		},
+	}
+}
+
+func (s *Server) policyObject(l *License) map[string]interface{} {
+	strategy := l.ComponentMatchingStrategy
+	if strategy == "" {
+		strategy = "MATCH_ANY"
+	}
+
+	return map[string]interface{}{
+		"id":   l.PolicyID,
+		"type": "policies",
+		"attributes": map[string]interface{}{
+			"maxMachines":                   nullableInt(l.MaxMachines),
+			"maxProcesses":                  nullableInt(l.MaxProcesses),
+			"maxCores":                      nullableInt(l.MaxCores),
+			"requireHeartbeat":              l.RequireHeartbeat,
+			"heartbeatDuration":             int(l.heartbeatDuration().Seconds()),
+			"heartbeatBasis":                nullable(l.HeartbeatBasis),
+			"heartbeatResurrectionStrategy": nullable(l.HeartbeatResurrectionStrategy),
+			"requireFingerprintScope":       l.RequireFingerprintScope,
+			"componentMatchingStrategy":     strategy,
+			"created":                       l.Created,
+			"updated":                       l.Updated,
+		},
+		"relationships": map[string]interface{}{
+			"account": relationship("accounts", s.Account),
+			"product": relationship("products", l.ProductID),
+		},
+	}
+}
+
+func (s *Server) machineObject(m *Machine) map[string]interface{} {
+	license := s.licenses[m.LicenseID]
+
+	return map[string]interface{}{
+		"id":   m.ID,
+		"type": "machines",
+		"attributes": map[string]interface{}{
+			"fingerprint":       m.Fingerprint,
+			"name":              nullable(m.Name),
+			"hostname":          nullable(m.Hostname),
+			"platform":          nullable(m.Platform),
+			"ip":                nullable(m.IP),
+			"cores":             nullableInt(m.Cores),
+			"requireHeartbeat":  license.RequireHeartbeat,
+			"heartbeatStatus":   s.heartbeatStatus(license, m.Created, m.LastHeartbeat, m.dead),
+			"heartbeatDuration": int(license.heartbeatDuration().Seconds()),
+			"metadata":          metadata(m.Metadata),
+			"created":           m.Created,
+			"updated":           m.Updated,
+		},
+		"relationships": map[string]interface{}{
+			"account": relationship("accounts", s.Account),
+			"license": relationship("licenses", m.LicenseID),
+		},
+	}
+}
+
+func (s *Server) componentObject(c *Component) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   c.ID,
+		"type": "components",
+		"attributes": map[string]interface{}{
+			"fingerprint": c.Fingerprint,
+			"name":        c.Name,
+			"metadata":    metadata(c.Metadata),
+			"created":     c.Created,
+			"updated":     c.Updated,
+		},
+		"relationships": map[string]interface{}{
+			"account": relationship("accounts", s.Account),
+			"machine": relationship("machines", c.MachineID),
+		},
+	}
+}
+
+func (s *Server) processObject(p *Process) map[string]interface{} {
+	machine := s.machines[p.MachineID]
+	license := s.licenses[machine.LicenseID]
+	status := "ALIVE"
+	if s.heartbeatStatus(license, p.Created, p.LastHeartbeat, p.dead) == "DEAD" {
+		status = "DEAD"
+	}
+
+	return map[string]interface{}{
+		"id":   p.ID,
+		"type": "processes",
+		"attributes": map[string]interface{}{
+			"pid":      p.Pid,
+			"status":   status,
+			"interval": int(license.heartbeatDuration().Seconds()),
+			"metadata": metadata(p.Metadata),
+			"created":  p.Created,
+			"updated":  p.Updated,
+		},
+		"relationships": map[string]interface{}{
+			"account": relationship("accounts", s.Account),
+			"machine": relationship("machines", p.MachineID),
+		},
+	}
+}
+
+func (s *Server) entitlementObject(e *entitlement) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   e.ID,
+		"type": "entitlements",
+		"attributes": map[string]interface{}{
+			"code":     e.Code,
+			"metadata": map[string]interface{}{},
+			"created":  e.Created,
+			"updated":  e.Created,
+		},
+	}
+}
+
+func (s *Server) releaseObject(r *Release) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   r.ID,
+		"type": "releases",
+		"attributes": map[string]interface{}{
+			"name":     nullable(r.Name),
+			"version":  r.Version,
+			"channel":  r.Channel,
+			"metadata": metadata(r.Metadata),
+			"created":  r.Created,
+			"updated":  r.Updated,
+		},
+		"relationships": map[string]interface{}{
+			"account": relationship("accounts", s.Account),
+			"product": relationship("products", r.ProductID),
+			"package": relationship("packages", r.PackageID),
+		},
+	}
+}
+
+func (s *Server) artifactObject(r *Release, a *Artifact) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   a.ID,
+		"type": "artifacts",
+		"attributes": map[string]interface{}{
+			"filename":  a.Filename,
+			"filetype":  nullable(a.Filetype),
+			"filesize":  len(a.Content),
+			"platform":  nullable(a.Platform),
+			"arch":      nullable(a.Arch),
+			"checksum":  checksum(a.Content),
+			"signature": s.signArtifact(r, a.Content),
+			"created":   r.Created,
+			"updated":   r.Updated,
+		},
+		"relationships": map[string]interface{}{
+			"account": relationship("accounts", s.Account),
+			"release": relationship("releases", r.ID),
+		},
+	}
+}
+
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+func nullableInt(i int) interface{} {
+	if i == 0 {
+		return nil
+	}
+
+	return i
+}
@@ -0,0 +1,744 @@
+// Package keygentest provides a fake Keygen API server, for testing programs
+// that use the SDK without network access or a Keygen account.
+//
+// The server implements the endpoints used by the SDK, e.g. license
+// validation, machine activation, heartbeats and upgrades, and it signs its
+// responses, license keys and license files with a generated Ed25519 key, so
+// that the SDK's signature verification passes. State, such as an expired
+// license or a dead heartbeat, can be scripted by a test:
+//
+//	srv := keygentest.NewServer()
+//	defer srv.Close()
+//
+//	license := srv.AddLicense(keygentest.License{MaxMachines: 1})
+//
+//	keygen.APIURL = srv.URL
+//	keygen.Account = srv.Account
+//	keygen.Product = srv.Product
+//	keygen.PublicKey = srv.PublicKey
+//	keygen.LicenseKey = license.Key
+package keygentest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	voi "github.com/oasisprotocol/curve25519-voi/primitives/ed25519"
+)
+
+// ErrNotFound is returned when scripting a resource that does not exist.
+var ErrNotFound = errors.New("keygentest: resource not found")
+
+// Server is a fake Keygen API server. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	// Account is the server's account ID.
+	Account string
+
+	// Product is the server's default product ID, used for licenses and
+	// releases that do not specify one.
+	Product string
+
+	// PublicKey is the hex-encoded Ed25519 public key used to verify the
+	// server's responses, license keys and license files.
+	PublicKey string
+
+	// RSAPublicKey is the PEM-encoded RSA public key used to verify license
+	// keys and license files for licenses using an RSA scheme.
+	RSAPublicKey string
+
+	// PersonalPublicKey is the hex-encoded Ed25519ph public key used to
+	// verify release artifact signatures.
+	PersonalPublicKey string
+
+	// Now returns the server's current time, used for e.g. expiries and
+	// heartbeats. It can be set to simulate the passage of time, but it
+	// must be set before the server is used. Defaults to time.Now.
+	Now func() time.Time
+
+	mu           sync.Mutex
+	privateKey   ed25519.PrivateKey
+	rsaKey       *rsa.PrivateKey
+	personalKey  voi.PrivateKey
+	licenses     map[string]*License
+	machines     map[string]*Machine
+	components   map[string]*Component
+	processes    map[string]*Process
+	releases     map[string]*Release
+	entitlements map[string]*entitlement
+	order        map[string]int
+	faults       []fault
+	requests     int
+}
+
+type fault struct {
+	status     int
+	retryAfter int
+}
+
+// response is a response from an endpoint, before it has been signed.
+type response struct {
+	status int
+	header http.Header
+	doc    interface{}
+}
+
+// NewServer starts and returns a new Server, with a freshly generated
+// account, product and signing keys. The caller should call Close when
+// finished, to shut it down.
+func NewServer() *Server {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("keygentest: failed to generate signing key: " + err.Error())
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("keygentest: failed to generate RSA signing key: " + err.Error())
+	}
+
+	rsaPublicKey, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		panic("keygentest: failed to encode RSA public key: " + err.Error())
+	}
+
+	personalPublicKey, personalKey, err := voi.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("keygentest: failed to generate personal signing key: " + err.Error())
+	}
+
+	s := &Server{
+		Account:           uuid.NewString(),
+		Product:           uuid.NewString(),
+		PublicKey:         hex.EncodeToString(privateKey.Public().(ed25519.PublicKey)),
+		RSAPublicKey:      string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaPublicKey})),
+		PersonalPublicKey: hex.EncodeToString(personalPublicKey),
+		privateKey:        privateKey,
+		rsaKey:            rsaKey,
+		personalKey:       personalKey,
+		licenses:          map[string]*License{},
+		machines:          map[string]*Machine{},
+		components:        map[string]*Component{},
+		processes:         map[string]*Process{},
+		releases:          map[string]*Release{},
+		entitlements:      map[string]*entitlement{},
+		order:             map[string]int{},
+	}
+
+	s.Server = httptest.NewServer(s)
+
+	return s
+}
+
+// AddLicense adds a license to the server, and returns it with any defaults
+// filled in, e.g. its ID and key.
+func (s *Server) AddLicense(license License) License {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	if license.ID == "" {
+		license.ID = uuid.NewString()
+	}
+
+	if license.ProductID == "" {
+		license.ProductID = s.Product
+	}
+
+	if license.PolicyID == "" {
+		license.PolicyID = uuid.NewString()
+	}
+
+	if license.Key == "" {
+		license.Key = strings.ToUpper(strings.ReplaceAll(uuid.NewString(), "-", ""))
+	}
+
+	if license.Scheme != "" {
+		key, err := s.signKey(license.Scheme, license.Key)
+		if err != nil {
+			panic("keygentest: failed to sign license key: " + err.Error())
+		}
+
+		license.Key = key
+	}
+
+	if license.Created.IsZero() {
+		license.Created = now
+	}
+
+	license.Updated = now
+	license.Entitlements = append([]string(nil), license.Entitlements...)
+
+	for _, code := range license.Entitlements {
+		s.entitlement(code)
+	}
+
+	l := license
+	s.licenses[l.ID] = &l
+	s.track(l.ID)
+
+	return license
+}
+
+// UpdateLicense updates a license on the server, e.g. to suspend it or to
+// change its expiry.
+func (s *Server) UpdateLicense(id string, update func(license *License)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	license, ok := s.licenses[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	update(license)
+
+	for _, code := range license.Entitlements {
+		s.entitlement(code)
+	}
+
+	license.Updated = s.now()
+
+	return nil
+}
+
+// License returns a license on the server, e.g. to assert its last
+// validated timestamp.
+func (s *Server) License(id string) (License, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	license, ok := s.licenses[id]
+	if !ok {
+		return License{}, ErrNotFound
+	}
+
+	return *license, nil
+}
+
+// AddMachine adds a machine to the server for the machine's license. Unlike
+// an activation, it bypasses the license's limits, so that e.g. an
+// over-limit license can be scripted.
+func (s *Server) AddMachine(machine Machine) (Machine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.licenses[machine.LicenseID]; !ok {
+		return Machine{}, ErrNotFound
+	}
+
+	now := s.now()
+
+	if machine.ID == "" {
+		machine.ID = uuid.NewString()
+	}
+
+	if machine.Fingerprint == "" {
+		machine.Fingerprint = uuid.NewString()
+	}
+
+	if machine.Created.IsZero() {
+		machine.Created = now
+	}
+
+	machine.Updated = now
+
+	m := machine
+	s.machines[m.ID] = &m
+	s.track(m.ID)
+
+	return machine, nil
+}
+
+// Machines returns the machines on the server for a license.
+func (s *Server) Machines(licenseID string) []Machine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	machines := []Machine{}
+	for _, machine := range s.licenseMachines(licenseID) {
+		machines = append(machines, *machine)
+	}
+
+	return machines
+}
+
+// KillMachine marks a machine's heartbeat as dead, as if it had missed its
+// heartbeat window. Subsequent heartbeat pings for the machine will fail.
+func (s *Server) KillMachine(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	machine, ok := s.machines[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	machine.dead = true
+
+	return nil
+}
+
+// KillProcess marks a process's heartbeat as dead, as if it had missed its
+// heartbeat window. Subsequent heartbeat pings for the process will fail.
+func (s *Server) KillProcess(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	process, ok := s.processes[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	process.dead = true
+
+	return nil
+}
+
+// AddRelease adds a release to the server, and returns it with any defaults
+// filled in, e.g. its ID and channel.
+func (s *Server) AddRelease(release Release) Release {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	if release.ID == "" {
+		release.ID = uuid.NewString()
+	}
+
+	if release.ProductID == "" {
+		release.ProductID = s.Product
+	}
+
+	if release.Channel == "" {
+		release.Channel = "stable"
+	}
+
+	if release.Created.IsZero() {
+		release.Created = now
+	}
+
+	release.Updated = now
+	release.Artifacts = append([]Artifact(nil), release.Artifacts...)
+
+	for i := range release.Artifacts {
+		if release.Artifacts[i].ID == "" {
+			release.Artifacts[i].ID = uuid.NewString()
+		}
+	}
+
+	r := release
+	s.releases[r.ID] = &r
+	s.track(r.ID)
+
+	return release
+}
+
+// FailNext makes the next n API requests fail with the given status, e.g.
+// http.StatusServiceUnavailable, without being processed.
+func (s *Server) FailNext(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		s.faults = append(s.faults, fault{status: status})
+	}
+}
+
+// RateLimitNext makes the next n API requests fail with a rate limit error,
+// with a Retry-After header of the given seconds, without being processed.
+func (s *Server) RateLimitNext(n int, retryAfter int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		s.faults = append(s.faults, fault{status: http.StatusTooManyRequests, retryAfter: retryAfter})
+	}
+}
+
+// Requests returns the number of API requests received by the server,
+// including any failed requests.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/downloads/") {
+		s.download(w, r)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+
+	if len(s.faults) > 0 {
+		fault := s.faults[0]
+		s.faults = s.faults[1:]
+
+		if fault.status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", strconv.Itoa(fault.retryAfter))
+			w.Header().Set("X-RateLimit-Window", "30s")
+			w.Header().Set("X-RateLimit-Count", "61")
+			w.Header().Set("X-RateLimit-Limit", "60")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Duration(fault.retryAfter)*time.Second).Unix(), 10))
+		}
+
+		s.write(w, r, errorResponse(fault.status, "", http.StatusText(fault.status), "", ""))
+
+		return
+	}
+
+	s.write(w, r, s.route(r))
+}
+
+func (s *Server) route(r *http.Request) *response {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	path = strings.TrimPrefix(path, "accounts/"+s.Account+"/")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	if r.Method == http.MethodPost && path == "licenses/actions/validate-key" {
+		return s.validateKey(r)
+	}
+
+	license, res := s.authenticate(r)
+	if res != nil {
+		return res
+	}
+
+	route := func(method string, pattern string) bool {
+		if r.Method != method {
+			return false
+		}
+
+		parts := strings.Split(pattern, "/")
+		if len(parts) != len(segments) {
+			return false
+		}
+
+		for i, part := range parts {
+			if part != "*" && part != segments[i] {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	switch {
+	case route(http.MethodGet, "me"):
+		return document(http.StatusOK, map[string]interface{}{"data": s.licenseObject(license)})
+	case route(http.MethodGet, "licenses/*"):
+		return s.getLicense(license, segments[1])
+	case route(http.MethodPost, "licenses/*/actions/validate"):
+		return s.validateLicense(r, license, segments[1])
+	case route(http.MethodPost, "licenses/*/actions/check-out"), route(http.MethodGet, "licenses/*/actions/check-out"):
+		return s.checkoutLicense(r, license, segments[1])
+	case route(http.MethodGet, "licenses/*/machines"):
+		return s.listMachines(r, license, segments[1])
+	case route(http.MethodGet, "licenses/*/entitlements"):
+		return s.listEntitlements(r, license, segments[1])
+	case route(http.MethodPost, "machines"):
+		return s.activateMachine(r, license)
+	case route(http.MethodGet, "machines/*"):
+		return s.getMachine(license, segments[1])
+	case route(http.MethodPatch, "machines/*"):
+		return s.updateMachine(r, license, segments[1])
+	case route(http.MethodDelete, "machines/*"):
+		return s.deactivateMachine(license, segments[1])
+	case route(http.MethodPost, "machines/*/actions/ping"):
+		return s.pingMachine(license, segments[1])
+	case route(http.MethodPost, "machines/*/actions/check-out"), route(http.MethodGet, "machines/*/actions/check-out"):
+		return s.checkoutMachine(r, license, segments[1])
+	case route(http.MethodGet, "machines/*/components"):
+		return s.listComponents(r, license, segments[1])
+	case route(http.MethodGet, "machines/*/processes"):
+		return s.listProcesses(r, license, segments[1])
+	case route(http.MethodPost, "components"):
+		return s.addComponent(r, license)
+	case route(http.MethodDelete, "components/*"):
+		return s.removeComponent(license, segments[1])
+	case route(http.MethodPost, "processes"):
+		return s.spawnProcess(r, license)
+	case route(http.MethodDelete, "processes/*"):
+		return s.killProcess(license, segments[1])
+	case route(http.MethodPost, "processes/*/actions/ping"):
+		return s.pingProcess(license, segments[1])
+	case route(http.MethodGet, "releases"):
+		return s.listReleases(r, license)
+	case route(http.MethodGet, "releases/*/upgrade"):
+		return s.upgradeRelease(r, license, segments[1])
+	case route(http.MethodGet, "releases/*/artifacts/*"):
+		return s.getArtifact(license, segments[1], segments[3])
+	default:
+		return notFound()
+	}
+}
+
+// authenticate returns the license for the request's license key or license
+// token. Unlike the real API, only license authentication is supported.
+func (s *Server) authenticate(r *http.Request) (*License, *response) {
+	auth := r.Header.Get("Authorization")
+
+	switch {
+	case strings.HasPrefix(auth, "License "):
+		key := strings.TrimPrefix(auth, "License ")
+
+		for _, license := range s.licenses {
+			if license.Key == key {
+				return license, nil
+			}
+		}
+
+		return nil, errorResponse(http.StatusUnauthorized, "LICENSE_INVALID", "Unauthorized", "must be a valid license key", "")
+	case strings.HasPrefix(auth, "Bearer "):
+		token := strings.TrimPrefix(auth, "Bearer ")
+
+		for _, license := range s.licenses {
+			if license.Token != "" && license.Token == token {
+				return license, nil
+			}
+		}
+
+		return nil, errorResponse(http.StatusUnauthorized, "TOKEN_INVALID", "Unauthorized", "must be a valid token", "")
+	default:
+		return nil, errorResponse(http.StatusUnauthorized, "TOKEN_MISSING", "Unauthorized", "must be authenticated", "")
+	}
+}
+
+// write signs and writes the response, like the real API does, so that the
+// SDK's response verification passes.
+func (s *Server) write(w http.ResponseWriter, r *http.Request, res *response) {
+	var body []byte
+
+	if res.doc != nil {
+		b, err := json.Marshal(res.doc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		body = b
+	}
+
+	for k, v := range res.header {
+		w.Header()[k] = v
+	}
+
+	// Always use the real time, since the date is checked for clock drift
+	date := time.Now().UTC().Format(http.TimeFormat)
+	shasum := sha256.Sum256(body)
+	digest := "sha-256=" + base64.StdEncoding.EncodeToString(shasum[:])
+
+	target := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+
+	msg := fmt.Sprintf(
+		"(request-target): %s %s\nhost: %s\ndate: %s\ndigest: %s",
+		strings.ToLower(r.Method),
+		target,
+		r.Host,
+		date,
+		digest,
+	)
+
+	sig := ed25519.Sign(s.privateKey, []byte(msg))
+
+	w.Header().Set("Date", date)
+	w.Header().Set("Digest", digest)
+	w.Header().Set("Keygen-Signature", fmt.Sprintf(
+		`keyid="%s", algorithm="ed25519", signature="%s", headers="(request-target) host date digest"`,
+		s.Account,
+		base64.StdEncoding.EncodeToString(sig),
+	))
+	w.Header().Set("X-Request-Id", uuid.NewString())
+
+	if len(body) > 0 {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+	}
+
+	w.WriteHeader(res.status)
+	w.Write(body)
+}
+
+// paginate returns a page of resource objects, along with the page's links,
+// using the request's page[size] and page[number] query parameters.
+func paginate(r *http.Request, objects []map[string]interface{}) *response {
+	query := r.URL.Query()
+	objects = filter(query, objects)
+
+	size, err := strconv.Atoi(query.Get("page[size]"))
+	if err != nil || size <= 0 {
+		size = 10
+	}
+
+	if size > 100 {
+		return errorResponse(http.StatusBadRequest, "PAGE_SIZE_INVALID", "Bad request", "page size must be less than or equal to 100", "")
+	}
+
+	number, err := strconv.Atoi(query.Get("page[number]"))
+	if err != nil || number <= 0 {
+		number = 1
+	}
+
+	start := (number - 1) * size
+	if start > len(objects) {
+		start = len(objects)
+	}
+
+	end := start + size
+	if end > len(objects) {
+		end = len(objects)
+	}
+
+	link := func(number int) string {
+		values := url.Values{}
+		for k, v := range query {
+			values[k] = v
+		}
+
+		values.Set("page[number]", strconv.Itoa(number))
+		values.Set("page[size]", strconv.Itoa(size))
+
+		return r.URL.Path + "?" + values.Encode()
+	}
+
+	links := map[string]interface{}{"self": link(number), "next": nil}
+	if end < len(objects) {
+		links["next"] = link(number + 1)
+	}
+
+	return document(http.StatusOK, map[string]interface{}{"data": objects[start:end], "links": links})
+}
+
+// filter applies the query's filters to the resource objects, matching an
+// attribute or a relationship by its key, e.g. fingerprint or product.
+func filter(query url.Values, objects []map[string]interface{}) []map[string]interface{} {
+	filtered := []map[string]interface{}{}
+
+outer:
+	for _, object := range objects {
+		for key, values := range query {
+			if key == "sort" || key == "include" || strings.HasPrefix(key, "page[") || strings.HasPrefix(key, "fields[") {
+				continue
+			}
+
+			attrs := object["attributes"].(map[string]interface{})
+			value, ok := attrs[key]
+			if !ok && object["type"] == "machines" && key == "status" {
+				value, ok = attrs["heartbeatStatus"]
+			}
+
+			if !ok {
+				if relationships, has := object["relationships"].(map[string]interface{}); has {
+					if relationship, has := relationships[key].(map[string]interface{}); has {
+						if data, has := relationship["data"].(map[string]interface{}); has {
+							value, ok = data["id"], true
+						}
+					}
+				}
+			}
+
+			// Like the real API, unsupported filters are ignored
+			if !ok {
+				continue
+			}
+
+			if fmt.Sprint(value) != values[0] {
+				continue outer
+			}
+		}
+
+		filtered = append(filtered, object)
+	}
+
+	return filtered
+}
+
+// track records the creation order of a resource, so that lists are ordered
+// consistently.
+func (s *Server) track(id string) {
+	s.order[id] = len(s.order)
+}
+
+func (s *Server) sorted(ids []string) []string {
+	sort.Slice(ids, func(i, j int) bool { return s.order[ids[i]] < s.order[ids[j]] })
+
+	return ids
+}
+
+func (s *Server) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+
+	return time.Now()
+}
+
+func document(status int, doc interface{}) *response {
+	return &response{status: status, doc: doc}
+}
+
+func errorResponse(status int, code string, title string, detail string, pointer string) *response {
+	e := map[string]interface{}{"title": title, "detail": detail}
+	if code != "" {
+		e["code"] = code
+	}
+
+	if pointer != "" {
+		e["source"] = map[string]interface{}{"pointer": pointer}
+	}
+
+	return document(status, map[string]interface{}{"errors": []interface{}{e}})
+}
+
+func notFound() *response {
+	return errorResponse(http.StatusNotFound, "NOT_FOUND", "Not found", "The requested resource was not found", "")
+}
+
+func forbidden(code string, detail string) *response {
+	return errorResponse(http.StatusForbidden, code, "Access denied", detail, "")
+}
+
+func unprocessable(code string, detail string, pointer string) *response {
+	return errorResponse(http.StatusUnprocessableEntity, code, "Unprocessable resource", detail, pointer)
+}
+
+func decode(r *http.Request, v interface{}) *response {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errorResponse(http.StatusBadRequest, "", "Bad request", "The request data was invalid: "+err.Error(), "")
+	}
+
+	return nil
+}
@@ -0,0 +1,423 @@
+package keygen
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LeaseEventCode is the kind of a lease's state change.
+type LeaseEventCode string
+
+const (
+	LeaseEventCodeRenewed       LeaseEventCode = "RENEWED"
+	LeaseEventCodeRenewalFailed LeaseEventCode = "RENEWAL_FAILED"
+	LeaseEventCodeExpiringSoon  LeaseEventCode = "EXPIRING_SOON"
+	LeaseEventCodeExpired       LeaseEventCode = "EXPIRED"
+)
+
+// LeaseEvent is a change in a lease's state.
+type LeaseEvent struct {
+	// Code is the kind of state change, e.g. LeaseEventCodeRenewed.
+	Code LeaseEventCode
+
+	// File is the lease's current file, i.e. a *LicenseFile or a *MachineFile.
+	File File
+
+	// Expiry is the current file's expiry, or zero when it never expires.
+	Expiry time.Time
+
+	// Err is the error that caused a renewal to fail, if any.
+	Err error
+}
+
+// LeaseOptions stores config options used by a lease.
+type LeaseOptions struct {
+	// Path is where the lease's current file is persisted, and where it is
+	// loaded from when the lease starts, e.g. while offline. When empty,
+	// the file is only kept in memory.
+	Path string
+
+	// Key is the license key used to decrypt the lease's files. It defaults
+	// to the license's key for a license file, and to the client's
+	// LicenseKey for a machine file.
+	Key string
+
+	// TTL is the time-to-live of checked out files. Defaults to the API's
+	// default TTL when zero.
+	TTL time.Duration
+
+	// Include are the relationships to include in checked out files. Defaults
+	// to the same relationships as License.Checkout and Machine.Checkout.
+	Include []string
+
+	// RenewAfter is the fraction of a file's lifetime after which it is
+	// renewed, while online. Defaults to 0.5, i.e. halfway to its expiry.
+	RenewAfter float64
+
+	// RetryInterval is the interval between renewal attempts after a renewal
+	// fails, e.g. while offline. Defaults to 1 minute.
+	RetryInterval time.Duration
+
+	// ExpiringWithin is the period before a file's expiry in which an
+	// EXPIRING_SOON event is sent, if the file hasn't been renewed. Defaults
+	// to a tenth of the file's lifetime.
+	ExpiringWithin time.Duration
+
+	// OnEvent is called for each of the lease's state changes, e.g. when its
+	// file is renewed or expires. It is called from the lease's goroutine, so
+	// it should not block.
+	OnEvent func(LeaseEvent)
+}
+
+// Lease keeps a license file or a machine file fresh in the background, by
+// checking out a new file before the current file expires. Use License.Lease
+// or Machine.Lease to start a lease. A Lease is safe for concurrent use.
+type Lease struct {
+	opts   LeaseOptions
+	source leaseSource
+	clock  clock
+	done   chan struct{}
+
+	mu     sync.Mutex
+	file   File
+	issued time.Time
+	expiry time.Time
+}
+
+// leaseSource checks out and loads the lease's files.
+type leaseSource struct {
+	checkout func(ctx context.Context, options ...CheckoutOption) (File, error)
+	load     func(path string) (File, error)
+	secret   string
+}
+
+// clock is the lease's source of time, so that tests can control it.
+type clock interface {
+	now() time.Time
+
+	// until returns a channel that receives once the time t is reached,
+	// and a func that stops it.
+	until(t time.Time) (<-chan time.Time, func() bool)
+}
+
+// clientClock is a lease's clock using the client's trusted clock, if any.
+type clientClock struct {
+	client *Client
+}
+
+func (c clientClock) now() time.Time {
+	// The lease reports an unsynced clock when renewing, so ignore it here
+	now, _ := c.client.now()
+
+	return now
+}
+
+func (c clientClock) until(t time.Time) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(t.Sub(c.now()))
+
+	return timer.C, timer.Stop
+}
+
+// Lease starts a lease for the license's license file. See the Lease type
+// for more info.
+func (l *License) Lease(ctx context.Context, options LeaseOptions) (*Lease, error) {
+	return startLease(ctx, options, l.leaseSource(options.Key), clientClock{clientOrDefault(l.client)})
+}
+
+func (l *License) leaseSource(key string) leaseSource {
+	if key == "" {
+		key = l.Key
+	}
+
+	return leaseSource{
+		checkout: func(ctx context.Context, options ...CheckoutOption) (File, error) {
+			return l.Checkout(ctx, options...)
+		},
+		load: func(path string) (File, error) {
+			lic, err := LoadLicenseFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			// Verify the file using the license's client
+			lic.client = clientOrDefault(l.client)
+
+			return lic, nil
+		},
+		secret: key,
+	}
+}
+
+// Lease starts a lease for the machine's machine file. See the Lease type
+// for more info.
+func (m *Machine) Lease(ctx context.Context, options LeaseOptions) (*Lease, error) {
+	return startLease(ctx, options, m.leaseSource(options.Key), clientClock{clientOrDefault(m.client)})
+}
+
+func (m *Machine) leaseSource(key string) leaseSource {
+	if key == "" {
+		key = clientOrDefault(m.client).LicenseKey
+	}
+
+	return leaseSource{
+		checkout: func(ctx context.Context, options ...CheckoutOption) (File, error) {
+			return m.Checkout(ctx, options...)
+		},
+		load: func(path string) (File, error) {
+			lic, err := LoadMachineFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			// Verify the file using the machine's client
+			lic.client = clientOrDefault(m.client)
+
+			return lic, nil
+		},
+		secret: key + m.Fingerprint,
+	}
+}
+
+// startLease starts a lease using its persisted file, if it's genuine and
+// unexpired, and otherwise using a newly checked out file. It returns an
+// error if neither is available. The lease stops when ctx is canceled.
+func startLease(ctx context.Context, options LeaseOptions, source leaseSource, clock clock) (*Lease, error) {
+	if options.RenewAfter <= 0 || options.RenewAfter > 1 {
+		options.RenewAfter = 0.5
+	}
+
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = time.Minute
+	}
+
+	lease := &Lease{opts: options, source: source, clock: clock, done: make(chan struct{})}
+
+	if !lease.restore() {
+		if err := lease.renew(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	go lease.run(ctx)
+
+	return lease, nil
+}
+
+// File returns the lease's current file, i.e. a *LicenseFile or a
+// *MachineFile.
+func (l *Lease) File() File {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file
+}
+
+// Expiry returns the lease's current file's expiry, or zero when it never
+// expires.
+func (l *Lease) Expiry() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.expiry
+}
+
+// Done returns a channel that is closed once the lease has stopped, after
+// its context is canceled.
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *Lease) run(ctx context.Context) {
+	defer close(l.done)
+
+	var retryAt time.Time
+	var warned, expired bool
+
+	for {
+		l.mu.Lock()
+		issued, expiry := l.issued, l.expiry
+		l.mu.Unlock()
+
+		// A file that never expires doesn't need to be renewed
+		if expiry.IsZero() {
+			<-ctx.Done()
+
+			return
+		}
+
+		now := l.clock.now()
+		lifetime := expiry.Sub(issued)
+		renewAt := issued.Add(time.Duration(float64(lifetime) * l.opts.RenewAfter))
+		if retryAt.After(renewAt) {
+			renewAt = retryAt
+		}
+
+		within := l.opts.ExpiringWithin
+		if within <= 0 {
+			within = lifetime / 10
+		}
+
+		warnAt := expiry.Add(-within)
+
+		switch {
+		case !expired && !now.Before(expiry):
+			expired = true
+
+			l.emit(LeaseEventCodeExpired, nil)
+		case !warned && !expired && !now.Before(warnAt):
+			warned = true
+
+			l.emit(LeaseEventCodeExpiringSoon, nil)
+		case !now.Before(renewAt):
+			if err := l.renew(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				retryAt = now.Add(l.opts.RetryInterval)
+
+				l.emit(LeaseEventCodeRenewalFailed, err)
+
+				continue
+			}
+
+			retryAt = time.Time{}
+			warned, expired = false, false
+
+			l.emit(LeaseEventCodeRenewed, nil)
+		default:
+			next := renewAt
+			if !warned && warnAt.Before(next) {
+				next = warnAt
+			}
+
+			if !expired && expiry.Before(next) {
+				next = expiry
+			}
+
+			c, stop := l.clock.until(next)
+
+			select {
+			case <-ctx.Done():
+				stop()
+
+				return
+			case <-c:
+			}
+		}
+	}
+}
+
+// restore loads the lease's persisted file, reporting whether it can be used,
+// i.e. it's genuine and unexpired.
+func (l *Lease) restore() bool {
+	if l.opts.Path == "" {
+		return false
+	}
+
+	file, err := l.source.load(l.opts.Path)
+	if err != nil {
+		return false
+	}
+
+	if err := file.Verify(); err != nil {
+		return false
+	}
+
+	issued, expiry, err := fileLifetime(file, l.source.secret)
+	if err != nil || (!expiry.IsZero() && !l.clock.now().Before(expiry)) {
+		return false
+	}
+
+	l.set(file, issued, expiry)
+
+	return true
+}
+
+// renew checks out a new file, and persists it.
+func (l *Lease) renew(ctx context.Context) error {
+	var options []CheckoutOption
+	if l.opts.TTL > 0 {
+		options = append(options, CheckoutTTL(l.opts.TTL))
+	}
+
+	if len(l.opts.Include) > 0 {
+		options = append(options, CheckoutInclude(l.opts.Include...))
+	}
+
+	file, err := l.source.checkout(ctx, options...)
+	if err != nil {
+		return err
+	}
+
+	issued, expiry, err := fileLifetime(file, l.source.secret)
+	if err != nil {
+		return err
+	}
+
+	if l.opts.Path != "" {
+		if err := file.Save(l.opts.Path); err != nil {
+			return err
+		}
+	}
+
+	l.set(file, issued, expiry)
+
+	return nil
+}
+
+func (l *Lease) set(file File, issued time.Time, expiry time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.file = file
+	l.issued = issued
+	l.expiry = expiry
+}
+
+func (l *Lease) emit(code LeaseEventCode, err error) {
+	if l.opts.OnEvent == nil {
+		return
+	}
+
+	l.mu.Lock()
+	event := LeaseEvent{Code: code, File: l.file, Expiry: l.expiry, Err: err}
+	l.mu.Unlock()
+
+	l.opts.OnEvent(event)
+}
+
+// fileLifetime returns the file's issued and expiry timestamps, from its
+// decrypted or decoded dataset. The expiry is zero when the file never
+// expires. The lease checks the expiry itself, so an expired file isn't
+// an error.
+func fileLifetime(file File, secret string) (time.Time, time.Time, error) {
+	var issued, expiry time.Time
+	var ttl int
+
+	switch f := file.(type) {
+	case *LicenseFile:
+		dataset, err := f.Dataset(secret)
+		if err != nil && err != ErrLicenseFileExpired {
+			return issued, expiry, err
+		}
+
+		issued, expiry, ttl = dataset.Issued, dataset.Expiry, dataset.TTL
+	case *MachineFile:
+		dataset, err := f.Dataset(secret)
+		if err != nil && err != ErrMachineFileExpired {
+			return issued, expiry, err
+		}
+
+		issued, expiry, ttl = dataset.Issued, dataset.Expiry, dataset.TTL
+	default:
+		return issued, expiry, ErrFileFormatInvalid
+	}
+
+	if ttl == 0 {
+		return issued, time.Time{}, nil
+	}
+
+	return issued, expiry, nil
+}
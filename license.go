@@ -12,7 +12,10 @@ import (
 type SchemeCode string
 
 const (
-	SchemeCodeEd25519 SchemeCode = "ED25519_SIGN"
+	SchemeCodeEd25519         SchemeCode = "ED25519_SIGN"
+	SchemeCodeRSAPKCS1Sign    SchemeCode = "RSA_2048_PKCS1_SIGN_V2"
+	SchemeCodeRSAPSSSign      SchemeCode = "RSA_2048_PKCS1_PSS_SIGN_V2"
+	SchemeCodeRSAPKCS1Encrypt SchemeCode = "RSA_2048_PKCS1_ENCRYPT"
 )
 
 // License represents a Keygen license object.
@@ -29,7 +32,12 @@ type License struct {
 	Updated          time.Time              `json:"updated"`
 	Metadata         map[string]interface{} `json:"metadata"`
 	PolicyId         string                 `json:"-"`
+	ProductID        string                 `json:"-"`
+	UserID           string                 `json:"-"`
+	GroupID          string                 `json:"-"`
 	LastValidation   *ValidationResult      `json:"-"`
+
+	client *Client `json:"-"`
 }
 
 // SetID implements the jsonapi.UnmarshalResourceIdentifier interface.
@@ -55,30 +63,63 @@ func (l *License) SetRelationships(relationships map[string]interface{}) error {
 		l.PolicyId = relationship.(*jsonapi.ResourceObjectIdentifier).ID
 	}
 
+	if relationship, ok := relationships["product"]; ok {
+		l.ProductID = relationship.(*jsonapi.ResourceObjectIdentifier).ID
+	}
+
+	// The user relationship was renamed to owner in API version 1.6
+	if relationship, ok := relationships["owner"]; ok {
+		l.UserID = relationship.(*jsonapi.ResourceObjectIdentifier).ID
+	} else if relationship, ok := relationships["user"]; ok {
+		l.UserID = relationship.(*jsonapi.ResourceObjectIdentifier).ID
+	}
+
+	if relationship, ok := relationships["group"]; ok {
+		l.GroupID = relationship.(*jsonapi.ResourceObjectIdentifier).ID
+	}
+
 	return nil
 }
 
 // Validate performs a license validation, scoped to an optional device fingerprint
 // and an optional array of hardware component fingerprints. It returns an error
 // if the license is invalid, e.g. ErrLicenseNotActivated, ErrLicenseExpired or
-// ErrLicenseTooManyMachines.
+// ErrLicenseTooManyMachines. The validation result is stored in LastValidation,
+// and LastValidationError returns its details. Use ValidateWithOptions to
+// validate other scopes.
 func (l *License) Validate(ctx context.Context, fingerprints ...string) error {
-	client := NewClient()
+	return l.ValidateWithOptions(ctx, validateFingerprints(fingerprints)...)
+}
+
+// ValidateWithOptions performs a license validation, scoped to the provided
+// options, e.g. ValidateFingerprint, ValidateEntitlements or ValidatePolicy.
+// See Validate for more info.
+func (l *License) ValidateWithOptions(ctx context.Context, options ...ValidateOption) error {
+	client := clientOrDefault(l.client)
+
+	params, err := newValidate(client, options)
+	if err != nil {
+		return err
+	}
+
+	return l.validate(ctx, client, "licenses/"+l.ID+"/actions/validate", params)
+}
+
+// validate performs a validation request, replacing the license with the
+// validated license. It returns the validation code's sentinel error if the
+// license is invalid.
+func (l *License) validate(ctx context.Context, client *Client, path string, params validate) error {
 	validation := &validation{}
 
-	// split up fingerprints (first is machine, rest are components)
-	var params validate
-	if n := len(fingerprints); n > 0 {
-		if n > 1 {
-			params = validate{fingerprint: fingerprints[0], components: fingerprints[1:]}
-		} else {
-			params = validate{fingerprint: fingerprints[0]}
-		}
-	} else {
-		params = validate{}
+	nonce, err := newNonce()
+	if err != nil {
+		return err
 	}
 
-	if _, err := client.Post(ctx, "licenses/"+l.ID+"/actions/validate", params, validation); err != nil {
+	params.nonce = nonce
+
+	res, err := client.Post(ctx, path, params, validation)
+	if err != nil {
 		if _, ok := err.(*NotFoundError); ok {
 			return ErrLicenseInvalid
 		}
@@ -86,48 +127,39 @@ func (l *License) Validate(ctx context.Context, fingerprints ...string) error {
 		return err
 	}
 
+	// Reject a replayed response, i.e. one for a different validation
+	if validation.Result.Nonce != nonce {
+		client.logger().Errorf("Validation nonce does not match: id=%s nonce=%d", res.ID, validation.Result.Nonce)
+
+		return ErrValidationNonceMismatch
+	}
+
 	*l = validation.License
+	l.client = client
 
 	// Store last validation result
 	l.LastValidation = &validation.Result
+	l.LastValidation.ResponseID = res.ID
 
 	if validation.Result.Code == ValidationCodeValid {
 		return nil
 	}
 
-	switch {
-	case validation.Result.Code == ValidationCodeFingerprintScopeMismatch ||
-		validation.Result.Code == ValidationCodeNoMachines ||
-		validation.Result.Code == ValidationCodeNoMachine:
-		return ErrLicenseNotActivated
-	case validation.Result.Code == ValidationCodeExpired:
-		return ErrLicenseExpired
-	case validation.Result.Code == ValidationCodeSuspended:
-		return ErrLicenseSuspended
-	case validation.Result.Code == ValidationCodeTooManyMachines:
-		return ErrLicenseTooManyMachines
-	case validation.Result.Code == ValidationCodeTooManyCores:
-		return ErrLicenseTooManyCores
-	case validation.Result.Code == ValidationCodeTooManyProcesses:
-		return ErrLicenseTooManyProcesses
-	case validation.Result.Code == ValidationCodeFingerprintScopeRequired ||
-		validation.Result.Code == ValidationCodeFingerprintScopeEmpty:
-		return ErrValidationFingerprintMissing
-	case validation.Result.Code == ValidationCodeComponentsScopeRequired ||
-		validation.Result.Code == ValidationCodeComponentsScopeEmpty:
-		return ErrValidationComponentsMissing
-	case validation.Result.Code == ValidationCodeComponentsScopeMismatch:
-		return ErrComponentNotActivated
-	case validation.Result.Code == ValidationCodeHeartbeatNotStarted:
-		return ErrHeartbeatRequired
-	case validation.Result.Code == ValidationCodeHeartbeatDead:
-		return ErrHeartbeatDead
-	case validation.Result.Code == ValidationCodeProductScopeRequired ||
-		validation.Result.Code == ValidationCodeProductScopeEmpty:
-		return ErrValidationProductMissing
-	default:
-		return ErrLicenseInvalid
+	return validationErr(validation.Result.Code)
+}
+
+// LastValidationError returns a *ValidationError for the license's last
+// validation, which carries the validation result and the license, and which
+// can be compared to the validation code's own sentinel error using errors.Is,
+// e.g. ErrLicenseNoMachine or ErrLicenseEntitlementsMissing, as well as to the
+// error returned by the validation, e.g. ErrLicenseNotActivated. It returns nil
+// if the license hasn't been validated, or if it's valid.
+func (l *License) LastValidationError() *ValidationError {
+	if l == nil || l.LastValidation == nil || l.LastValidation.Code == ValidationCodeValid {
+		return nil
 	}
+
+	return newValidationError(*l.LastValidation, l)
 }
 
 // Verify checks if the license's key is genuine by cryptographically verifying the
@@ -139,7 +171,8 @@ func (l *License) Verify() ([]byte, error) {
 		return nil, ErrLicenseNotSigned
 	}
 
-	verifier := &verifier{PublicKey: PublicKey}
+	client := clientOrDefault(l.client)
+	verifier := &verifier{PublicKey: client.PublicKey, RSAPublicKey: client.RSAPublicKey}
 
 	return verifier.VerifyLicense(l)
 }
@@ -147,17 +180,40 @@ func (l *License) Verify() ([]byte, error) {
 // Activate performs a machine activation for the license, identified by the provided
 // fingerprint. If the activation is successful, the new machine will be returned. An
 // error will be returned if the activation fails, e.g. ErrMachineLimitExceeded
-// or ErrMachineAlreadyActivated.
+// or ErrMachineAlreadyActivated. Use ActivateWithOptions to set other attributes.
 func (l *License) Activate(ctx context.Context, fingerprint string, components ...Component) (*Machine, error) {
-	client := NewClient()
+	return l.ActivateWithOptions(ctx, fingerprint, ActivateComponents(components...))
+}
+
+// ActivateWithOptions performs a machine activation for the license, identified by
+// the provided fingerprint, using the provided options, e.g. ActivateName or
+// ActivateCores. See Activate for more info.
+func (l *License) ActivateWithOptions(ctx context.Context, fingerprint string, options ...ActivateOption) (*Machine, error) {
+	client := clientOrDefault(l.client)
 	hostname, _ := os.Hostname()
+
+	opts := ActivateOptions{
+		Hostname: hostname,
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+		Cores:    runtime.NumCPU(),
+	}
+
+	for _, opt := range options {
+		if err := opt(&opts); err != nil {
+			return nil, err
+		}
+	}
+
 	params := &Machine{
 		Fingerprint: fingerprint,
-		Hostname:    hostname,
-		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
-		Cores:       runtime.NumCPU(),
+		Name:        opts.Name,
+		Hostname:    opts.Hostname,
+		Platform:    opts.Platform,
+		IP:          opts.IP,
+		Cores:       opts.Cores,
+		Metadata:    opts.Metadata,
 		LicenseID:   l.ID,
-		components:  components,
+		components:  opts.Components,
 	}
 
 	machine := &Machine{}
@@ -165,6 +221,8 @@ func (l *License) Activate(ctx context.Context, fingerprint string, components .
 		return nil, err
 	}
 
+	machine.client = client
+
 	return machine, nil
 }
 
@@ -172,7 +230,7 @@ func (l *License) Activate(ctx context.Context, fingerprint string, components .
 // can be the machine's UUID or the machine's fingerprint. An error will be returned
 // if the machine deactivation fails.
 func (l *License) Deactivate(ctx context.Context, id string) error {
-	client := NewClient()
+	client := clientOrDefault(l.client)
 
 	_, err := client.Delete(ctx, "machines/"+id, nil, nil)
 	if err != nil {
@@ -185,43 +243,98 @@ func (l *License) Deactivate(ctx context.Context, id string) error {
 // Machine retreives a machine, identified by the provided ID. The ID can be the machine's
 // UUID or the machine's fingerprint. An error will be returned if it does not exist.
 func (l *License) Machine(ctx context.Context, id string) (*Machine, error) {
-	client := NewClient()
+	client := clientOrDefault(l.client)
 	machine := &Machine{}
 
 	if _, err := client.Get(ctx, "machines/"+id, nil, machine); err != nil {
 		return nil, err
 	}
 
+	machine.client = client
+
 	return machine, nil
 }
 
-// Machines lists up to 100 machines for the license.
-func (l *License) Machines(ctx context.Context) (Machines, error) {
-	client := NewClient()
+// Machines lists all machines for the license, fetching every page, i.e. one
+// request per page. Unlike earlier versions, which only listed the first 100
+// machines, it doesn't truncate large lists, so use IterMachines to process
+// them a page at a time.
+func (l *License) Machines(ctx context.Context, options ...ListOption) (Machines, error) {
+	it := l.IterMachines(ctx, options...)
 	machines := Machines{}
 
-	if _, err := client.Get(ctx, "licenses/"+l.ID+"/machines", querystring{Limit: 100}, &machines); err != nil {
+	for it.Next() {
+		machines = append(machines, *it.Machine())
+	}
+
+	if err := it.Err(); err != nil {
 		return nil, err
 	}
 
 	return machines, nil
 }
 
-// Machines lists up to 100 entitlements for the license.
-func (l *License) Entitlements(ctx context.Context) (Entitlements, error) {
-	client := NewClient()
+// IterMachines returns an iterator over the license's machines.
+func (l *License) IterMachines(ctx context.Context, options ...ListOption) *MachineIterator {
+	client := clientOrDefault(l.client)
+	page := func() (interface{}, func() []interface{}) {
+		machines := Machines{}
+
+		return &machines, func() []interface{} {
+			items := make([]interface{}, len(machines))
+			for i := range machines {
+				machines[i].client = client
+				items[i] = &machines[i]
+			}
+
+			return items
+		}
+	}
+
+	return &MachineIterator{newIterator(ctx, client, "licenses/"+l.ID+"/machines", options, page)}
+}
+
+// Entitlements lists all entitlements for the license, fetching every page,
+// i.e. one request per page. Unlike earlier versions, which only listed the
+// first 100 entitlements, it doesn't truncate large lists, so use
+// IterEntitlements to process them a page at a time.
+func (l *License) Entitlements(ctx context.Context, options ...ListOption) (Entitlements, error) {
+	it := l.IterEntitlements(ctx, options...)
 	entitlements := Entitlements{}
 
-	if _, err := client.Get(ctx, "licenses/"+l.ID+"/entitlements", querystring{Limit: 100}, &entitlements); err != nil {
+	for it.Next() {
+		entitlements = append(entitlements, *it.Entitlement())
+	}
+
+	if err := it.Err(); err != nil {
 		return nil, err
 	}
 
 	return entitlements, nil
 }
 
+// IterEntitlements returns an iterator over the license's entitlements.
+func (l *License) IterEntitlements(ctx context.Context, options ...ListOption) *EntitlementIterator {
+	client := clientOrDefault(l.client)
+	page := func() (interface{}, func() []interface{}) {
+		entitlements := Entitlements{}
+
+		return &entitlements, func() []interface{} {
+			items := make([]interface{}, len(entitlements))
+			for i := range entitlements {
+				items[i] = &entitlements[i]
+			}
+
+			return items
+		}
+	}
+
+	return &EntitlementIterator{newIterator(ctx, client, "licenses/"+l.ID+"/entitlements", options, page)}
+}
+
 // Checkout generates an encrypted license file. Returns a LicenseFile.
 func (l *License) Checkout(ctx context.Context, options ...CheckoutOption) (*LicenseFile, error) {
-	client := NewClient()
+	client := clientOrDefault(l.client)
 	lic := &LicenseFile{}
 
 	opts := CheckoutOptions{Encrypt: true, Include: "entitlements"}
@@ -235,5 +348,7 @@ func (l *License) Checkout(ctx context.Context, options ...CheckoutOption) (*Lic
 		return nil, err
 	}
 
+	lic.client = client
+
 	return lic, nil
 }
@@ -3,6 +3,7 @@ package keygen
 import (
 	"encoding/base64"
 	"encoding/json"
+	"io"
 	"strings"
 	"time"
 
@@ -18,6 +19,8 @@ type LicenseFile struct {
 	Expiry      time.Time `json:"expiry"`
 	TTL         int       `json:"ttl"`
 	LicenseID   string    `json:"-"`
+
+	client *Client `json:"-"`
 }
 
 // SetID implements the jsonapi.UnmarshalResourceIdentifier interface.
@@ -49,7 +52,8 @@ func (lic *LicenseFile) SetRelationships(relationships map[string]interface{}) e
 // Decrypt verifies the license file's signature. It returns any errors
 // that occurred during verification, e.g. ErrLicenseFileInvalid.
 func (lic *LicenseFile) Verify() error {
-	verifier := &verifier{PublicKey: PublicKey}
+	client := clientOrDefault(lic.client)
+	verifier := &verifier{PublicKey: client.PublicKey, RSAPublicKey: client.RSAPublicKey}
 
 	if err := verifier.VerifyLicenseFile(lic); err != nil {
 		return &LicenseFileError{err}
@@ -60,16 +64,14 @@ func (lic *LicenseFile) Verify() error {
 
 // Decrypt decrypts the license file's encrypted dataset. It returns the decrypted dataset
 // and any errors that occurred during decryption, e.g. ErrLicenseFileNotEncrypted.
+// Use Dataset to handle both encrypted and unencrypted files.
 func (lic *LicenseFile) Decrypt(key string) (*LicenseFileDataset, error) {
 	cert, err := lic.certificate()
 	if err != nil {
 		return nil, err
 	}
 
-	switch {
-	case cert.Alg == "aes-256-gcm+rsa-pss-sha256" || cert.Alg == "aes-256-gcm+rsa-sha256":
-		return nil, ErrLicenseFileNotSupported
-	case cert.Alg != "aes-256-gcm+ed25519":
+	if !strings.HasPrefix(cert.Alg, "aes-256-gcm+") {
 		return nil, ErrLicenseFileNotEncrypted
 	}
 
@@ -80,6 +82,56 @@ func (lic *LicenseFile) Decrypt(key string) (*LicenseFileDataset, error) {
 		return nil, &LicenseFileError{err}
 	}
 
+	return lic.dataset(data)
+}
+
+// Decode decodes the license file's unencrypted dataset, i.e. a file checked out
+// without encryption. It returns the decoded dataset and any errors that occurred
+// during decoding, e.g. ErrLicenseFileSecretMissing for an encrypted license file.
+func (lic *LicenseFile) Decode() (*LicenseFileDataset, error) {
+	cert, err := lic.certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(cert.Alg, "aes-256-gcm+"):
+		return nil, ErrLicenseFileSecretMissing
+	case !strings.HasPrefix(cert.Alg, "base64+"):
+		return nil, ErrLicenseFileNotSupported
+	}
+
+	data, err := base64.StdEncoding.DecodeString(cert.Enc)
+	if err != nil {
+		return nil, &LicenseFileError{err}
+	}
+
+	return lic.dataset(data)
+}
+
+// Dataset returns the license file's dataset, decrypting it using the key when the
+// license file is encrypted, and decoding it otherwise. The key is ignored for an
+// unencrypted license file.
+func (lic *LicenseFile) Dataset(key string) (*LicenseFileDataset, error) {
+	cert, err := lic.certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(cert.Alg, "aes-256-gcm+") {
+		return lic.Decode()
+	}
+
+	if key == "" {
+		return nil, ErrLicenseFileSecretMissing
+	}
+
+	return lic.Decrypt(key)
+}
+
+// dataset unmarshals the license file's decrypted or decoded dataset, and checks
+// its issued and expiry timestamps.
+func (lic *LicenseFile) dataset(data []byte) (*LicenseFileDataset, error) {
 	// Unmarshal
 	dataset := &LicenseFileDataset{}
 
@@ -91,13 +143,39 @@ func (lic *LicenseFile) Decrypt(key string) (*LicenseFileDataset, error) {
 		return dataset, ErrSystemClockUnsynced
 	}
 
-	if dataset.TTL != 0 && time.Now().After(dataset.Expiry) {
+	client := clientOrDefault(lic.client)
+
+	// Only a genuine file's issued timestamp can be trusted
+	if client.clock() != nil && lic.Verify() == nil {
+		client.observe(dataset.Issued)
+	}
+
+	now, err := client.now()
+	if err != nil {
+		return dataset, err
+	}
+
+	if dataset.TTL != 0 && now.After(dataset.Expiry) {
 		return dataset, ErrLicenseFileExpired
 	}
 
 	return dataset, nil
 }
 
+// Save atomically writes the license file's certificate to the path, readable and
+// writable by the current user only. Use LoadLicenseFile to load it.
+func (lic *LicenseFile) Save(path string) error {
+	return writeFile(path, []byte(lic.Certificate))
+}
+
+// WriteTo writes the license file's certificate to the writer. It implements the
+// io.WriterTo interface.
+func (lic *LicenseFile) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, lic.Certificate)
+
+	return int64(n), err
+}
+
 func (lic *LicenseFile) certificate() (*certificate, error) {
 	payload := strings.TrimSpace(lic.Certificate)
 
@@ -121,13 +199,20 @@ func (lic *LicenseFile) certificate() (*certificate, error) {
 	return cert, nil
 }
 
-// LicenseFileDataset represents a decrypted license file object.
+// LicenseFileDataset represents a decrypted license file object. Its related
+// resources, e.g. Policy and User, are only set when they were included at
+// checkout, e.g. using CheckoutInclude(IncludeCodePolicy, IncludeCodeOwner).
 type LicenseFileDataset struct {
-	License      License      `json:"-"`
-	Entitlements Entitlements `json:"-"`
-	Issued       time.Time    `json:"issued"`
-	Expiry       time.Time    `json:"expiry"`
-	TTL          int          `json:"ttl"`
+	License      License        `json:"-"`
+	Entitlements Entitlements   `json:"-"`
+	Policy       *Policy        `json:"-"`
+	Product      *ProductObject `json:"-"`
+	User         *User          `json:"-"`
+	Group        *Group         `json:"-"`
+	Machines     Machines       `json:"-"`
+	Issued       time.Time      `json:"issued"`
+	Expiry       time.Time      `json:"expiry"`
+	TTL          int            `json:"ttl"`
 }
 
 // SetData implements the jsonapi.UnmarshalData interface.
@@ -142,6 +227,9 @@ func (lic *LicenseFileDataset) SetMeta(to func(target interface{}) error) error
 
 // SetIncluded implements jsonapi.UnmarshalIncluded interface.
 func (lic *LicenseFileDataset) SetIncluded(relationships []*jsonapi.ResourceObject, unmarshal func(res *jsonapi.ResourceObject, target interface{}) error) error {
+	var users []*User
+	var groups []*Group
+
 	for _, relationship := range relationships {
 		switch relationship.Type {
 		case "entitlements":
@@ -151,6 +239,55 @@ func (lic *LicenseFileDataset) SetIncluded(relationships []*jsonapi.ResourceObje
 			}
 
 			lic.Entitlements = append(lic.Entitlements, *entitlement)
+		case "policies":
+			policy := &Policy{}
+			if err := unmarshal(relationship, policy); err != nil {
+				return err
+			}
+
+			lic.Policy = policy
+		case "products":
+			product := &ProductObject{}
+			if err := unmarshal(relationship, product); err != nil {
+				return err
+			}
+
+			lic.Product = product
+		case "users":
+			user := &User{}
+			if err := unmarshal(relationship, user); err != nil {
+				return err
+			}
+
+			users = append(users, user)
+		case "groups":
+			group := &Group{}
+			if err := unmarshal(relationship, group); err != nil {
+				return err
+			}
+
+			groups = append(groups, group)
+		case "machines":
+			machine := &Machine{}
+			if err := unmarshal(relationship, machine); err != nil {
+				return err
+			}
+
+			lic.Machines = append(lic.Machines, *machine)
+		}
+	}
+
+	// Other users and groups may be included, e.g. a machine's owner, so only
+	// keep the license's
+	for _, user := range users {
+		if user.ID == lic.License.UserID {
+			lic.User = user
+		}
+	}
+
+	for _, group := range groups {
+		if group.ID == lic.License.GroupID {
+			lic.Group = group
 		}
 	}
 
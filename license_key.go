@@ -0,0 +1,126 @@
+package keygen
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// rsaKeySize is the size, in bytes, of the RSA schemes' 2048-bit keys, and so
+// of their signatures and ciphertexts.
+const rsaKeySize = 256
+
+// LicenseKeyDataset represents the standard shape of a signed license key's
+// dataset. Use your own type with VerifyLicenseKey to decode other datasets.
+type LicenseKeyDataset struct {
+	Issued       *time.Time             `json:"issued,omitempty"`
+	Expiry       *time.Time             `json:"expiry,omitempty"`
+	Entitlements []string               `json:"entitlements,omitempty"`
+	Policy       string                 `json:"policy,omitempty"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// VerifyLicenseKey verifies a signed license key offline, using your PublicKey,
+// or your RSAPublicKey for an RSA scheme, without a License object or any
+// network requests. The signing scheme is detected from the key's format. The
+// key's JSON dataset is decoded into v, e.g. a *LicenseKeyDataset, which may
+// be nil. An error will be returned if the key is not genuine, or if its
+// dataset has an expiry in the past or an issued timestamp in the future, e.g.
+// ErrLicenseKeyNotGenuine, ErrLicenseKeyExpired or ErrSystemClockUnsynced. In
+// the latter cases, v is still decoded.
+func VerifyLicenseKey(key string, v interface{}) error {
+	client := NewClient()
+
+	return client.VerifyLicenseKey(key, v)
+}
+
+// VerifyLicenseKey verifies a signed license key offline, using the client's
+// PublicKey, or the client's RSAPublicKey for an RSA scheme. See the top-level
+// VerifyLicenseKey for more info.
+func (c *Client) VerifyLicenseKey(key string, v interface{}) error {
+	schemes, err := detectSchemes(key)
+	if err != nil {
+		return err
+	}
+
+	verifier := &verifier{PublicKey: c.PublicKey, RSAPublicKey: c.RSAPublicKey}
+
+	// A signed key's format doesn't distinguish the RSA padding, so try each
+	// candidate scheme until one verifies.
+	var data []byte
+	for _, scheme := range schemes {
+		data, err = verifier.VerifyLicense(&License{Key: key, Scheme: scheme})
+		if err != ErrLicenseKeyNotGenuine {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	dataset := &LicenseKeyDataset{}
+	if err := json.Unmarshal(data, dataset); err != nil {
+		return ErrLicenseKeyDatasetInvalid
+	}
+
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			return ErrLicenseKeyDatasetInvalid
+		}
+	}
+
+	if MaxClockDrift >= 0 && dataset.Issued != nil && time.Until(*dataset.Issued) > MaxClockDrift {
+		return ErrSystemClockUnsynced
+	}
+
+	now, err := c.now()
+	if err != nil {
+		return err
+	}
+
+	if dataset.Expiry != nil && now.After(*dataset.Expiry) {
+		return ErrLicenseKeyExpired
+	}
+
+	return nil
+}
+
+// detectSchemes detects a license key's candidate signing schemes from its
+// format, i.e. the size of its signature or ciphertext.
+func detectSchemes(key string) ([]SchemeCode, error) {
+	if key == "" {
+		return nil, ErrLicenseKeyMissing
+	}
+
+	// Signed keys are formatted key/{dataset}.{signature}
+	if strings.HasPrefix(key, "key/") {
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 {
+			return nil, ErrLicenseNotSigned
+		}
+
+		sig, err := base64.URLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, ErrLicenseKeyNotGenuine
+		}
+
+		switch len(sig) {
+		case ed25519.SignatureSize:
+			return []SchemeCode{SchemeCodeEd25519}, nil
+		case rsaKeySize:
+			return []SchemeCode{SchemeCodeRSAPKCS1Sign, SchemeCodeRSAPSSSign}, nil
+		default:
+			return nil, ErrLicenseKeyNotGenuine
+		}
+	}
+
+	// Encrypted keys are the ciphertext of the dataset
+	if ciphertext, err := base64.URLEncoding.DecodeString(key); err == nil && len(ciphertext) == rsaKeySize {
+		return []SchemeCode{SchemeCodeRSAPKCS1Encrypt}, nil
+	}
+
+	return nil, ErrLicenseNotSigned
+}
@@ -17,14 +17,17 @@ const (
 )
 
 type machine struct {
-	ID          string     `json:"-"`
-	Type        string     `json:"-"`
-	Fingerprint string     `json:"fingerprint"`
-	Hostname    string     `json:"hostname"`
-	Platform    string     `json:"platform"`
-	Cores       int        `json:"cores"`
-	LicenseID   string     `json:"-"`
-	Components  Components `json:"-"`
+	ID          string                 `json:"-"`
+	Type        string                 `json:"-"`
+	Name        string                 `json:"name,omitempty"`
+	Fingerprint string                 `json:"fingerprint"`
+	Hostname    string                 `json:"hostname"`
+	Platform    string                 `json:"platform"`
+	IP          string                 `json:"ip,omitempty"`
+	Cores       int                    `json:"cores"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	LicenseID   string                 `json:"-"`
+	Components  Components             `json:"-"`
 }
 
 // GetID implements the jsonapi.MarshalResourceIdentifier interface.
@@ -58,6 +61,29 @@ func (m machine) GetRelationships() map[string]interface{} {
 	return relationships
 }
 
+// machineUpdate is a machine's updatable attributes. Only non-nil attributes
+// are sent, so that an update doesn't overwrite the machine's other attrs.
+type machineUpdate struct {
+	ID       string                  `json:"-"`
+	Name     *string                 `json:"name,omitempty"`
+	Metadata *map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// GetID implements the jsonapi.MarshalResourceIdentifier interface.
+func (m machineUpdate) GetID() string {
+	return m.ID
+}
+
+// GetType implements the jsonapi.MarshalResourceIdentifier interface.
+func (m machineUpdate) GetType() string {
+	return "machines"
+}
+
+// GetData implements the jsonapi.MarshalData interface.
+func (m machineUpdate) GetData() interface{} {
+	return m
+}
+
 // Machine represents a Keygen machine object.
 type Machine struct {
 	ID                string                 `json:"-"`
@@ -77,6 +103,7 @@ type Machine struct {
 	LicenseID         string                 `json:"-"`
 
 	components []Component `json:"-"`
+	client     *Client     `json:"-"`
 }
 
 // GetID implements the jsonapi.MarshalResourceIdentifier interface.
@@ -93,10 +120,13 @@ func (m Machine) GetType() string {
 func (m Machine) GetData() interface{} {
 	// Transform public machine to private machine to only send a subset of attrs
 	return machine{
+		Name:        m.Name,
 		Fingerprint: m.Fingerprint,
 		Hostname:    m.Hostname,
 		Platform:    m.Platform,
+		IP:          m.IP,
 		Cores:       m.Cores,
+		Metadata:    m.Metadata,
 		LicenseID:   m.LicenseID,
 		Components:  m.components,
 	}
@@ -127,10 +157,45 @@ func (m *Machines) SetData(to func(target interface{}) error) error {
 	return to(m)
 }
 
+// MachineIterator iterates over a paginated list of machines. Pages are fetched
+// as needed, and iteration stops on the first error.
+type MachineIterator struct{ iterator }
+
+// Next advances the iterator to the next machine, returning false when there
+// are no more machines or an error occurred.
+func (it *MachineIterator) Next() bool {
+	return it.advance()
+}
+
+// Machine returns the current machine.
+func (it *MachineIterator) Machine() *Machine {
+	if it.item == nil {
+		return nil
+	}
+
+	return it.item.(*Machine)
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *MachineIterator) Err() error {
+	return it.err
+}
+
+// FilterMachineFingerprint filters a list of machines by fingerprint.
+func FilterMachineFingerprint(fingerprint string) ListOption {
+	return ListFilter("fingerprint", fingerprint)
+}
+
+// FilterMachineHeartbeatStatus filters a list of machines by heartbeat status,
+// e.g. HeartbeatStatusCodeDead.
+func FilterMachineHeartbeatStatus(status HeartbeatStatusCode) ListOption {
+	return ListFilter("status", string(status))
+}
+
 // Deactivate performs a machine deactivation for the current Machine. An error
 // will be returned if the machine deactivation fails.
 func (m *Machine) Deactivate(ctx context.Context) error {
-	client := NewClient()
+	client := clientOrDefault(m.client)
 
 	if _, err := client.Delete(ctx, "machines/"+m.ID, nil, nil); err != nil {
 		return err
@@ -139,31 +204,42 @@ func (m *Machine) Deactivate(ctx context.Context) error {
 	return nil
 }
 
-// Monitor performs, on a loop, a machine hearbeat ping for the current Machine. An
-// error channel will be returned, where any ping errors will be emitted. Pings are
-// sent according to the machine's required heartbeat window, minus 30 seconds to
-// account for any network lag. Panics if a heartbeat ping fails after first ping.
-func (m *Machine) Monitor(ctx context.Context) error {
-	if err := m.ping(ctx); err != nil {
-		return err
+// UpdateName updates the current Machine's name. An error will be returned
+// if the update fails.
+func (m *Machine) UpdateName(ctx context.Context, name string) error {
+	return m.update(ctx, machineUpdate{ID: m.ID, Name: &name})
+}
+
+// UpdateMetadata replaces the current Machine's metadata. A nil metadata
+// clears it. An error will be returned if the update fails.
+func (m *Machine) UpdateMetadata(ctx context.Context, metadata map[string]interface{}) error {
+	if metadata == nil {
+		metadata = map[string]interface{}{}
 	}
 
-	go func() {
-		t := (time.Duration(m.HeartbeatDuration) * time.Second) - (30 * time.Second)
+	return m.update(ctx, machineUpdate{ID: m.ID, Metadata: &metadata})
+}
 
-		for range time.Tick(t) {
-			if err := m.ping(ctx); err != nil {
-				panic(err)
-			}
-		}
-	}()
+func (m *Machine) update(ctx context.Context, params machineUpdate) error {
+	client := clientOrDefault(m.client)
+
+	// Unmarshal into a new machine, so that e.g. removed metadata keys aren't
+	// merged with the machine's current metadata
+	machine := &Machine{}
+	if _, err := client.Patch(ctx, "machines/"+m.ID, params, machine); err != nil {
+		return err
+	}
+
+	machine.components = m.components
+	machine.client = m.client
+	*m = *machine
 
 	return nil
 }
 
 // Checkout generates an encrypted machine file. Returns a MachineFile.
 func (m *Machine) Checkout(ctx context.Context, options ...CheckoutOption) (*MachineFile, error) {
-	client := NewClient()
+	client := clientOrDefault(m.client)
 	license := &License{}
 	lic := &MachineFile{}
 
@@ -182,30 +258,172 @@ func (m *Machine) Checkout(ctx context.Context, options ...CheckoutOption) (*Mac
 		return nil, err
 	}
 
+	lic.client = client
+
 	return lic, nil
 }
 
-// Components lists up to 100 components for the machine.
-func (m *Machine) Components(ctx context.Context) (Components, error) {
-	client := NewClient()
+// Components lists all components for the machine, fetching every page, i.e.
+// one request per page. Unlike earlier versions, which only listed the first
+// 100 components, it doesn't truncate large lists, so use IterComponents to
+// process them a page at a time.
+func (m *Machine) Components(ctx context.Context, options ...ListOption) (Components, error) {
+	it := m.IterComponents(ctx, options...)
 	components := Components{}
 
-	if _, err := client.Get(ctx, "machines/"+m.ID+"/components", querystring{Limit: 100}, &components); err != nil {
+	for it.Next() {
+		components = append(components, *it.Component())
+	}
+
+	if err := it.Err(); err != nil {
 		return nil, err
 	}
 
 	return components, nil
 }
 
+// IterComponents returns an iterator over the machine's components.
+func (m *Machine) IterComponents(ctx context.Context, options ...ListOption) *ComponentIterator {
+	client := clientOrDefault(m.client)
+	page := func() (interface{}, func() []interface{}) {
+		components := Components{}
+
+		return &components, func() []interface{} {
+			items := make([]interface{}, len(components))
+			for i := range components {
+				items[i] = &components[i]
+			}
+
+			return items
+		}
+	}
+
+	return &ComponentIterator{newIterator(ctx, client, "machines/"+m.ID+"/components", options, page)}
+}
+
+// AddComponent adds a component to the current Machine. If successful, the
+// new Component will be returned. When unsuccessful, an error will be
+// returned, e.g. ErrComponentAlreadyActivated when the component's fingerprint
+// is already in use.
+func (m *Machine) AddComponent(ctx context.Context, component Component) (*Component, error) {
+	client := clientOrDefault(m.client)
+	params := &Component{
+		Fingerprint: component.Fingerprint,
+		Name:        component.Name,
+		Metadata:    component.Metadata,
+		MachineID:   m.ID,
+	}
+
+	created := &Component{}
+	if _, err := client.Post(ctx, "components", params, created); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// RemoveComponent removes the component, identified by the provided id, from
+// the current Machine. An error will be returned if the removal fails.
+func (m *Machine) RemoveComponent(ctx context.Context, id string) error {
+	client := clientOrDefault(m.client)
+
+	if _, err := client.Delete(ctx, "components/"+id, nil, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SyncComponents diffs the provided components against the current Machine's
+// components, by fingerprint, adding the missing components and then removing
+// the stale ones, e.g. after a disk was swapped. The changes made are returned,
+// even when an error is returned, e.g. ErrComponentAlreadyActivated. Stale
+// components aren't removed unless every missing component was added. An
+// ErrComponentConflict error will be returned, before any changes are made,
+// if the provided components have duplicate fingerprints.
+func (m *Machine) SyncComponents(ctx context.Context, components ...Component) (*ComponentChanges, error) {
+	local := map[string]bool{}
+	for _, component := range components {
+		if local[component.Fingerprint] {
+			return nil, ErrComponentConflict
+		}
+
+		local[component.Fingerprint] = true
+	}
+
+	existing, err := m.Components(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := map[string]bool{}
+	for _, component := range existing {
+		remote[component.Fingerprint] = true
+	}
+
+	changes := &ComponentChanges{Added: Components{}, Removed: Components{}}
+
+	for _, component := range components {
+		if remote[component.Fingerprint] {
+			continue
+		}
+
+		created, err := m.AddComponent(ctx, component)
+		if err != nil {
+			return changes, err
+		}
+
+		changes.Added = append(changes.Added, *created)
+	}
+
+	for _, component := range existing {
+		if local[component.Fingerprint] {
+			continue
+		}
+
+		if err := m.RemoveComponent(ctx, component.ID); err != nil {
+			return changes, err
+		}
+
+		changes.Removed = append(changes.Removed, component)
+	}
+
+	return changes, nil
+}
+
+// SpawnOptions stores config options used when spawning a process.
+type SpawnOptions struct {
+	// Metadata is the new process's metadata, if any.
+	Metadata map[string]interface{}
+
+	// Interval is the interval between the process's heartbeat pings. See
+	// MonitorOptions.Interval for the default.
+	Interval time.Duration
+
+	// OnError is called for each failed heartbeat ping, and when killing the
+	// process fails after its context is canceled. It is called from one of
+	// the heartbeat scheduler's workers, so it should not block.
+	OnError func(error)
+}
+
 // Spawn creates a new process for a machine, identified by the provided pid. If
 // successful, the new Process will be returned. When unsuccessful, as error
-// will be returned, e.g. ErrProcessLimitExceeded. Automatically starts a loop
-// that sends heartbeat pings according to the process's Interval. Panics if a
-// heartbeat ping fails after first ping.
+// will be returned, e.g. ErrProcessLimitExceeded. Automatically starts a
+// monitor that sends heartbeat pings according to the process's Interval,
+// until the process is stopped or killed. When ctx is canceled, the process is
+// killed. Use SpawnWithOptions to handle ping errors.
 func (m *Machine) Spawn(ctx context.Context, pid string) (*Process, error) {
-	client := NewClient()
+	return m.SpawnWithOptions(ctx, pid, SpawnOptions{})
+}
+
+// SpawnWithOptions creates a new process for a machine, identified by the
+// provided pid, using the provided options, e.g. its metadata. See Spawn for
+// more info.
+func (m *Machine) SpawnWithOptions(ctx context.Context, pid string, options SpawnOptions) (*Process, error) {
+	client := clientOrDefault(m.client)
 	params := &Process{
 		Pid:       pid,
+		Metadata:  options.Metadata,
 		MachineID: m.ID,
 	}
 
@@ -214,27 +432,56 @@ func (m *Machine) Spawn(ctx context.Context, pid string) (*Process, error) {
 		return nil, err
 	}
 
-	if err := process.monitor(ctx); err != nil {
+	process.client = client
+
+	if err := process.monitor(ctx, MonitorOptions{Interval: options.Interval, OnError: options.OnError}); err != nil {
 		return process, err
 	}
 
 	return process, nil
 }
 
-// Processes lists up to 100 processes for the machine.
-func (m *Machine) Processes(ctx context.Context) (Processes, error) {
-	client := NewClient()
+// Processes lists all processes for the machine, fetching every page, i.e. one
+// request per page. Unlike earlier versions, which only listed the first 100
+// processes, it doesn't truncate large lists, so use IterProcesses to process
+// them a page at a time.
+func (m *Machine) Processes(ctx context.Context, options ...ListOption) (Processes, error) {
+	it := m.IterProcesses(ctx, options...)
 	processes := Processes{}
 
-	if _, err := client.Get(ctx, "machines/"+m.ID+"/processes", querystring{Limit: 100}, &processes); err != nil {
+	for it.Next() {
+		processes = append(processes, *it.Process())
+	}
+
+	if err := it.Err(); err != nil {
 		return nil, err
 	}
 
 	return processes, nil
 }
 
+// IterProcesses returns an iterator over the machine's processes.
+func (m *Machine) IterProcesses(ctx context.Context, options ...ListOption) *ProcessIterator {
+	client := clientOrDefault(m.client)
+	page := func() (interface{}, func() []interface{}) {
+		processes := Processes{}
+
+		return &processes, func() []interface{} {
+			items := make([]interface{}, len(processes))
+			for i := range processes {
+				processes[i].client = client
+				items[i] = &processes[i]
+			}
+
+			return items
+		}
+	}
+
+	return &ProcessIterator{newIterator(ctx, client, "machines/"+m.ID+"/processes", options, page)}
+}
+
 func (m *Machine) ping(ctx context.Context) error {
-	client := NewClient()
+	client := clientOrDefault(m.client)
 
 	if _, err := client.Post(ctx, "machines/"+m.ID+"/actions/ping", nil, m); err != nil {
 		return err
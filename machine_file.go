@@ -3,6 +3,7 @@ package keygen
 import (
 	"encoding/base64"
 	"encoding/json"
+	"io"
 	"strings"
 	"time"
 
@@ -19,6 +20,8 @@ type MachineFile struct {
 	TTL         int       `json:"ttl"`
 	MachineID   string    `json:"-"`
 	LicenseID   string    `json:"-"`
+
+	client *Client `json:"-"`
 }
 
 // SetID implements the jsonapi.UnmarshalResourceIdentifier interface.
@@ -54,7 +57,8 @@ func (lic *MachineFile) SetRelationships(relationships map[string]interface{}) e
 // Decrypt verifies the machine file's signature. It returns any errors
 // that occurred during verification, e.g. ErrMachineFileInvalid.
 func (lic *MachineFile) Verify() error {
-	verifier := &verifier{PublicKey: PublicKey}
+	client := clientOrDefault(lic.client)
+	verifier := &verifier{PublicKey: client.PublicKey, RSAPublicKey: client.RSAPublicKey}
 
 	if err := verifier.VerifyMachineFile(lic); err != nil {
 		return &MachineFileError{err}
@@ -65,16 +69,14 @@ func (lic *MachineFile) Verify() error {
 
 // Decrypt decrypts the machine file's encrypted dataset. It returns the decrypted dataset
 // and any errors that occurred during decryption, e.g. ErrMachineFileNotEncrypted.
+// Use Dataset to handle both encrypted and unencrypted files.
 func (lic *MachineFile) Decrypt(key string) (*MachineFileDataset, error) {
 	cert, err := lic.certificate()
 	if err != nil {
 		return nil, err
 	}
 
-	switch {
-	case cert.Alg == "aes-256-gcm+rsa-pss-sha256" || cert.Alg == "aes-256-gcm+rsa-sha256":
-		return nil, ErrMachineFileNotSupported
-	case cert.Alg != "aes-256-gcm+ed25519":
+	if !strings.HasPrefix(cert.Alg, "aes-256-gcm+") {
 		return nil, ErrMachineFileNotEncrypted
 	}
 
@@ -85,6 +87,56 @@ func (lic *MachineFile) Decrypt(key string) (*MachineFileDataset, error) {
 		return nil, &MachineFileError{err}
 	}
 
+	return lic.dataset(data)
+}
+
+// Decode decodes the machine file's unencrypted dataset, i.e. a file checked out
+// without encryption. It returns the decoded dataset and any errors that occurred
+// during decoding, e.g. ErrMachineFileSecretMissing for an encrypted machine file.
+func (lic *MachineFile) Decode() (*MachineFileDataset, error) {
+	cert, err := lic.certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(cert.Alg, "aes-256-gcm+"):
+		return nil, ErrMachineFileSecretMissing
+	case !strings.HasPrefix(cert.Alg, "base64+"):
+		return nil, ErrMachineFileNotSupported
+	}
+
+	data, err := base64.StdEncoding.DecodeString(cert.Enc)
+	if err != nil {
+		return nil, &MachineFileError{err}
+	}
+
+	return lic.dataset(data)
+}
+
+// Dataset returns the machine file's dataset, decrypting it using the key when the
+// machine file is encrypted, and decoding it otherwise. The key is ignored for an
+// unencrypted machine file.
+func (lic *MachineFile) Dataset(key string) (*MachineFileDataset, error) {
+	cert, err := lic.certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(cert.Alg, "aes-256-gcm+") {
+		return lic.Decode()
+	}
+
+	if key == "" {
+		return nil, ErrMachineFileSecretMissing
+	}
+
+	return lic.Decrypt(key)
+}
+
+// dataset unmarshals the machine file's decrypted or decoded dataset, and checks
+// its issued and expiry timestamps.
+func (lic *MachineFile) dataset(data []byte) (*MachineFileDataset, error) {
 	// Unmarshal
 	dataset := &MachineFileDataset{}
 
@@ -96,13 +148,187 @@ func (lic *MachineFile) Decrypt(key string) (*MachineFileDataset, error) {
 		return dataset, ErrSystemClockUnsynced
 	}
 
-	if dataset.TTL != 0 && time.Now().After(dataset.Expiry) {
+	client := clientOrDefault(lic.client)
+
+	// Only a genuine file's issued timestamp can be trusted
+	if client.clock() != nil && lic.Verify() == nil {
+		client.observe(dataset.Issued)
+	}
+
+	now, err := client.now()
+	if err != nil {
+		return dataset, err
+	}
+
+	if dataset.TTL != 0 && now.After(dataset.Expiry) {
 		return dataset, ErrMachineFileExpired
 	}
 
 	return dataset, nil
 }
 
+// Validate performs an offline validation of the machine file, scoped to the
+// provided options, e.g. ValidateFingerprint and ValidateComponents. It verifies
+// the machine file's signature, decrypts it using the license key and the
+// fingerprint (or decodes it, when unencrypted), and then checks the dataset the
+// same way an online validation would: the machine's fingerprint, its components
+// using the policy's ComponentMatchingStrategy (MATCH_ANY unless the policy was
+// included), and the license's expiry (when the license was included). It
+// returns the dataset, with the result stored in the dataset license's
+// LastValidation, and the same errors as an online validation if the machine
+// file is invalid, e.g. ErrLicenseNotActivated, ErrLicenseExpired,
+// ErrMachineFileExpired or ErrSystemClockUnsynced. Use the dataset license's
+// LastValidationError for details. A machine file that can't be decrypted using
+// the key and fingerprint is a fingerprint mismatch, while a malformed one is
+// a *MachineFileError wrapping ErrFileFormatInvalid. Other errors, e.g.
+// ErrMachineFileNotGenuine, are returned as-is.
+func (lic *MachineFile) Validate(key string, options ...ValidateOption) (*MachineFileDataset, error) {
+	opts := ValidateOptions{}
+	for _, opt := range options {
+		if err := opt(&opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := lic.Verify(); err != nil {
+		return nil, err
+	}
+
+	dataset, code, detail, err := lic.validate(key, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := ValidationResult{
+		Valid:  code == ValidationCodeValid,
+		Code:   code,
+		Detail: detail,
+		Scope: &ValidationScope{
+			scope{Fingerprint: opts.Fingerprint, Components: opts.Components},
+		},
+	}
+
+	if dataset == nil {
+		return nil, validationErr(result.Code)
+	}
+
+	// Store last validation result
+	dataset.License.LastValidation = &result
+
+	if result.Valid {
+		return dataset, nil
+	}
+
+	return dataset, validationErr(result.Code)
+}
+
+// validate decrypts or decodes the machine file's dataset and checks it against
+// the options, returning the dataset, if any, and the validation code and detail.
+func (lic *MachineFile) validate(key string, opts ValidateOptions) (*MachineFileDataset, ValidationCode, string, error) {
+	if opts.Fingerprint == "" {
+		return nil, ValidationCodeFingerprintScopeRequired, "fingerprint scope is required", nil
+	}
+
+	cert, err := lic.certificate()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	var dataset *MachineFileDataset
+
+	if strings.HasPrefix(cert.Alg, "aes-256-gcm+") {
+		if key == "" {
+			return nil, "", "", ErrMachineFileSecretMissing
+		}
+
+		// The secret includes the machine's fingerprint, so the dataset can't be
+		// decrypted using another fingerprint
+		decryptor := &decryptor{key + opts.Fingerprint}
+		data, err := decryptor.DecryptCertificate(cert)
+		switch {
+		case err == errDecryptionFailed:
+			return nil, ValidationCodeFingerprintScopeMismatch, "fingerprint scope does not match", nil
+		case err != nil:
+			return nil, "", "", &MachineFileError{err}
+		}
+
+		dataset, err = lic.dataset(data)
+		if err != nil {
+			return lic.invalid(dataset, err)
+		}
+	} else {
+		dataset, err = lic.Decode()
+		if err != nil {
+			return lic.invalid(dataset, err)
+		}
+	}
+
+	if dataset.Machine.Fingerprint != opts.Fingerprint {
+		return dataset, ValidationCodeFingerprintScopeMismatch, "fingerprint scope does not match", nil
+	}
+
+	now, err := clientOrDefault(lic.client).now()
+	if err != nil {
+		return lic.invalid(dataset, err)
+	}
+
+	if dataset.License.Expiry != nil && now.After(*dataset.License.Expiry) {
+		return dataset, ValidationCodeExpired, "is expired", nil
+	}
+
+	if len(opts.Components) > 0 {
+		fingerprints := make(map[string]bool, len(dataset.Components))
+		for _, component := range dataset.Components {
+			fingerprints[component.Fingerprint] = true
+		}
+
+		matched := 0
+		for _, fingerprint := range opts.Components {
+			if fingerprints[fingerprint] {
+				matched++
+			}
+		}
+
+		var strategy ComponentMatchingStrategy
+		if dataset.Policy != nil {
+			strategy = dataset.Policy.ComponentMatchingStrategy
+		}
+
+		if !strategy.match(matched, len(opts.Components)) {
+			return dataset, ValidationCodeComponentsScopeMismatch, "one or more component is not activated (does not match any associated components)", nil
+		}
+	}
+
+	return dataset, ValidationCodeValid, "is valid", nil
+}
+
+// invalid maps an error from checking the machine file's dataset to its
+// validation code and detail. Other errors are returned as-is.
+func (lic *MachineFile) invalid(dataset *MachineFileDataset, err error) (*MachineFileDataset, ValidationCode, string, error) {
+	switch err {
+	case ErrSystemClockUnsynced:
+		return dataset, ValidationCodeClockUnsynced, "system clock is out of sync", nil
+	case ErrMachineFileExpired:
+		return dataset, ValidationCodeMachineFileExpired, "machine file is expired", nil
+	default:
+		return nil, "", "", err
+	}
+}
+
+// Save atomically writes the machine file's certificate to the path, readable and
+// writable by the current user only. Use LoadMachineFile to load it.
+func (lic *MachineFile) Save(path string) error {
+	return writeFile(path, []byte(lic.Certificate))
+}
+
+// WriteTo writes the machine file's certificate to the writer. It implements the
+// io.WriterTo interface.
+func (lic *MachineFile) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, lic.Certificate)
+
+	return int64(n), err
+}
+
 func (lic *MachineFile) certificate() (*certificate, error) {
 	payload := strings.TrimSpace(lic.Certificate)
 
@@ -126,15 +352,23 @@ func (lic *MachineFile) certificate() (*certificate, error) {
 	return cert, nil
 }
 
-// MachineFileDataset represents a decrypted machine file object.
+// MachineFileDataset represents a decrypted machine file object. Its related
+// resources, e.g. License and Policy, are only set when they were included at
+// checkout, e.g. using CheckoutInclude(IncludeCodeLicense, IncludeCodeLicensePolicy).
+// User and Group are the license's owner and group.
 type MachineFileDataset struct {
-	Machine      Machine      `json:"-"`
-	License      License      `json:"-"`
-	Entitlements Entitlements `json:"-"`
-	Components   Components   `json:"-"`
-	Issued       time.Time    `json:"issued"`
-	Expiry       time.Time    `json:"expiry"`
-	TTL          int          `json:"ttl"`
+	Machine      Machine        `json:"-"`
+	License      License        `json:"-"`
+	Entitlements Entitlements   `json:"-"`
+	Components   Components     `json:"-"`
+	Policy       *Policy        `json:"-"`
+	Product      *ProductObject `json:"-"`
+	User         *User          `json:"-"`
+	Group        *Group         `json:"-"`
+	Machines     Machines       `json:"-"`
+	Issued       time.Time      `json:"issued"`
+	Expiry       time.Time      `json:"expiry"`
+	TTL          int            `json:"ttl"`
 }
 
 // SetData implements the jsonapi.UnmarshalData interface.
@@ -149,6 +383,9 @@ func (lic *MachineFileDataset) SetMeta(to func(target interface{}) error) error
 
 // SetIncluded implements jsonapi.UnmarshalIncluded interface.
 func (lic *MachineFileDataset) SetIncluded(relationships []*jsonapi.ResourceObject, unmarshal func(res *jsonapi.ResourceObject, target interface{}) error) error {
+	var users []*User
+	var groups []*Group
+
 	for _, relationship := range relationships {
 		switch relationship.Type {
 		case "components":
@@ -172,6 +409,55 @@ func (lic *MachineFileDataset) SetIncluded(relationships []*jsonapi.ResourceObje
 			}
 
 			lic.License = *license
+		case "policies":
+			policy := &Policy{}
+			if err := unmarshal(relationship, policy); err != nil {
+				return err
+			}
+
+			lic.Policy = policy
+		case "products":
+			product := &ProductObject{}
+			if err := unmarshal(relationship, product); err != nil {
+				return err
+			}
+
+			lic.Product = product
+		case "users":
+			user := &User{}
+			if err := unmarshal(relationship, user); err != nil {
+				return err
+			}
+
+			users = append(users, user)
+		case "groups":
+			group := &Group{}
+			if err := unmarshal(relationship, group); err != nil {
+				return err
+			}
+
+			groups = append(groups, group)
+		case "machines":
+			machine := &Machine{}
+			if err := unmarshal(relationship, machine); err != nil {
+				return err
+			}
+
+			lic.Machines = append(lic.Machines, *machine)
+		}
+	}
+
+	// Other users and groups may be included, e.g. a machine's owner, so only
+	// keep the license's
+	for _, user := range users {
+		if user.ID == lic.License.UserID {
+			lic.User = user
+		}
+	}
+
+	for _, group := range groups {
+		if group.ID == lic.License.GroupID {
+			lic.Group = group
 		}
 	}
 
@@ -1,8 +1,11 @@
 package keygen
 
 import (
+	"net/url"
 	"strings"
 	"time"
+
+	"github.com/google/go-querystring/query"
 )
 
 type CheckoutOptions struct {
@@ -13,6 +16,32 @@ type CheckoutOptions struct {
 
 type CheckoutOption func(*CheckoutOptions) error
 
+// Relationships to include in a license file or a machine file's dataset at
+// checkout, using CheckoutInclude.
+const (
+	// License file includes
+	IncludeCodeEntitlements = "entitlements"
+	IncludeCodeProduct      = "product"
+	IncludeCodePolicy       = "policy"
+	IncludeCodeOwner        = "owner"
+	IncludeCodeUser         = "user"
+	IncludeCodeGroup        = "group"
+	IncludeCodeMachines     = "machines"
+
+	// Machine file includes
+	IncludeCodeLicense             = "license"
+	IncludeCodeLicenseEntitlements = "license.entitlements"
+	IncludeCodeLicenseProduct      = "license.product"
+	IncludeCodeLicensePolicy       = "license.policy"
+	IncludeCodeLicenseOwner        = "license.owner"
+	IncludeCodeLicenseUser         = "license.user"
+	IncludeCodeLicenseGroup        = "license.group"
+	IncludeCodeLicenseMachines     = "license.machines"
+	IncludeCodeComponents          = "components"
+)
+
+// CheckoutInclude sets the relationships to include in the checked out file's
+// dataset, e.g. IncludeCodeEntitlements.
 func CheckoutInclude(includes ...string) CheckoutOption {
 	return func(options *CheckoutOptions) error {
 		options.Include = strings.Join(includes, ",")
@@ -28,3 +57,299 @@ func CheckoutTTL(ttl time.Duration) CheckoutOption {
 		return nil
 	}
 }
+
+// ActivateOptions stores the attributes of a machine being activated. The
+// hostname, platform and cores default to the current machine's.
+type ActivateOptions struct {
+	// Name is the machine's human-readable name.
+	Name string
+
+	// Hostname is the machine's hostname. Defaults to os.Hostname.
+	Hostname string
+
+	// Platform is the machine's platform. Defaults to GOOS/GOARCH, e.g.
+	// linux/amd64.
+	Platform string
+
+	// Cores is the machine's number of CPU cores, used for core limits.
+	// Defaults to runtime.NumCPU. See AvailableCores for containers.
+	Cores int
+
+	// IP is the machine's IP address.
+	IP string
+
+	// Metadata is the machine's metadata.
+	Metadata map[string]interface{}
+
+	// Components are the machine's hardware components.
+	Components []Component
+}
+
+type ActivateOption func(*ActivateOptions) error
+
+func ActivateName(name string) ActivateOption {
+	return func(options *ActivateOptions) error {
+		options.Name = name
+
+		return nil
+	}
+}
+
+func ActivateHostname(hostname string) ActivateOption {
+	return func(options *ActivateOptions) error {
+		options.Hostname = hostname
+
+		return nil
+	}
+}
+
+func ActivatePlatform(platform string) ActivateOption {
+	return func(options *ActivateOptions) error {
+		options.Platform = platform
+
+		return nil
+	}
+}
+
+// ActivateCores sets the machine's number of CPU cores, e.g. AvailableCores().
+func ActivateCores(cores int) ActivateOption {
+	return func(options *ActivateOptions) error {
+		options.Cores = cores
+
+		return nil
+	}
+}
+
+func ActivateIP(ip string) ActivateOption {
+	return func(options *ActivateOptions) error {
+		options.IP = ip
+
+		return nil
+	}
+}
+
+func ActivateMetadata(metadata map[string]interface{}) ActivateOption {
+	return func(options *ActivateOptions) error {
+		options.Metadata = metadata
+
+		return nil
+	}
+}
+
+func ActivateComponents(components ...Component) ActivateOption {
+	return func(options *ActivateOptions) error {
+		options.Components = append(options.Components, components...)
+
+		return nil
+	}
+}
+
+// ValidateOptions stores the scopes used when validating a license. The API
+// asserts each scope that is set, and the validation fails with a scope code,
+// e.g. ENTITLEMENTS_MISSING, when a scope does not match.
+type ValidateOptions struct {
+	// Fingerprint is the machine fingerprint the license must be activated for.
+	Fingerprint string
+
+	// Components are the hardware component fingerprints the machine must have.
+	Components []string
+
+	// Entitlements are the entitlement codes the license must have.
+	Entitlements []string
+
+	// Policy is the ID of the policy the license must belong to.
+	Policy string
+
+	// Machine is the ID of the machine the license must be activated for.
+	Machine string
+
+	// User is the ID or email of the user the license must belong to.
+	User string
+
+	// Checksum is the checksum of a release artifact the license must be
+	// able to access, e.g. to assert the running binary is genuine.
+	Checksum string
+}
+
+type ValidateOption func(*ValidateOptions) error
+
+func ValidateFingerprint(fingerprint string) ValidateOption {
+	return func(options *ValidateOptions) error {
+		options.Fingerprint = fingerprint
+
+		return nil
+	}
+}
+
+func ValidateComponents(fingerprints ...string) ValidateOption {
+	return func(options *ValidateOptions) error {
+		options.Components = append(options.Components, fingerprints...)
+
+		return nil
+	}
+}
+
+func ValidateEntitlements(codes ...string) ValidateOption {
+	return func(options *ValidateOptions) error {
+		options.Entitlements = append(options.Entitlements, codes...)
+
+		return nil
+	}
+}
+
+func ValidatePolicy(id string) ValidateOption {
+	return func(options *ValidateOptions) error {
+		options.Policy = id
+
+		return nil
+	}
+}
+
+func ValidateMachine(id string) ValidateOption {
+	return func(options *ValidateOptions) error {
+		options.Machine = id
+
+		return nil
+	}
+}
+
+func ValidateUser(idOrEmail string) ValidateOption {
+	return func(options *ValidateOptions) error {
+		options.User = idOrEmail
+
+		return nil
+	}
+}
+
+func ValidateChecksum(checksum string) ValidateOption {
+	return func(options *ValidateOptions) error {
+		options.Checksum = checksum
+
+		return nil
+	}
+}
+
+// validateFingerprints converts positional fingerprints into validate options.
+// The first fingerprint is a machine fingerprint, and the rest are component
+// fingerprints.
+func validateFingerprints(fingerprints []string) []ValidateOption {
+	options := []ValidateOption{}
+	if n := len(fingerprints); n > 0 {
+		options = append(options, ValidateFingerprint(fingerprints[0]))
+
+		if n > 1 {
+			options = append(options, ValidateComponents(fingerprints[1:]...))
+		}
+	}
+
+	return options
+}
+
+// ListOptions stores options used when listing resources, e.g. pagination and
+// filters. Filters are sent as query parameters, e.g. status=ALIVE, while
+// sorting, sparse fieldsets and includes follow the JSON:API spec.
+type ListOptions struct {
+	// PageSize is the number of resources requested per page. Defaults to
+	// 100, the maximum allowed by the API.
+	PageSize int
+
+	// PageNumber is the page to start listing from. Defaults to 1.
+	PageNumber int
+
+	// Filters are the filters applied to the list, keyed by query parameter.
+	Filters map[string]string
+
+	// Sort are the attributes to sort by. Prefix an attribute with "-" to
+	// sort in descending order.
+	Sort []string
+
+	// Fields are the sparse fieldsets requested, keyed by resource type.
+	Fields map[string][]string
+
+	// Include are the relationships to include.
+	Include []string
+}
+
+// values encodes the list options into query parameters.
+func (opts ListOptions) values() (url.Values, error) {
+	values, err := query.Values(querystring{PageSize: opts.PageSize, PageNumber: opts.PageNumber})
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range opts.Filters {
+		values.Set(k, v)
+	}
+
+	if len(opts.Sort) > 0 {
+		values.Set("sort", strings.Join(opts.Sort, ","))
+	}
+
+	for t, fields := range opts.Fields {
+		values.Set("fields["+t+"]", strings.Join(fields, ","))
+	}
+
+	if len(opts.Include) > 0 {
+		values.Set("include", strings.Join(opts.Include, ","))
+	}
+
+	return values, nil
+}
+
+type ListOption func(*ListOptions) error
+
+func ListPageSize(size int) ListOption {
+	return func(options *ListOptions) error {
+		options.PageSize = size
+
+		return nil
+	}
+}
+
+func ListPageNumber(number int) ListOption {
+	return func(options *ListOptions) error {
+		options.PageNumber = number
+
+		return nil
+	}
+}
+
+func ListFilter(key string, value string) ListOption {
+	return func(options *ListOptions) error {
+		if options.Filters == nil {
+			options.Filters = make(map[string]string)
+		}
+
+		options.Filters[key] = value
+
+		return nil
+	}
+}
+
+func ListSort(attributes ...string) ListOption {
+	return func(options *ListOptions) error {
+		options.Sort = append(options.Sort, attributes...)
+
+		return nil
+	}
+}
+
+func ListFields(resourceType string, attributes ...string) ListOption {
+	return func(options *ListOptions) error {
+		if options.Fields == nil {
+			options.Fields = make(map[string][]string)
+		}
+
+		options.Fields[resourceType] = append(options.Fields[resourceType], attributes...)
+
+		return nil
+	}
+}
+
+func ListInclude(includes ...string) ListOption {
+	return func(options *ListOptions) error {
+		options.Include = append(options.Include, includes...)
+
+		return nil
+	}
+}
@@ -0,0 +1,56 @@
+package keygen
+
+import (
+	"time"
+
+	"github.com/keygen-sh/jsonapi-go"
+)
+
+// Policy represents a Keygen policy object.
+type Policy struct {
+	ID                        string                    `json:"-"`
+	Type                      string                    `json:"-"`
+	Name                      string                    `json:"name"`
+	Duration                  int                       `json:"duration"`
+	Strict                    bool                      `json:"strict"`
+	Floating                  bool                      `json:"floating"`
+	Scheme                    SchemeCode                `json:"scheme"`
+	MaxMachines               int                       `json:"maxMachines"`
+	MaxProcesses              int                       `json:"maxProcesses"`
+	MaxCores                  int                       `json:"maxCores"`
+	MaxUses                   int                       `json:"maxUses"`
+	RequireHeartbeat          bool                      `json:"requireHeartbeat"`
+	HeartbeatDuration         int                       `json:"heartbeatDuration"`
+	HeartbeatBasis            string                    `json:"heartbeatBasis"`
+	ComponentMatchingStrategy ComponentMatchingStrategy `json:"componentMatchingStrategy"`
+	Created                   time.Time                 `json:"created"`
+	Updated                   time.Time                 `json:"updated"`
+	Metadata                  map[string]interface{}    `json:"metadata"`
+	ProductID                 string                    `json:"-"`
+}
+
+// SetID implements the jsonapi.UnmarshalResourceIdentifier interface.
+func (p *Policy) SetID(id string) error {
+	p.ID = id
+	return nil
+}
+
+// SetType implements the jsonapi.UnmarshalResourceIdentifier interface.
+func (p *Policy) SetType(t string) error {
+	p.Type = t
+	return nil
+}
+
+// SetData implements the jsonapi.UnmarshalData interface.
+func (p *Policy) SetData(to func(target interface{}) error) error {
+	return to(p)
+}
+
+// SetRelationships implements the jsonapi.UnmarshalRelationship interface.
+func (p *Policy) SetRelationships(relationships map[string]interface{}) error {
+	if relationship, ok := relationships["product"]; ok {
+		p.ProductID = relationship.(*jsonapi.ResourceObjectIdentifier).ID
+	}
+
+	return nil
+}
@@ -2,11 +2,16 @@ package keygen
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/keygen-sh/jsonapi-go"
 )
 
+// processKillTimeout is the timeout for killing a process after its monitor's
+// context is canceled.
+const processKillTimeout = 30 * time.Second
+
 type ProcessStatusCode string
 
 const (
@@ -15,10 +20,11 @@ const (
 )
 
 type process struct {
-	ID        string `json:"-"`
-	Type      string `json:"-"`
-	Pid       string `json:"pid"`
-	MachineID string `json:"-"`
+	ID        string                 `json:"-"`
+	Type      string                 `json:"-"`
+	Pid       string                 `json:"pid"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	MachineID string                 `json:"-"`
 }
 
 // GetID implements the jsonapi.MarshalResourceIdentifier interface.
@@ -59,6 +65,17 @@ type Process struct {
 	Updated   time.Time              `json:"updated"`
 	Metadata  map[string]interface{} `json:"metadata"`
 	MachineID string                 `json:"-"`
+
+	client    *Client           `json:"-"`
+	heartbeat *HeartbeatMonitor `json:"-"`
+	state     *processState     `json:"-"`
+}
+
+// processState is a spawned process's kill state, shared by Kill and the kill
+// when its context is canceled, so that the process is only deleted once.
+type processState struct {
+	mu     sync.Mutex
+	killed bool
 }
 
 // GetID implements the jsonapi.MarshalResourceIdentifier interface.
@@ -76,6 +93,7 @@ func (p Process) GetData() interface{} {
 	// Transform public process to private process to only send a subset of attrs
 	return process{
 		Pid:       p.Pid,
+		Metadata:  p.Metadata,
 		MachineID: p.MachineID,
 	}
 }
@@ -105,38 +123,149 @@ func (p *Processes) SetData(to func(target interface{}) error) error {
 	return to(p)
 }
 
-// Kill deletes the current Process. An error will be returned if the process
-// deletion fails.
+// ProcessIterator iterates over a paginated list of processes. Pages are fetched
+// as needed, and iteration stops on the first error.
+type ProcessIterator struct{ iterator }
+
+// Next advances the iterator to the next process, returning false when there
+// are no more processes or an error occurred.
+func (it *ProcessIterator) Next() bool {
+	return it.advance()
+}
+
+// Process returns the current process.
+func (it *ProcessIterator) Process() *Process {
+	if it.item == nil {
+		return nil
+	}
+
+	return it.item.(*Process)
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *ProcessIterator) Err() error {
+	return it.err
+}
+
+// FilterProcessStatus filters a list of processes by status, e.g.
+// ProcessStatusCodeAlive.
+func FilterProcessStatus(status ProcessStatusCode) ListOption {
+	return ListFilter("status", string(status))
+}
+
+// Kill stops the current Process's heartbeat monitor, if any, and deletes the
+// process, unless it was already killed, e.g. when its context was canceled.
+// An error will be returned if the process deletion fails.
 func (p *Process) Kill(ctx context.Context) error {
-	client := NewClient()
+	// Waits for the monitor to be done, i.e. for any kill after its context
+	// was canceled
+	if p.heartbeat != nil {
+		p.heartbeat.Stop()
+	}
+
+	return p.kill(ctx)
+}
+
+// Stop stops the current Process's heartbeat monitor, if any, without deleting
+// the process, i.e. the process will die once its heartbeat window has passed.
+func (p *Process) Stop() {
+	if p.heartbeat != nil {
+		p.heartbeat.Stop()
+	}
+}
+
+// Done returns a channel that is closed once the current Process's heartbeat
+// monitor has stopped. For a process without a monitor, e.g. one that was
+// listed rather than spawned, the channel is already closed.
+func (p *Process) Done() <-chan struct{} {
+	if p.heartbeat == nil {
+		return closed
+	}
+
+	return p.heartbeat.Done()
+}
+
+// Err returns the error that stopped the current Process's heartbeat monitor,
+// e.g. ErrHeartbeatDead. See HeartbeatMonitor.Err for more info.
+func (p *Process) Err() error {
+	if p.heartbeat == nil {
+		return nil
+	}
+
+	return p.heartbeat.Err()
+}
+
+func (p *Process) kill(ctx context.Context) error {
+	client := clientOrDefault(p.client)
+
+	if p.state != nil {
+		p.state.mu.Lock()
+		defer p.state.mu.Unlock()
+
+		if p.state.killed {
+			return nil
+		}
+	}
 
 	if _, err := client.Delete(ctx, "processes/"+p.ID, nil, nil); err != nil {
 		return err
 	}
 
+	if p.state != nil {
+		p.state.killed = true
+	}
+
 	return nil
 }
 
-func (p *Process) monitor(ctx context.Context) error {
+// monitor starts the process's heartbeat monitor, after a first ping. When ctx
+// is canceled, the monitor stops and the process is killed.
+func (p *Process) monitor(ctx context.Context, options MonitorOptions) error {
 	if err := p.ping(ctx); err != nil {
 		return err
 	}
 
-	go func() {
-		t := (time.Duration(p.Interval) * time.Second) - (30 * time.Second)
+	client := clientOrDefault(p.client)
+	pinger := heartbeatClient(client)
+	ping := func(ctx context.Context) (HeartbeatStatusCode, error) {
+		// Ping a copy, so that the process isn't written concurrently
+		process := &Process{ID: p.ID, client: pinger}
+		if err := process.ping(ctx); err != nil {
+			return "", err
+		}
+
+		return HeartbeatStatusCode(process.Status), nil
+	}
+
+	canceled := func() {
+		// The monitor's context is canceled, so kill using a new one
+		ctx, cancel := context.WithTimeout(context.Background(), processKillTimeout)
+		defer cancel()
+
+		if err := p.kill(ctx); err != nil {
+			client.logger().Errorf("Error killing process: id=%s err=%v", p.ID, err)
 
-		for range time.Tick(t) {
-			if err := p.ping(ctx); err != nil {
-				panic(err)
+			if options.OnError != nil {
+				options.OnError(err)
 			}
 		}
-	}()
+	}
+
+	p.state = &processState{}
+
+	window := time.Duration(p.Interval) * time.Second
+	heartbeat, err := startHeartbeat(ctx, client, ping, window, HeartbeatStatusCode(p.Status), options, canceled)
+	if err != nil {
+		return err
+	}
+
+	p.heartbeat = heartbeat
 
 	return nil
 }
 
 func (p *Process) ping(ctx context.Context) error {
-	client := NewClient()
+	client := clientOrDefault(p.client)
 
 	if _, err := client.Post(ctx, "processes/"+p.ID+"/actions/ping", nil, p); err != nil {
 		return err
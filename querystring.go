@@ -6,4 +6,6 @@ type querystring struct {
 	Product    string `url:"product,omitempty"`
 	Package    string `url:"package,omitempty"`
 	Limit      int    `url:"limit,omitempty"`
+	PageSize   int    `url:"page[size],omitempty"`
+	PageNumber int    `url:"page[number],omitempty"`
 }
@@ -28,7 +28,8 @@ type Release struct {
 	Updated     time.Time              `json:"updated"`
 	Metadata    map[string]interface{} `json:"metadata"`
 
-	opts UpgradeOptions `json:"-"`
+	opts   UpgradeOptions `json:"-"`
+	client *Client        `json:"-"`
 }
 
 // SetID implements the jsonapi.UnmarshalResourceIdentifier interface.
@@ -48,6 +49,94 @@ func (r *Release) SetData(to func(target interface{}) error) error {
 	return to(r)
 }
 
+// Releases represents an array of release objects.
+type Releases []Release
+
+// SetData implements the jsonapi.UnmarshalData interface.
+func (r *Releases) SetData(to func(target interface{}) error) error {
+	return to(r)
+}
+
+// ReleaseIterator iterates over a paginated list of releases. Pages are fetched
+// as needed, and iteration stops on the first error.
+type ReleaseIterator struct{ iterator }
+
+// Next advances the iterator to the next release, returning false when there
+// are no more releases or an error occurred.
+func (it *ReleaseIterator) Next() bool {
+	return it.advance()
+}
+
+// Release returns the current release.
+func (it *ReleaseIterator) Release() *Release {
+	if it.item == nil {
+		return nil
+	}
+
+	return it.item.(*Release)
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *ReleaseIterator) Err() error {
+	return it.err
+}
+
+// FilterReleaseChannel filters a list of releases by channel, e.g. stable.
+func FilterReleaseChannel(channel string) ListOption {
+	return ListFilter("channel", channel)
+}
+
+// FilterReleasePlatform filters a list of releases by platform, e.g. linux.
+func FilterReleasePlatform(platform string) ListOption {
+	return ListFilter("platform", platform)
+}
+
+// FilterReleaseProduct filters a list of releases by product.
+func FilterReleaseProduct(product string) ListOption {
+	return ListFilter("product", product)
+}
+
+// FilterReleasePackage filters a list of releases by package.
+func FilterReleasePackage(pkg string) ListOption {
+	return ListFilter("package", pkg)
+}
+
+// Releases lists all releases accessible to the client, fetching every page.
+func (c *Client) Releases(ctx context.Context, options ...ListOption) (Releases, error) {
+	it := c.IterReleases(ctx, options...)
+	releases := Releases{}
+
+	for it.Next() {
+		releases = append(releases, *it.Release())
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return releases, nil
+}
+
+// IterReleases returns an iterator over the releases accessible to the client.
+func (c *Client) IterReleases(ctx context.Context, options ...ListOption) *ReleaseIterator {
+	page := func() (interface{}, func() []interface{}) {
+		releases := Releases{}
+
+		return &releases, func() []interface{} {
+			items := make([]interface{}, len(releases))
+			for i := range releases {
+				releases[i].opts = UpgradeOptions{Product: c.Product, Package: c.Package}
+				releases[i].client = c
+				items[i] = &releases[i]
+			}
+
+			return items
+		}
+	}
+
+	return &ReleaseIterator{newIterator(ctx, c, "releases", options, page)}
+}
+
 // Install performs an update of the current executable to the new Release.
 func (r *Release) Install(ctx context.Context) error {
 	artifact, err := r.artifact(ctx)
@@ -55,7 +144,13 @@ func (r *Release) Install(ctx context.Context) error {
 		return err
 	}
 
-	res, err := http.Get(artifact.URL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, artifact.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	client := clientOrDefault(r.client)
+	res, err := client.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -70,7 +165,7 @@ func (r *Release) Install(ctx context.Context) error {
 				return err
 			}
 
-			opts.Verifier = ed25519phVerifier{}
+			opts.Verifier = ed25519phVerifier{Product: r.opts.Product}
 			opts.PublicKey = k
 		}
 	}
@@ -93,7 +188,7 @@ func (r *Release) Install(ctx context.Context) error {
 }
 
 func (r *Release) artifact(ctx context.Context) (*Artifact, error) {
-	client := NewClient()
+	client := clientOrDefault(r.client)
 	artifact := &Artifact{}
 
 	filename, err := r.filename()
@@ -113,7 +208,12 @@ func (r *Release) artifact(ctx context.Context) (*Artifact, error) {
 }
 
 func (r *Release) filename() (string, error) {
-	tmpl, err := template.New("").Parse(r.opts.Filename)
+	filename := r.opts.Filename
+	if filename == "" {
+		filename = defaultFilename
+	}
+
+	tmpl, err := template.New("").Parse(filename)
 	if err != nil {
 		return "", err
 	}
@@ -128,12 +228,15 @@ func (r *Release) filename() (string, error) {
 	return out.String(), nil
 }
 
-// ed25519phVerifier handles verifying the upgrade's signature.
-type ed25519phVerifier struct{}
+// ed25519phVerifier handles verifying the upgrade's signature, using the
+// release's product as the signature context.
+type ed25519phVerifier struct {
+	Product string
+}
 
 // VerifySignature verifies the upgrade's signature with Ed25519ph.
 func (v ed25519phVerifier) VerifySignature(checksum []byte, signature []byte, _ crypto.Hash, publicKey crypto.PublicKey) error {
-	opts := &ed25519.Options{Hash: crypto.SHA512, Context: Product}
+	opts := &ed25519.Options{Hash: crypto.SHA512, Context: v.Product}
 	key, err := hex.DecodeString(publicKey.(string))
 	if err != nil {
 		return errors.New("failed to decode ed25519ph public key")
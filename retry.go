@@ -0,0 +1,226 @@
+package keygen
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// RetryOptions stores config options used for automatically retrying failed
+// API requests.
+//
+// Rate limited requests are always retried, since they were rejected before
+// being processed. Server errors and network errors are only retried for
+// idempotent requests, so that e.g. a machine activation is never duplicated.
+// A retried DELETE request that isn't found is considered successful, since
+// an earlier attempt may have been processed, e.g. when its response was lost.
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of attempts made for a request,
+	// including the initial attempt. Set to 1 to disable retries.
+	MaxAttempts int
+
+	// MinBackoff is the backoff used before the first retry. It is doubled
+	// for each subsequent retry, and jittered to avoid retry storms.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the maximum backoff used between retries. It also caps
+	// the wait for a rate limit's RetryAfter or Reset, so a request is never
+	// held for longer.
+	MaxBackoff time.Duration
+}
+
+// idempotentActions are the actions that can safely be retried after they may
+// have been processed.
+var idempotentActions = map[string]bool{
+	"validate":     true,
+	"validate-key": true,
+	"ping":         true,
+	"check-out":    true,
+	"reset":        true,
+}
+
+// backoff returns the jittered exponential backoff for the given retry.
+func (r *RetryOptions) backoff(retry int) time.Duration {
+	backoff := r.MinBackoff
+	for i := 0; i < retry && (r.MaxBackoff <= 0 || backoff < r.MaxBackoff); i++ {
+		backoff *= 2
+	}
+
+	if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	// Use "equal jitter" i.e. half of the backoff is fixed and half is random
+	half := backoff / 2
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// send performs the request, retrying it according to the client's retry
+// policy when it fails with a retryable error.
+func (c *Client) send(req *http.Request, model interface{}) (*Response, error) {
+	retries := c.retries()
+	logger := c.logger()
+	ctx := req.Context()
+
+	// Whether a failed attempt may have been processed
+	processed := false
+
+	for attempt := 1; ; attempt++ {
+		res, err := c.attempt(req, model)
+
+		// The resource was deleted by an earlier attempt, e.g. a deactivation
+		// whose response was lost
+		if processed && req.Method == http.MethodDelete && notFound(err) {
+			logger.Warnf("Retried deletion was not found, assuming it was processed: url=%s attempt=%d", req.URL, attempt)
+
+			return res, nil
+		}
+
+		if err == nil || retries == nil || attempt >= retries.MaxAttempts {
+			return res, err
+		}
+
+		wait, ok := c.retryable(req, err, retries, attempt)
+		if !ok {
+			return res, err
+		}
+
+		// Rate limited requests are rejected before being processed
+		var rateLimitErr *RateLimitError
+		if !errors.As(err, &rateLimitErr) {
+			processed = true
+		}
+
+		// Don't bother waiting when we'd exceed the context's deadline
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return res, err
+		}
+
+		// Rewind the request body for the next attempt
+		if req.GetBody != nil {
+			body, e := req.GetBody()
+			if e != nil {
+				return res, err
+			}
+
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+
+		logger.Warnf("Retrying request: method=%s url=%s attempt=%d wait=%s err=%v", req.Method, req.URL, attempt+1, wait, err)
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return res, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a failed request should be retried, and how long
+// to wait before doing so.
+func (c *Client) retryable(req *http.Request, err error, retries *RetryOptions, attempt int) (time.Duration, bool) {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		var wait time.Duration
+
+		switch {
+		case rateLimitErr.RetryAfter > 0:
+			wait = time.Duration(rateLimitErr.RetryAfter) * time.Second
+		case !rateLimitErr.Reset.IsZero() && time.Until(rateLimitErr.Reset) > 0:
+			wait = time.Until(rateLimitErr.Reset)
+		default:
+			return retries.backoff(attempt - 1), true
+		}
+
+		if retries.MaxBackoff > 0 && wait > retries.MaxBackoff {
+			wait = retries.MaxBackoff
+		}
+
+		return wait, true
+	}
+
+	if !idempotent(req) {
+		return 0, false
+	}
+
+	// Never retry a request that was canceled or timed out
+	if ctx := req.Context(); ctx.Err() != nil {
+		return 0, false
+	}
+
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return retries.backoff(attempt - 1), true
+	}
+
+	// Certificate errors won't resolve themselves, so they're never retried
+	if certificateErr(err) {
+		return 0, false
+	}
+
+	// Network errors from the HTTP client, e.g. a refused connection
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return retries.backoff(attempt - 1), true
+	}
+
+	return 0, false
+}
+
+// certificateErr reports whether the error is a TLS certificate verification
+// error, e.g. an unknown authority or a hostname mismatch.
+func certificateErr(err error) bool {
+	var (
+		authorityErr   x509.UnknownAuthorityError
+		hostnameErr    x509.HostnameError
+		invalidErr     x509.CertificateInvalidError
+		constraintsErr x509.ConstraintViolationError
+		systemRootsErr x509.SystemRootsError
+	)
+
+	return errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) ||
+		errors.As(err, &constraintsErr) ||
+		errors.As(err, &systemRootsErr)
+}
+
+func (c *Client) retries() *RetryOptions {
+	if c.Retries != nil {
+		return c.Retries
+	}
+
+	return Retries
+}
+
+// idempotent reports whether a request can safely be retried after it may have
+// been processed. POST requests are only considered idempotent for the actions
+// in idempotentActions, e.g. a validation or a heartbeat ping, and not for e.g.
+// an activation or a license renewal.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		dir, action := path.Split(req.URL.Path)
+
+		return strings.HasSuffix(dir, "/actions/") && idempotentActions[action]
+	default:
+		return false
+	}
+}
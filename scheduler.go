@@ -0,0 +1,470 @@
+package keygen
+
+import (
+	"container/heap"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// SchedulerOptions stores config options used by a heartbeat scheduler.
+type SchedulerOptions struct {
+	// Workers is the maximum number of heartbeat pings sent concurrently.
+	// Defaults to 16.
+	Workers int
+
+	// Jitter is the fraction of a monitor's interval by which each of its
+	// pings is randomly brought forward, to spread out pings that would
+	// otherwise be sent at the same time. Pings are never delayed by jitter,
+	// so that they're still sent within the heartbeat window. Defaults to
+	// 0.1. Set to a negative value to disable.
+	Jitter float64
+}
+
+// HeartbeatMetrics is a snapshot of a heartbeat scheduler's metrics.
+type HeartbeatMetrics struct {
+	// Monitors is the number of monitors currently scheduled.
+	Monitors int
+
+	// Busy is the number of heartbeat pings currently in flight.
+	Busy int
+
+	// Pings is the total number of heartbeat pings sent.
+	Pings uint64
+
+	// Failures is the total number of failed heartbeat pings.
+	Failures uint64
+
+	// Lag is how late the most recently dispatched ping was, relative to
+	// when it was due. A growing lag means there are too few workers.
+	Lag time.Duration
+}
+
+// HeartbeatScheduler multiplexes the heartbeat pings of many machine monitors
+// and process monitors onto a bounded pool of workers, sending each monitor's
+// pings in order of when they're due. Its goroutines are started once its
+// first monitor is scheduled. Set the global Scheduler, or
+// ClientOptions.Scheduler, to use it. A HeartbeatScheduler is safe for
+// concurrent use.
+type HeartbeatScheduler struct {
+	opts  SchedulerOptions
+	wake  chan struct{}
+	watch chan struct{}
+	jobs  chan *HeartbeatMonitor
+	quit  chan struct{}
+	wg    sync.WaitGroup
+
+	mu       sync.Mutex
+	queue    heartbeatQueue
+	monitors map[*HeartbeatMonitor]struct{}
+	metrics  HeartbeatMetrics
+	started  bool
+	closed   bool
+
+	// watched are the monitors that can be canceled, keyed by the Done
+	// channel of their context, since many monitors may share a context
+	watched map[<-chan struct{}]map[*HeartbeatMonitor]struct{}
+}
+
+// NewHeartbeatScheduler returns a heartbeat scheduler using the provided
+// options.
+func NewHeartbeatScheduler(options SchedulerOptions) *HeartbeatScheduler {
+	if options.Workers <= 0 {
+		options.Workers = 16
+	}
+
+	if options.Jitter == 0 {
+		options.Jitter = 0.1
+	}
+
+	return &HeartbeatScheduler{
+		opts:     options,
+		wake:     make(chan struct{}, 1),
+		watch:    make(chan struct{}, 1),
+		jobs:     make(chan *HeartbeatMonitor),
+		quit:     make(chan struct{}),
+		monitors: map[*HeartbeatMonitor]struct{}{},
+		watched:  map[<-chan struct{}]map[*HeartbeatMonitor]struct{}{},
+	}
+}
+
+// Metrics returns a snapshot of the scheduler's metrics.
+func (s *HeartbeatScheduler) Metrics() HeartbeatMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := s.metrics
+	metrics.Monitors = len(s.monitors)
+
+	return metrics
+}
+
+// Close stops all of the scheduler's monitors, as if by HeartbeatMonitor.Stop,
+// and waits for its goroutines to exit. Monitors can't be scheduled once the
+// scheduler is closed, i.e. they fail with ErrHeartbeatSchedulerClosed.
+func (s *HeartbeatScheduler) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+
+		return
+	}
+
+	s.closed = true
+
+	monitors := make([]*HeartbeatMonitor, 0, len(s.monitors))
+	for h := range s.monitors {
+		monitors = append(monitors, h)
+	}
+
+	started := s.started
+	s.mu.Unlock()
+
+	for _, h := range monitors {
+		h.Stop()
+	}
+
+	if started {
+		close(s.quit)
+	}
+
+	s.wg.Wait()
+}
+
+// schedule adds the monitor to the scheduler, with its first ping due after
+// its interval.
+func (s *HeartbeatScheduler) schedule(h *HeartbeatMonitor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrHeartbeatSchedulerClosed
+	}
+
+	if !s.started {
+		s.started = true
+		s.wg.Add(2 + s.opts.Workers)
+
+		go s.dispatch()
+		go s.cancel()
+
+		for i := 0; i < s.opts.Workers; i++ {
+			go s.work()
+		}
+	}
+
+	s.monitors[h] = struct{}{}
+
+	h.due = time.Now().Add(s.jitter(h.opts.Interval))
+	heap.Push(&s.queue, h)
+
+	// Stop the monitor when its context is canceled. A context that can't be
+	// canceled, e.g. context.Background, doesn't need to be watched.
+	if done := h.parent.Done(); done != nil {
+		if s.watched[done] == nil {
+			s.watched[done] = map[*HeartbeatMonitor]struct{}{}
+			s.rewatch()
+		}
+
+		s.watched[done][h] = struct{}{}
+	}
+
+	s.notify()
+
+	return nil
+}
+
+// jitter returns the interval, randomly brought forward by up to the
+// scheduler's jitter.
+func (s *HeartbeatScheduler) jitter(interval time.Duration) time.Duration {
+	max := int64(float64(interval) * s.opts.Jitter)
+	if max <= 0 {
+		return interval
+	}
+
+	return interval - time.Duration(rand.Int63n(max+1))
+}
+
+// notify wakes the dispatcher, e.g. after the queue changed.
+func (s *HeartbeatScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// rewatch wakes the canceler, after the watched contexts changed.
+func (s *HeartbeatScheduler) rewatch() {
+	select {
+	case s.watch <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch sends each monitor to a worker once its ping is due.
+func (s *HeartbeatScheduler) dispatch() {
+	defer s.wg.Done()
+
+	for {
+		var h *HeartbeatMonitor
+		var wait time.Duration
+
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			wait = time.Until(s.queue[0].due)
+			if wait <= 0 {
+				h = heap.Pop(&s.queue).(*HeartbeatMonitor)
+				h.running = true
+
+				s.metrics.Lag = -wait
+			}
+		}
+		s.mu.Unlock()
+
+		if h != nil {
+			// Blocks until a worker is free, i.e. the pool is bounded
+			select {
+			case s.jobs <- h:
+			case <-s.quit:
+				return
+			}
+
+			continue
+		}
+
+		// Wait until the next ping is due, or the queue changes
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-s.wake:
+		case <-timeout:
+		case <-s.quit:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
+	}
+}
+
+func (s *HeartbeatScheduler) work() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case h := <-s.jobs:
+			s.beat(h)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// beat sends a monitor's heartbeat ping, and reschedules the monitor, unless
+// it has ended.
+func (s *HeartbeatScheduler) beat(h *HeartbeatMonitor) {
+	s.mu.Lock()
+	if h.ending != heartbeatRunning {
+		h.running = false
+		s.mu.Unlock()
+
+		s.finish(h)
+
+		return
+	}
+
+	s.metrics.Busy++
+	s.metrics.Pings++
+	s.mu.Unlock()
+
+	status, err := h.ping(h.ctx)
+	wait, end := h.record(status, err)
+
+	s.mu.Lock()
+	s.metrics.Busy--
+	if err != nil && h.ctx.Err() == nil {
+		s.metrics.Failures++
+	}
+
+	h.running = false
+
+	// The monitor's context is only canceled once it has ended, unless its
+	// parent context was canceled
+	if h.ending == heartbeatRunning && h.ctx.Err() != nil {
+		end = heartbeatCanceled
+	}
+
+	if h.ending == heartbeatRunning {
+		h.ending = end
+	}
+
+	if h.ending != heartbeatRunning {
+		s.mu.Unlock()
+
+		s.finish(h)
+
+		return
+	}
+
+	if err == nil {
+		wait = s.jitter(wait)
+	}
+
+	h.due = time.Now().Add(wait)
+	heap.Push(&s.queue, h)
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// cancel ends monitors once their context is canceled, using a single select
+// over the Done channels of the watched contexts, which is rebuilt whenever
+// they change.
+func (s *HeartbeatScheduler) cancel() {
+	defer s.wg.Done()
+
+	for {
+		s.mu.Lock()
+		dones := make([]<-chan struct{}, 0, len(s.watched))
+		cases := make([]reflect.SelectCase, 2, 2+len(s.watched))
+		cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.quit)}
+		cases[1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.watch)}
+
+		for done := range s.watched {
+			dones = append(dones, done)
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+		}
+		s.mu.Unlock()
+
+		chosen, _, _ := reflect.Select(cases)
+		switch chosen {
+		case 0:
+			return
+		case 1:
+			continue
+		}
+
+		done := dones[chosen-2]
+
+		s.mu.Lock()
+		monitors := make([]*HeartbeatMonitor, 0, len(s.watched[done]))
+		for h := range s.watched[done] {
+			monitors = append(monitors, h)
+		}
+
+		delete(s.watched, done)
+		s.mu.Unlock()
+
+		for _, h := range monitors {
+			s.end(h, heartbeatCanceled)
+		}
+	}
+}
+
+// end ends the monitor for the reason, unless it has already ended. When the
+// monitor's ping is in flight, the worker sending it finishes the monitor.
+func (s *HeartbeatScheduler) end(h *HeartbeatMonitor, reason heartbeatEnd) {
+	s.mu.Lock()
+	if h.ending != heartbeatRunning {
+		s.mu.Unlock()
+
+		return
+	}
+
+	h.ending = reason
+
+	if h.running {
+		s.mu.Unlock()
+
+		return
+	}
+
+	heap.Remove(&s.queue, h.index)
+	s.mu.Unlock()
+
+	s.finish(h)
+}
+
+// finish removes an ended monitor from the scheduler, and closes its Done
+// channel. A monitor whose context was canceled calls its canceled func in a
+// new goroutine, e.g. to kill a process without blocking a worker, and its
+// Done channel is closed once the func returns.
+func (s *HeartbeatScheduler) finish(h *HeartbeatMonitor) {
+	s.mu.Lock()
+	delete(s.monitors, h)
+	reason := h.ending
+
+	if done := h.parent.Done(); s.watched[done] != nil {
+		delete(s.watched[done], h)
+
+		if len(s.watched[done]) == 0 {
+			delete(s.watched, done)
+			s.rewatch()
+		}
+	}
+	s.mu.Unlock()
+
+	h.cancel()
+
+	if reason != heartbeatCanceled || h.canceled == nil {
+		close(h.done)
+
+		return
+	}
+
+	// Called by a worker or the canceler, so the wait group can't be zero
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		h.call(h.canceled)
+
+		close(h.done)
+	}()
+}
+
+// heartbeatQueue is a priority queue of monitors, ordered by when their next
+// ping is due. It implements the heap.Interface interface.
+type heartbeatQueue []*HeartbeatMonitor
+
+func (q heartbeatQueue) Len() int { return len(q) }
+
+func (q heartbeatQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q heartbeatQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *heartbeatQueue) Push(x interface{}) {
+	h := x.(*HeartbeatMonitor)
+	h.index = len(*q)
+
+	*q = append(*q, h)
+}
+
+func (q *heartbeatQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	h := old[n-1]
+	old[n-1] = nil
+	h.index = -1
+
+	*q = old[:n-1]
+
+	return h
+}
@@ -0,0 +1,341 @@
+package keygen
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionShutdownTimeout is the timeout for shutting down a session, e.g. for
+// deactivating its machine, after its context is canceled.
+const sessionShutdownTimeout = 30 * time.Second
+
+// SessionStateCode is the state of a session.
+type SessionStateCode string
+
+const (
+	SessionStateCodeValidating   SessionStateCode = "VALIDATING"
+	SessionStateCodeActivating   SessionStateCode = "ACTIVATING"
+	SessionStateCodeActive       SessionStateCode = "ACTIVE"
+	SessionStateCodeStopping     SessionStateCode = "STOPPING"
+	SessionStateCodeDeactivating SessionStateCode = "DEACTIVATING"
+	SessionStateCodeClosed       SessionStateCode = "CLOSED"
+	SessionStateCodeFailed       SessionStateCode = "FAILED"
+)
+
+// SessionEvent is a session's transition to a new state.
+type SessionEvent struct {
+	// State is the session's new state, e.g. SessionStateCodeActive.
+	State SessionStateCode
+
+	// Signal is the signal that stopped the session, if any.
+	Signal os.Signal
+
+	// Err is the error that caused the transition, if any, e.g. the error
+	// that failed the session, or ErrHeartbeatDead when stopping.
+	Err error
+}
+
+// SessionOptions stores config options used by a session.
+type SessionOptions struct {
+	// Fingerprint is the current machine's fingerprint. Required.
+	Fingerprint string
+
+	// Components are the current machine's components, if any. They scope
+	// the validation, and are sent when activating the machine.
+	Components []Component
+
+	// Activate activates the machine if the license isn't activated for it,
+	// i.e. on ErrLicenseNotActivated.
+	Activate bool
+
+	// Deactivate deactivates the machine when the session ends, e.g. to
+	// free a floating license's seat when the app exits.
+	Deactivate bool
+
+	// Spawn spawns a process for the current PID, which is killed when the
+	// session ends.
+	Spawn bool
+
+	// Signals are the signals that end the session, e.g. os.Interrupt and
+	// syscall.SIGTERM. When empty, the session only ends when its context is
+	// canceled, when Close is called, or when its heartbeat dies.
+	Signals []os.Signal
+
+	// Monitor configures the machine's heartbeat monitor.
+	Monitor MonitorOptions
+
+	// OnEvent is called for each of the session's transitions. It should
+	// not block.
+	OnEvent func(SessionEvent)
+}
+
+// Session runs a license's lifecycle on the current machine: it validates the
+// license, activates the machine if needed, monitors the machine's heartbeat,
+// optionally spawns a process, and deactivates the machine when it ends. Use
+// StartSession to start a session. A Session is safe for concurrent use.
+type Session struct {
+	opts      SessionOptions
+	client    *Client
+	license   *License
+	machine   *Machine
+	activated bool
+	monitor   *HeartbeatMonitor
+	process   *Process
+	signals   chan os.Signal
+	closing   chan struct{}
+	close     sync.Once
+	done      chan struct{}
+
+	mu    sync.Mutex
+	state SessionStateCode
+	err   error
+}
+
+// StartSession starts a session using the current LicenseKey or Token. See
+// the Session type for more info.
+func StartSession(ctx context.Context, options SessionOptions) (*Session, error) {
+	client := NewClient()
+
+	return client.StartSession(ctx, options)
+}
+
+// StartSession starts a session using the client's license key or token. The
+// session's license and machine are bound to the client. The session ends
+// when ctx is canceled, when one of its Signals is received, when Close is
+// called, or when its heartbeat dies. An error will be returned if the session
+// can't be started, e.g. ErrLicenseNotActivated when Activate is false, or
+// ErrLicenseExpired. Any machine activated by a failed session is deactivated,
+// when Deactivate is set.
+func (c *Client) StartSession(ctx context.Context, options SessionOptions) (*Session, error) {
+	s := &Session{
+		opts:    options,
+		client:  c,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	// Trap signals before starting, so that none are missed
+	if len(options.Signals) > 0 {
+		s.signals = make(chan os.Signal, 1)
+
+		signal.Notify(s.signals, options.Signals...)
+	}
+
+	if err := s.start(ctx); err != nil {
+		// Only deactivate a machine that was activated by the failed session
+		if !s.activated {
+			s.machine = nil
+		}
+
+		s.shutdown()
+		s.transition(SessionEvent{State: SessionStateCodeFailed, Err: err})
+
+		close(s.done)
+
+		return nil, err
+	}
+
+	s.transition(SessionEvent{State: SessionStateCodeActive})
+
+	go s.run(ctx)
+
+	return s, nil
+}
+
+func (s *Session) start(ctx context.Context) error {
+	if s.opts.Fingerprint == "" {
+		return ErrValidationFingerprintMissing
+	}
+
+	s.transition(SessionEvent{State: SessionStateCodeValidating})
+
+	options := []ValidateOption{ValidateFingerprint(s.opts.Fingerprint)}
+	if len(s.opts.Components) > 0 {
+		fingerprints := make([]string, len(s.opts.Components))
+		for i, component := range s.opts.Components {
+			fingerprints[i] = component.Fingerprint
+		}
+
+		options = append(options, ValidateComponents(fingerprints...))
+	}
+
+	license, err := s.client.ValidateWithOptions(ctx, options...)
+	switch {
+	case errors.Is(err, ErrLicenseNotActivated) && s.opts.Activate:
+		s.license = license
+		s.transition(SessionEvent{State: SessionStateCodeActivating})
+
+		machine, err := license.Activate(ctx, s.opts.Fingerprint, s.opts.Components...)
+		if err != nil {
+			return err
+		}
+
+		s.machine = machine
+		s.activated = true
+	case err != nil:
+		return err
+	default:
+		s.license = license
+
+		machine, err := license.Machine(ctx, s.opts.Fingerprint)
+		if err != nil {
+			return err
+		}
+
+		s.machine = machine
+	}
+
+	monitor, err := s.machine.MonitorWithOptions(ctx, s.opts.Monitor)
+	if err != nil {
+		return err
+	}
+
+	s.monitor = monitor
+
+	if s.opts.Spawn {
+		process, err := s.machine.Spawn(ctx, strconv.Itoa(os.Getpid()))
+		if err != nil {
+			return err
+		}
+
+		s.process = process
+	}
+
+	return nil
+}
+
+func (s *Session) run(ctx context.Context) {
+	var processDone <-chan struct{}
+	if s.process != nil {
+		processDone = s.process.Done()
+	}
+
+	event := SessionEvent{State: SessionStateCodeStopping}
+
+	select {
+	case <-ctx.Done():
+	case <-s.closing:
+	case sig := <-s.signals:
+		event.Signal = sig
+	case <-s.monitor.Done():
+		event.Err = s.monitor.Err()
+	case <-processDone:
+		event.Err = s.process.Err()
+	}
+
+	s.transition(event)
+
+	if err := s.shutdown(); err != nil && event.Err == nil {
+		event.Err = err
+	}
+
+	s.transition(SessionEvent{State: SessionStateCodeClosed, Err: event.Err})
+
+	close(s.done)
+}
+
+// shutdown stops trapping signals, kills the session's process, stops its
+// heartbeat monitor, and deactivates its machine, when Deactivate is set. It
+// returns the first error, if any.
+func (s *Session) shutdown() error {
+	if s.signals != nil {
+		signal.Stop(s.signals)
+	}
+
+	// The session's context may be canceled, so shut down using a new one
+	ctx, cancel := context.WithTimeout(context.Background(), sessionShutdownTimeout)
+	defer cancel()
+
+	var errs []error
+
+	// A process or machine with a dead heartbeat may already be deleted
+	if s.process != nil {
+		if err := s.process.Kill(ctx); err != nil && !notFound(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.monitor != nil {
+		s.monitor.Stop()
+	}
+
+	if s.machine != nil && s.opts.Deactivate {
+		s.transition(SessionEvent{State: SessionStateCodeDeactivating})
+
+		if err := s.machine.Deactivate(ctx); err != nil && !notFound(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+func (s *Session) transition(event SessionEvent) {
+	s.mu.Lock()
+	s.state = event.State
+	if event.Err != nil && s.err == nil {
+		s.err = event.Err
+	}
+	s.mu.Unlock()
+
+	if s.opts.OnEvent != nil {
+		s.opts.OnEvent(event)
+	}
+}
+
+// License returns the session's license.
+func (s *Session) License() *License {
+	return s.license
+}
+
+// Machine returns the session's machine.
+func (s *Session) Machine() *Machine {
+	return s.machine
+}
+
+// Process returns the session's process, or nil when Spawn isn't set.
+func (s *Session) Process() *Process {
+	return s.process
+}
+
+// State returns the session's current state.
+func (s *Session) State() SessionStateCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// Done returns a channel that is closed once the session has ended, i.e. its
+// machine was deactivated, when Deactivate is set.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that ended the session, if any, e.g. ErrHeartbeatDead,
+// or an error deactivating its machine.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Close ends the session, and waits for it to shut down. It returns the error
+// that ended the session, if any. See Err for more info.
+func (s *Session) Close() error {
+	s.close.Do(func() { close(s.closing) })
+
+	<-s.done
+
+	return s.Err()
+}
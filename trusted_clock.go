@@ -0,0 +1,137 @@
+package keygen
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trustedClockPersistInterval is how far the high-water mark must advance
+// before it is persisted again, to avoid a write for every API response.
+const trustedClockPersistInterval = time.Minute
+
+// TrustedClock is a source of time for expiry checks that can't be turned back.
+// It records a high-water mark, i.e. the latest trusted time it has seen: the
+// signed Date of verified API responses, and the Issued timestamp of verified
+// license files and machine files. Its current time is the later of the system
+// time and the high-water mark, so that turning the system clock back doesn't
+// extend an expired file. Set the global Clock, or ClientOptions.Clock, to use
+// it. A TrustedClock is safe for concurrent use.
+type TrustedClock struct {
+	path      string
+	mu        sync.Mutex
+	mark      time.Time
+	persisted time.Time
+}
+
+// NewTrustedClock returns a trusted clock that persists its high-water mark to
+// the path, loading the mark persisted by a previous run, if any. When path is
+// empty, the high-water mark is only kept in memory.
+func NewTrustedClock(path string) (*TrustedClock, error) {
+	clock := &TrustedClock{path: path}
+	if path == "" {
+		return clock, nil
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return clock, nil
+	case err != nil:
+		return nil, err
+	}
+
+	mark, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	clock.mark = mark
+	clock.persisted = mark
+
+	return clock, nil
+}
+
+// Now returns the later of the system time and the high-water mark. It returns
+// ErrSystemClockUnsynced, along with the high-water mark, if the system clock
+// is behind the high-water mark by more than MaxClockDrift, i.e. it was turned
+// back.
+func (c *TrustedClock) Now() (time.Time, error) {
+	now := time.Now()
+	mark := c.HighWaterMark()
+
+	if !now.Before(mark) {
+		return now, nil
+	}
+
+	if MaxClockDrift >= 0 && mark.Sub(now) > MaxClockDrift {
+		return mark, ErrSystemClockUnsynced
+	}
+
+	return mark, nil
+}
+
+// HighWaterMark returns the latest trusted time seen by the clock.
+func (c *TrustedClock) HighWaterMark() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mark
+}
+
+// Observe records a trusted time, e.g. a verified response's Date, advancing
+// the high-water mark if it's later. The mark is persisted once it has
+// advanced by at least a minute since it was last persisted.
+func (c *TrustedClock) Observe(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !t.After(c.mark) {
+		return nil
+	}
+
+	c.mark = t
+
+	if c.path == "" || t.Sub(c.persisted) < trustedClockPersistInterval {
+		return nil
+	}
+
+	if err := writeFile(c.path, []byte(t.UTC().Format(time.RFC3339Nano))); err != nil {
+		return err
+	}
+
+	c.persisted = t
+
+	return nil
+}
+
+func (c *Client) clock() *TrustedClock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+
+	return Clock
+}
+
+// now returns the current time for expiry checks, using the client's trusted
+// clock, if any. See TrustedClock.Now.
+func (c *Client) now() (time.Time, error) {
+	if clock := c.clock(); clock != nil {
+		return clock.Now()
+	}
+
+	return time.Now(), nil
+}
+
+// observe records a trusted time using the client's trusted clock, if any.
+func (c *Client) observe(t time.Time) {
+	clock := c.clock()
+	if clock == nil {
+		return
+	}
+
+	if err := clock.Observe(t); err != nil {
+		c.logger().Warnf("Error persisting trusted clock: err=%v", err)
+	}
+}
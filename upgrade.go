@@ -2,17 +2,21 @@ package keygen
 
 import "context"
 
+// defaultFilename is the default template used when retrieving a release's
+// artifact during install.
+const defaultFilename = `{{.program}}_{{.platform}}_{{.arch}}{{if .ext}}.{{.ext}}{{end}}`
+
 type UpgradeOptions struct {
 	// CurrentVersion is the current version of the program. This will be used by
 	// Keygen to determine if an upgrade is available.
 	CurrentVersion string
 
-	// Product is the product ID to scope the upgrade to. This defaults to keygen.Product,
+	// Product is the product ID to scope the upgrade to. This defaults to the client's Product,
 	// but overriding it may be useful if you're requesting an upgrade for another
 	// accessible product, e.g. a product with an OPEN distribution strategy.
 	Product string
 
-	// Package is the package ID to scope the upgrade to. This defaults to keygen.Package,
+	// Package is the package ID to scope the upgrade to. This defaults to the client's Package,
 	// but overriding it may be useful if you're requesting an upgrade for another
 	// accessible package of the product.
 	Package string
@@ -53,31 +57,39 @@ type UpgradeOptions struct {
 // Upgrade checks if an upgrade is available for the provided version. Returns a
 // Release and any errors that occurred, e.g. ErrUpgradeNotAvailable.
 func Upgrade(ctx context.Context, options UpgradeOptions) (*Release, error) {
-	if options.PublicKey == PublicKey {
+	client := NewClient()
+
+	return client.Upgrade(ctx, options)
+}
+
+// Upgrade checks if an upgrade is available for the provided version, using the
+// client's product and package as defaults. The returned Release is bound to the
+// client.
+func (c *Client) Upgrade(ctx context.Context, options UpgradeOptions) (*Release, error) {
+	if options.PublicKey == c.PublicKey {
 		panic("You MUST use a personal public key. This MUST NOT be your Keygen account's public key.")
 	}
 
 	if options.Filename == "" {
-		options.Filename = `{{.program}}_{{.platform}}_{{.arch}}{{if .ext}}.{{.ext}}{{end}}`
+		options.Filename = defaultFilename
 	}
 
 	if options.Product == "" {
-		options.Product = Product
+		options.Product = c.Product
 	}
 
 	if options.Package == "" {
-		options.Package = Package
+		options.Package = c.Package
 	}
 
 	if options.Channel == "" {
 		options.Channel = "stable"
 	}
 
-	client := NewClient()
 	params := querystring{Product: options.Product, Package: options.Package, Constraint: options.Constraint, Channel: options.Channel}
 	release := &Release{}
 
-	if _, err := client.Get(ctx, "releases/"+options.CurrentVersion+"/upgrade", params, release); err != nil {
+	if _, err := c.Get(ctx, "releases/"+options.CurrentVersion+"/upgrade", params, release); err != nil {
 		switch err.(type) {
 		case *NotFoundError:
 			return nil, ErrUpgradeNotAvailable
@@ -87,6 +99,7 @@ func Upgrade(ctx context.Context, options UpgradeOptions) (*Release, error) {
 	}
 
 	release.opts = options
+	release.client = c
 
 	return release, nil
 }
@@ -0,0 +1,49 @@
+package keygen
+
+import (
+	"time"
+
+	"github.com/keygen-sh/jsonapi-go"
+)
+
+// User represents a Keygen user object, e.g. a license's owner.
+type User struct {
+	ID        string                 `json:"-"`
+	Type      string                 `json:"-"`
+	Email     string                 `json:"email"`
+	FirstName string                 `json:"firstName"`
+	LastName  string                 `json:"lastName"`
+	FullName  string                 `json:"fullName"`
+	Status    string                 `json:"status"`
+	Role      string                 `json:"role"`
+	Created   time.Time              `json:"created"`
+	Updated   time.Time              `json:"updated"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	GroupID   string                 `json:"-"`
+}
+
+// SetID implements the jsonapi.UnmarshalResourceIdentifier interface.
+func (u *User) SetID(id string) error {
+	u.ID = id
+	return nil
+}
+
+// SetType implements the jsonapi.UnmarshalResourceIdentifier interface.
+func (u *User) SetType(t string) error {
+	u.Type = t
+	return nil
+}
+
+// SetData implements the jsonapi.UnmarshalData interface.
+func (u *User) SetData(to func(target interface{}) error) error {
+	return to(u)
+}
+
+// SetRelationships implements the jsonapi.UnmarshalRelationship interface.
+func (u *User) SetRelationships(relationships map[string]interface{}) error {
+	if relationship, ok := relationships["group"]; ok {
+		u.GroupID = relationship.(*jsonapi.ResourceObjectIdentifier).ID
+	}
+
+	return nil
+}
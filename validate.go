@@ -1,6 +1,10 @@
 package keygen
 
-import "context"
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+)
 
 type ValidationCode string
 
@@ -31,31 +35,153 @@ const (
 	ValidationCodeMachineScopeMismatch     ValidationCode = "MACHINE_SCOPE_MISMATCH"
 	ValidationCodeEntitlementsMissing      ValidationCode = "ENTITLEMENTS_MISSING"
 	ValidationCodeEntitlementsEmpty        ValidationCode = "ENTITLEMENTS_SCOPE_EMPTY"
+	ValidationCodeUserScopeRequired        ValidationCode = "USER_SCOPE_REQUIRED"
+	ValidationCodeUserScopeMismatch        ValidationCode = "USER_SCOPE_MISMATCH"
+	ValidationCodeChecksumScopeRequired    ValidationCode = "CHECKSUM_SCOPE_REQUIRED"
+	ValidationCodeChecksumScopeMismatch    ValidationCode = "CHECKSUM_SCOPE_MISMATCH"
+
+	// Codes only returned by offline validations, e.g. MachineFile.Validate
+	ValidationCodeMachineFileExpired ValidationCode = "MACHINE_FILE_EXPIRED"
+	ValidationCodeClockUnsynced      ValidationCode = "CLOCK_UNSYNCED"
 )
 
+// validationErrors maps each invalid validation code to its sentinel error,
+// and to the less specific sentinel error returned for the code before it had
+// its own, if any. Validations return the less specific sentinel error, so that
+// existing comparisons keep working. Unknown codes fall back to
+// ErrLicenseInvalid.
+var validationErrors = map[ValidationCode]struct{ err, generic error }{
+	ValidationCodeNotFound:                 {ErrLicenseNotFound, ErrLicenseInvalid},
+	ValidationCodeSuspended:                {ErrLicenseSuspended, nil},
+	ValidationCodeExpired:                  {ErrLicenseExpired, nil},
+	ValidationCodeOverdue:                  {ErrLicenseOverdue, ErrLicenseInvalid},
+	ValidationCodeNoMachine:                {ErrLicenseNoMachine, ErrLicenseNotActivated},
+	ValidationCodeNoMachines:               {ErrLicenseNoMachines, ErrLicenseNotActivated},
+	ValidationCodeTooManyMachines:          {ErrLicenseTooManyMachines, nil},
+	ValidationCodeTooManyCores:             {ErrLicenseTooManyCores, nil},
+	ValidationCodeTooManyProcesses:         {ErrLicenseTooManyProcesses, nil},
+	ValidationCodeFingerprintScopeRequired: {ErrValidationFingerprintScopeRequired, ErrValidationFingerprintMissing},
+	ValidationCodeFingerprintScopeMismatch: {ErrValidationFingerprintScopeMismatch, ErrLicenseNotActivated},
+	ValidationCodeFingerprintScopeEmpty:    {ErrValidationFingerprintScopeEmpty, ErrValidationFingerprintMissing},
+	ValidationCodeComponentsScopeRequired:  {ErrValidationComponentsScopeRequired, ErrValidationComponentsMissing},
+	ValidationCodeComponentsScopeMismatch:  {ErrComponentNotActivated, nil},
+	ValidationCodeComponentsScopeEmpty:     {ErrValidationComponentsScopeEmpty, ErrValidationComponentsMissing},
+	ValidationCodeHeartbeatNotStarted:      {ErrHeartbeatRequired, nil},
+	ValidationCodeHeartbeatDead:            {ErrHeartbeatDead, nil},
+	ValidationCodeProductScopeRequired:     {ErrValidationProductScopeRequired, ErrValidationProductMissing},
+	ValidationCodeProductScopeEmpty:        {ErrValidationProductScopeMismatch, ErrValidationProductMissing},
+	ValidationCodePolicyScopeRequired:      {ErrValidationPolicyScopeRequired, ErrLicenseInvalid},
+	ValidationCodePolicyScopeMismatch:      {ErrValidationPolicyScopeMismatch, ErrLicenseInvalid},
+	ValidationCodeMachineScopeRequired:     {ErrValidationMachineScopeRequired, ErrLicenseInvalid},
+	ValidationCodeMachineScopeMismatch:     {ErrValidationMachineScopeMismatch, ErrLicenseInvalid},
+	ValidationCodeEntitlementsMissing:      {ErrLicenseEntitlementsMissing, ErrLicenseInvalid},
+	ValidationCodeEntitlementsEmpty:        {ErrValidationEntitlementsScopeEmpty, ErrLicenseInvalid},
+	ValidationCodeUserScopeRequired:        {ErrValidationUserScopeRequired, ErrLicenseInvalid},
+	ValidationCodeUserScopeMismatch:        {ErrValidationUserScopeMismatch, ErrLicenseInvalid},
+	ValidationCodeChecksumScopeRequired:    {ErrValidationChecksumScopeRequired, ErrLicenseInvalid},
+	ValidationCodeChecksumScopeMismatch:    {ErrValidationChecksumScopeMismatch, ErrLicenseInvalid},
+	ValidationCodeMachineFileExpired:       {ErrMachineFileExpired, nil},
+	ValidationCodeClockUnsynced:            {ErrSystemClockUnsynced, nil},
+}
+
+// newValidationError returns a *ValidationError for an invalid validation
+// result.
+func newValidationError(result ValidationResult, license *License) *ValidationError {
+	e := &ValidationError{Result: result, License: license, ResponseID: result.ResponseID, Err: ErrLicenseInvalid}
+	if errs, ok := validationErrors[result.Code]; ok {
+		e.Err = errs.err
+		e.generic = errs.generic
+	}
+
+	return e
+}
+
+// validationErr returns the sentinel error returned by a validation for an
+// invalid validation code, e.g. ErrLicenseNotActivated for NO_MACHINE.
+func validationErr(code ValidationCode) error {
+	errs, ok := validationErrors[code]
+	switch {
+	case !ok:
+		return ErrLicenseInvalid
+	case errs.generic != nil:
+		return errs.generic
+	default:
+		return errs.err
+	}
+}
+
 type validate struct {
-	fingerprint string
-	components  []string
+	scope       ValidateOptions
+	product     string
+	environment string
+	key         string
+	nonce       int64
+}
+
+// newValidate returns validation params for the client, scoped to the options.
+func newValidate(client *Client, options []ValidateOption) (validate, error) {
+	params := validate{product: client.Product, environment: client.Environment}
+	for _, opt := range options {
+		if err := opt(&params.scope); err != nil {
+			return params, err
+		}
+	}
+
+	return params, nil
 }
 
 type meta struct {
-	Scope scope `json:"scope"`
+	Key   string `json:"key,omitempty"`
+	Nonce int64  `json:"nonce,omitempty"`
+	Scope scope  `json:"scope"`
 }
 
 type scope struct {
-	Fingerprint string   `json:"fingerprint,omitempty"`
-	Components  []string `json:"components,omitempty"`
-	Product     string   `json:"product"`
-	Environment *string  `json:"environment,omitempty"`
+	Fingerprint  string   `json:"fingerprint,omitempty"`
+	Components   []string `json:"components,omitempty"`
+	Entitlements []string `json:"entitlements,omitempty"`
+	Policy       string   `json:"policy,omitempty"`
+	Machine      string   `json:"machine,omitempty"`
+	User         string   `json:"user,omitempty"`
+	Checksum     string   `json:"checksum,omitempty"`
+	Product      string   `json:"product"`
+	Environment  *string  `json:"environment,omitempty"`
 }
 
 // GetMeta implements jsonapi.MarshalMeta interface.
 func (v validate) GetMeta() interface{} {
-	if Environment != "" {
-		return meta{Scope: scope{Fingerprint: v.fingerprint, Components: v.components, Product: Product, Environment: &Environment}}
+	s := scope{
+		Fingerprint:  v.scope.Fingerprint,
+		Components:   v.scope.Components,
+		Entitlements: v.scope.Entitlements,
+		Policy:       v.scope.Policy,
+		Machine:      v.scope.Machine,
+		User:         v.scope.User,
+		Checksum:     v.scope.Checksum,
+		Product:      v.product,
+	}
+
+	if v.environment != "" {
+		s.Environment = &v.environment
+	}
+
+	return meta{Key: v.key, Nonce: v.nonce, Scope: s}
+}
+
+// maxNonce is the exclusive upper bound for a validation nonce, so that it is
+// safely represented as a JSON number.
+var maxNonce = big.NewInt(1 << 53)
+
+// newNonce returns a random nonce for a validation, which is echoed in the
+// signed response to protect against replay attacks.
+func newNonce() (int64, error) {
+	n, err := rand.Int(rand.Reader, maxNonce)
+	if err != nil {
+		return 0, err
 	}
 
-	return meta{Scope: scope{Fingerprint: v.fingerprint, Components: v.components, Environment: nil, Product: Product}}
+	// A zero nonce would be omitted from the request
+	return n.Int64() + 1, nil
 }
 
 type validation struct {
@@ -84,22 +210,83 @@ type ValidationResult struct {
 	Valid  bool             `json:"valid"`
 	Code   ValidationCode   `json:"code"`
 	Scope  *ValidationScope `json:"scope,omitempty"`
+	Nonce  int64            `json:"nonce,omitempty"`
+
+	// ResponseID is the ID of the validation's API response, if any
+	ResponseID string `json:"-"`
 }
 
 // Validate performs a license validation using the current Token, scoped to any
 // provided fingerprints. The first fingerprint should be a machine fingerprint,
 // and the rest are optional component fingerprints. It returns a License, and
 // an error if the license is invalid, e.g. ErrLicenseNotActivated or
-// ErrLicenseExpired.
+// ErrLicenseExpired. Use the license's LastValidationError for details, and
+// ValidateWithOptions to validate other scopes.
 func Validate(ctx context.Context, fingerprints ...string) (*License, error) {
 	client := NewClient()
-	license := &License{}
 
-	if _, err := client.Get(ctx, "me", nil, license); err != nil {
+	return client.Validate(ctx, fingerprints...)
+}
+
+// ValidateWithOptions performs a license validation using the current Token,
+// scoped to the provided options, e.g. ValidateFingerprint or
+// ValidateEntitlements. See Validate for more info.
+func ValidateWithOptions(ctx context.Context, options ...ValidateOption) (*License, error) {
+	client := NewClient()
+
+	return client.ValidateWithOptions(ctx, options...)
+}
+
+// ValidateKey performs a license validation using only the license key, in a
+// single request, scoped to the provided options. Unlike Validate, it doesn't
+// require license key or token authentication, so it can be used to validate
+// keys for policies that don't allow license key authentication. It returns a
+// License, and an error if the license is invalid, e.g. ErrLicenseInvalid or
+// ErrLicenseExpired. See Validate for more info.
+func ValidateKey(ctx context.Context, key string, options ...ValidateOption) (*License, error) {
+	client := NewClient()
+
+	return client.ValidateKey(ctx, key, options...)
+}
+
+// Validate performs a license validation using the client's license key or
+// token. See the top-level Validate for more info. The returned License is
+// bound to the client.
+func (c *Client) Validate(ctx context.Context, fingerprints ...string) (*License, error) {
+	return c.ValidateWithOptions(ctx, validateFingerprints(fingerprints)...)
+}
+
+// ValidateWithOptions performs a license validation using the client's license
+// key or token, scoped to the provided options. See the top-level Validate for
+// more info. The returned License is bound to the client.
+func (c *Client) ValidateWithOptions(ctx context.Context, options ...ValidateOption) (*License, error) {
+	license := &License{client: c}
+
+	if _, err := c.Get(ctx, "me", nil, license); err != nil {
 		return nil, err
 	}
 
-	if err := license.Validate(ctx, fingerprints...); err != nil {
+	if err := license.ValidateWithOptions(ctx, options...); err != nil {
+		return license, err
+	}
+
+	return license, nil
+}
+
+// ValidateKey performs a license validation using only the license key. See
+// the top-level ValidateKey for more info. The returned License is bound to
+// the client.
+func (c *Client) ValidateKey(ctx context.Context, key string, options ...ValidateOption) (*License, error) {
+	license := &License{client: c}
+
+	params, err := newValidate(c, options)
+	if err != nil {
+		return nil, err
+	}
+
+	params.key = key
+
+	if err := license.validate(ctx, c, "licenses/actions/validate-key", params); err != nil {
 		return license, err
 	}
 
@@ -2,19 +2,25 @@ package keygen
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"strings"
 	"time"
 )
 
 type verifier struct {
-	PublicKey string
+	PublicKey    string
+	RSAPublicKey string
 }
 
 // VerifyLicenseFile checks if a license file is genuine.
@@ -24,6 +30,25 @@ func (v *verifier) VerifyLicenseFile(lic *LicenseFile) error {
 		return err
 	}
 
+	return v.verifyCertificate(cert, "license", ErrLicenseFileNotGenuine, ErrLicenseFileNotSupported)
+}
+
+// VerifyMachineFile checks if a license file is genuine.
+func (v *verifier) VerifyMachineFile(lic *MachineFile) error {
+	cert, err := lic.certificate()
+	if err != nil {
+		return err
+	}
+
+	return v.verifyCertificate(cert, "machine", ErrMachineFileNotGenuine, ErrMachineFileNotSupported)
+}
+
+// verifyCertificate verifies a certificate's signature over its encoded
+// dataset, prefixed by the file's kind, using the certificate's algorithm.
+// It returns errNotGenuine or errNotSupported accordingly.
+func (v *verifier) verifyCertificate(cert *certificate, prefix string, errNotGenuine error, errNotSupported error) error {
+	msg := []byte(prefix + "/" + cert.Enc)
+
 	switch {
 	case cert.Alg == "aes-256-gcm+ed25519" || cert.Alg == "base64+ed25519":
 		publicKey, err := v.publicKeyBytes()
@@ -31,49 +56,43 @@ func (v *verifier) VerifyLicenseFile(lic *LicenseFile) error {
 			return err
 		}
 
-		msg := []byte("license/" + cert.Enc)
 		sig, err := base64.StdEncoding.DecodeString(cert.Sig)
 		if err != nil {
-			return ErrLicenseFileNotGenuine
+			return errNotGenuine
 		}
 
 		if ok := ed25519.Verify(publicKey, msg, sig); !ok {
-			return ErrLicenseFileNotGenuine
+			return errNotGenuine
 		}
 
 		return nil
-	default:
-		return ErrLicenseFileNotSupported
-	}
-}
-
-// VerifyMachineFile checks if a license file is genuine.
-func (v *verifier) VerifyMachineFile(lic *MachineFile) error {
-	cert, err := lic.certificate()
-	if err != nil {
-		return err
-	}
-
-	switch {
-	case cert.Alg == "aes-256-gcm+ed25519" || cert.Alg == "base64+ed25519":
-		publicKey, err := v.publicKeyBytes()
+	case cert.Alg == "aes-256-gcm+rsa-pss-sha256" || cert.Alg == "base64+rsa-pss-sha256" ||
+		cert.Alg == "aes-256-gcm+rsa-sha256" || cert.Alg == "base64+rsa-sha256":
+		publicKey, err := v.rsaPublicKey()
 		if err != nil {
 			return err
 		}
 
-		msg := []byte("machine/" + cert.Enc)
 		sig, err := base64.StdEncoding.DecodeString(cert.Sig)
 		if err != nil {
-			return ErrMachineFileNotGenuine
+			return errNotGenuine
 		}
 
-		if ok := ed25519.Verify(publicKey, msg, sig); !ok {
-			return ErrMachineFileNotGenuine
+		digest := sha256.Sum256(msg)
+
+		if strings.HasSuffix(cert.Alg, "+rsa-pss-sha256") {
+			err = rsa.VerifyPSS(publicKey, crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		} else {
+			err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], sig)
+		}
+
+		if err != nil {
+			return errNotGenuine
 		}
 
 		return nil
 	default:
-		return ErrMachineFileNotSupported
+		return errNotSupported
 	}
 }
 
@@ -94,6 +113,14 @@ func (v *verifier) VerifyLicense(license *License) ([]byte, error) {
 	case license.Scheme == SchemeCodeEd25519:
 		dataset, err := v.verifyKey(license.Key)
 
+		return dataset, err
+	case license.Scheme == SchemeCodeRSAPKCS1Sign || license.Scheme == SchemeCodeRSAPSSSign:
+		dataset, err := v.verifyRSAKey(license.Key, license.Scheme == SchemeCodeRSAPSSSign)
+
+		return dataset, err
+	case license.Scheme == SchemeCodeRSAPKCS1Encrypt:
+		dataset, err := v.decryptRSAKey(license.Key)
+
 		return dataset, err
 	default:
 		return nil, ErrLicenseSchemeNotSupported
@@ -259,34 +286,122 @@ func (v *verifier) verifyKey(key string) ([]byte, error) {
 		return nil, err
 	}
 
+	msg, sig, dataset, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok := ed25519.Verify(publicKey, msg, sig); !ok {
+		return nil, ErrLicenseKeyNotGenuine
+	}
+
+	return dataset, nil
+}
+
+// verifyRSAKey verifies a key signed using RSA_2048_PKCS1_SIGN_V2, or using
+// RSA_2048_PKCS1_PSS_SIGN_V2 when pss is true. Both are signed over the
+// SHA256 digest of the key's signing data.
+func (v *verifier) verifyRSAKey(key string, pss bool) ([]byte, error) {
+	publicKey, err := v.rsaPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, sig, dataset, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(msg)
+
+	if pss {
+		err = rsa.VerifyPSS(publicKey, crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+	} else {
+		err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], sig)
+	}
+
+	if err != nil {
+		return nil, ErrLicenseKeyNotGenuine
+	}
+
+	return dataset, nil
+}
+
+// decryptRSAKey decrypts a key encrypted using RSA_2048_PKCS1_ENCRYPT, i.e.
+// a dataset encrypted with the private key, using PKCS1 v1.5 padding. Since
+// only the private key can encrypt, a key that decrypts is genuine.
+func (v *verifier) decryptRSAKey(key string) ([]byte, error) {
+	publicKey, err := v.rsaPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, ErrLicenseKeyNotGenuine
+	}
+
+	size := publicKey.Size()
+	if len(ciphertext) != size {
+		return nil, ErrLicenseKeyNotGenuine
+	}
+
+	c := new(big.Int).SetBytes(ciphertext)
+	if c.Cmp(publicKey.N) >= 0 {
+		return nil, ErrLicenseKeyNotGenuine
+	}
+
+	m := new(big.Int).Exp(c, big.NewInt(int64(publicKey.E)), publicKey.N)
+	em := m.FillBytes(make([]byte, size))
+
+	// Unpad, i.e. 0x00 || 0x01 || 0xff... || 0x00 || dataset
+	if em[0] != 0x00 || em[1] != 0x01 {
+		return nil, ErrLicenseKeyNotGenuine
+	}
+
+	i := 2
+	for i < size && em[i] == 0xff {
+		i++
+	}
+
+	// The padding is at least 8 bytes
+	if i == size || i < 10 || em[i] != 0x00 {
+		return nil, ErrLicenseKeyNotGenuine
+	}
+
+	return em[i+1:], nil
+}
+
+// splitKey splits a signed key, i.e. key/{dataset}.{signature}, into its
+// signing data, signature and decoded dataset.
+func splitKey(key string) ([]byte, []byte, []byte, error) {
 	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return nil, nil, nil, ErrLicenseKeyNotGenuine
+	}
+
 	signingData := parts[0]
 	encSig := parts[1]
 
 	parts = strings.SplitN(signingData, "/", 2)
-	signingPrefix := parts[0]
-	encDataset := parts[1]
-
-	if signingPrefix != "key" {
-		return nil, ErrLicenseKeyNotGenuine
+	if len(parts) != 2 || parts[0] != "key" {
+		return nil, nil, nil, ErrLicenseKeyNotGenuine
 	}
 
+	encDataset := parts[1]
+
 	msg := []byte("key/" + encDataset)
 	sig, err := base64.URLEncoding.DecodeString(encSig)
 	if err != nil {
-		return nil, ErrLicenseKeyNotGenuine
+		return nil, nil, nil, ErrLicenseKeyNotGenuine
 	}
 
 	dataset, err := base64.URLEncoding.DecodeString(encDataset)
 	if err != nil {
-		return nil, ErrLicenseKeyNotGenuine
+		return nil, nil, nil, ErrLicenseKeyNotGenuine
 	}
 
-	if ok := ed25519.Verify(publicKey, msg, sig); !ok {
-		return nil, ErrLicenseKeyNotGenuine
-	}
-
-	return dataset, nil
+	return msg, sig, dataset, nil
 }
 
 func (v *verifier) publicKeyBytes() ([]byte, error) {
@@ -306,6 +421,43 @@ func (v *verifier) publicKeyBytes() ([]byte, error) {
 	return key, nil
 }
 
+// rsaPublicKey parses the PEM-encoded RSA public key, in either PKIX or
+// PKCS1 form.
+func (v *verifier) rsaPublicKey() (*rsa.PublicKey, error) {
+	if v.RSAPublicKey == "" {
+		return nil, ErrPublicKeyMissing
+	}
+
+	block, _ := pem.Decode([]byte(v.RSAPublicKey))
+	if block == nil {
+		return nil, ErrPublicKeyInvalid
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, ErrPublicKeyInvalid
+		}
+
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, ErrPublicKeyInvalid
+		}
+
+		return publicKey, nil
+	case "RSA PUBLIC KEY":
+		publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, ErrPublicKeyInvalid
+		}
+
+		return publicKey, nil
+	default:
+		return nil, ErrPublicKeyInvalid
+	}
+}
+
 func parseSignatureHeader(header string) map[string]string {
 	params := make(map[string]string)
 
@@ -24,7 +24,15 @@ import (
 //		http.ListenAndServe(":8081", nil)
 //	}
 func VerifyWebhook(request *http.Request) error {
-	verifier := &verifier{PublicKey: PublicKey}
+	client := NewClient()
+
+	return client.VerifyWebhook(request)
+}
+
+// VerifyWebhook verifies the signature of a webhook request sent from
+// Keygen, using the client's public key.
+func (c *Client) VerifyWebhook(request *http.Request) error {
+	verifier := &verifier{PublicKey: c.PublicKey}
 
 	return verifier.VerifyRequest(request)
 }